@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// adminTimeout bounds the requests of the admin commands.
+const adminTimeout = 10 * time.Second
+
+// adminSocket returns the path of the admin socket: --socket, or the config
+// file with a .sock extension.
+func adminSocket(ctx *cli.Context) string {
+	if socket := ctx.GlobalString("socket"); socket != "" {
+		return socket
+	}
+	configFile := ctx.GlobalString("conf")
+	return strings.TrimSuffix(configFile, filepath.Ext(configFile)) + ".sock"
+}
+
+// adminServer serves the JSON admin API of a running agent, connector or up.
+type adminServer struct {
+	mode       string
+	name       string
+	configFile string
+	node       host.Host
+	started    time.Time
+	// peers returns the peers currently configured, by name.
+	peers func() map[string]peer.ID
+	// reload re-reads and applies the config, nil if the mode can't reload.
+	reload func() error
+	// forwards runs the forwards of up, nil in the other modes.
+	forwards *forwarder
+}
+
+// adminStatus is the answer of GET /status.
+type adminStatus struct {
+	Name      string             `json:"name"`
+	ID        string             `json:"id"`
+	Mode      string             `json:"mode"`
+	Started   time.Time          `json:"started"`
+	Addrs     []string           `json:"addrs"`
+	Peers     int                `json:"peers"`
+	Connected int                `json:"connected"`
+	Tunnels   int                `json:"tunnels"`
+	Forwards  map[string]Forward `json:"forwards,omitempty"`
+}
+
+// adminPeer is an entry of GET /peers.
+type adminPeer struct {
+	Name          string   `json:"name"`
+	ID            string   `json:"id"`
+	Connectedness string   `json:"connectedness"`
+	Addrs         []string `json:"addrs"`
+}
+
+// adminForward is the body of POST /forwards.
+type adminForward struct {
+	Name string `json:"name"`
+	Forward
+}
+
+// serveAdmin serves the admin API on the Unix socket at path until ctx is
+// done. The socket is only accessible by the owner.
+func serveAdmin(ctx context.Context, path string, a *adminServer) error {
+	// A socket left behind by a crashed process is replaced, one which still
+	// answers belongs to another process.
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return errors.Errorf("%s is in use by another process", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: a.handler()}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+		os.Remove(path)
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			logger.Errorw("admin API", "error", err)
+		}
+	}()
+	logger.Infow("admin API listening", "socket", path)
+	return nil
+}
+
+// listenPrivate listens on a Unix socket at path which only the owner can
+// connect to from the start. The socket is created and restricted inside a new
+// directory only the owner can enter, then moved to path.
+func listenPrivate(path string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".admin")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed at its final path by serveAdmin.
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", a.handleStatus)
+	mux.HandleFunc("/peers", a.handlePeers)
+	mux.HandleFunc("/tunnels", a.handleTunnels)
+	mux.HandleFunc("/forwards", a.handleForwards)
+	mux.HandleFunc("/forwards/", a.handleForward)
+	mux.HandleFunc("/reload", a.handleReload)
+	return mux
+}
+
+func (a *adminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	status := adminStatus{
+		Name:    a.name,
+		ID:      a.node.ID().Pretty(),
+		Mode:    a.mode,
+		Started: a.started,
+		Tunnels: tunnels.count(),
+	}
+	for _, addr := range a.node.Addrs() {
+		status.Addrs = append(status.Addrs, addr.String())
+	}
+	for _, id := range a.peers() {
+		status.Peers++
+		if a.node.Network().Connectedness(id) == network.Connected {
+			status.Connected++
+		}
+	}
+	if a.forwards != nil {
+		status.Forwards = a.forwards.list()
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (a *adminServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	peers := []adminPeer{}
+	for name, id := range a.peers() {
+		p := adminPeer{
+			Name:          name,
+			ID:            id.Pretty(),
+			Connectedness: a.node.Network().Connectedness(id).String(),
+			Addrs:         []string{},
+		}
+		// Prefer the addresses in use over all known ones.
+		for _, c := range a.node.Network().ConnsToPeer(id) {
+			p.Addrs = append(p.Addrs, c.RemoteMultiaddr().String())
+		}
+		if len(p.Addrs) == 0 {
+			for _, addr := range a.node.Peerstore().Addrs(id) {
+				p.Addrs = append(p.Addrs, addr.String())
+			}
+		}
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (a *adminServer) handleTunnels(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, tunnels.list())
+}
+
+// handleForwards lists the forwards, or adds one to the config and applies it.
+func (a *adminServer) handleForwards(w http.ResponseWriter, r *http.Request) {
+	if a.forwards == nil {
+		writeError(w, http.StatusBadRequest, errors.New("forwards are only run by `p2ptunnel up`"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.forwards.list())
+	case http.MethodPost:
+		var fwd adminForward
+		if err := json.NewDecoder(r.Body).Decode(&fwd); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		_, err := updateConf(a.configFile, func(conf *Config) error {
+			if _, ok := conf.Forwards[fwd.Name]; ok {
+				return errors.Errorf("forward %s exists already", fwd.Name)
+			}
+			if conf.Forwards == nil {
+				conf.Forwards = make(map[string]Forward)
+			}
+			conf.Forwards[fwd.Name] = fwd.Forward
+			// Line numbers of the file read would be misleading now.
+			conf.raw = nil
+			return conf.check()
+		})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		a.applyChange(w)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleForward removes the forward named by the path from the config.
+func (a *adminServer) handleForward(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	if a.forwards == nil {
+		writeError(w, http.StatusBadRequest, errors.New("forwards are only run by `p2ptunnel up`"))
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/forwards/")
+	status := http.StatusBadRequest
+	_, err := updateConf(a.configFile, func(conf *Config) error {
+		if _, ok := conf.Forwards[name]; !ok {
+			status = http.StatusNotFound
+			return errors.Errorf("no forward %s", name)
+		}
+		delete(conf.Forwards, name)
+		return nil
+	})
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	a.applyChange(w)
+}
+
+func (a *adminServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if a.reload == nil {
+		writeError(w, http.StatusBadRequest, errors.Errorf("the %s doesn't reload its config", a.mode))
+		return
+	}
+	logger.Infow("reloading config", "config", a.configFile, "reason", "admin API")
+	a.applyChange(w)
+}
+
+// applyChange reloads the config after it was changed through the API.
+func (a *adminServer) applyChange(w http.ResponseWriter) {
+	if err := a.reload(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Debugw("admin API: write response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// adminRequest calls the admin API of the running process and decodes its
+// answer into out, unless out is nil.
+func adminRequest(ctx *cli.Context, method, path string, body, out interface{}) error {
+	socket := adminSocket(ctx)
+	client := &http.Client{
+		Timeout: adminTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, "http://p2ptunnel"+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "connect to %s, is p2ptunnel running?", socket)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return errors.Errorf("admin API: %s", resp.Status)
+		}
+		return errors.New(e.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// printJSON prints v indented, for the --json flag of the admin commands.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func statusCmd(ctx *cli.Context) error {
+	var status adminStatus
+	if err := adminRequest(ctx, http.MethodGet, "/status", nil, &status); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(status)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", status.Name)
+	fmt.Fprintf(w, "ID:\t%s\n", status.ID)
+	fmt.Fprintf(w, "Mode:\t%s\n", status.Mode)
+	fmt.Fprintf(w, "Uptime:\t%s\n", time.Since(status.Started).Round(time.Second))
+	fmt.Fprintf(w, "Peers:\t%d (%d connected)\n", status.Peers, status.Connected)
+	fmt.Fprintf(w, "Tunnels:\t%d\n", status.Tunnels)
+	for _, addr := range status.Addrs {
+		fmt.Fprintf(w, "Address:\t%s\n", addr)
+	}
+	for _, name := range sortedKeys(status.Forwards) {
+		fwd := status.Forwards[name]
+		fmt.Fprintf(w, "Forward:\t%s %s -> %s/%s\n", name, fwd.Listen, fwd.Peer, fwd.Service)
+	}
+	return w.Flush()
+}
+
+func peersCmd(ctx *cli.Context) error {
+	var peers []adminPeer
+	if err := adminRequest(ctx, http.MethodGet, "/peers", nil, &peers); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(peers)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tID\tSTATE\tADDRESSES")
+	for _, p := range peers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Name, p.ID, p.Connectedness, strings.Join(p.Addrs, ","))
+	}
+	return w.Flush()
+}
+
+func tunnelsCmd(ctx *cli.Context) error {
+	var list []tunnelStats
+	if err := adminRequest(ctx, http.MethodGet, "/tunnels", nil, &list); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(list)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDIR\tPEER\tSERVICE\tLOCAL\tAGE\tIN\tOUT")
+	for _, t := range list {
+		service := t.Service
+		if t.Dest != "" {
+			service += " (" + t.Dest + ")"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Direction, t.Peer, service, t.Local,
+			time.Since(t.Started).Round(time.Second), formatBytes(t.BytesIn), formatBytes(t.BytesOut))
+	}
+	return w.Flush()
+}
+
+// formatBytes formats n with a binary unit, e.g. 1.5 KiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminCall sends a request to the handler of a and decodes the JSON answer
+// into out, unless out is nil. It returns the status code.
+func adminCall(t *testing.T, a *adminServer, method, path, body string, out interface{}) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	a.handler().ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s %s: content type %q", method, path, ct)
+	}
+	if out != nil {
+		if err := json.NewDecoder(rec.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAdminStatus(t *testing.T) {
+	node := newTestHost(t, newTestKey(t))
+	laptop, phone := newTestHost(t, newTestKey(t)), newTestHost(t, newTestKey(t))
+	if err := node.Connect(context.Background(), peer.AddrInfo{ID: laptop.ID(), Addrs: laptop.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	a := &adminServer{
+		mode:    "agent",
+		name:    "home",
+		node:    node,
+		started: time.Now(),
+		peers: func() map[string]peer.ID {
+			return map[string]peer.ID{"phone": phone.ID(), "laptop": laptop.ID()}
+		},
+	}
+
+	var status adminStatus
+	if code := adminCall(t, a, http.MethodGet, "/status", "", &status); code != http.StatusOK {
+		t.Fatalf("GET /status = %d", code)
+	}
+	if status.Name != "home" || status.Mode != "agent" || status.ID != node.ID().Pretty() ||
+		status.Peers != 2 || status.Connected != 1 || len(status.Addrs) == 0 || status.Forwards != nil {
+		t.Errorf("GET /status = %+v", status)
+	}
+
+	var peers []adminPeer
+	if code := adminCall(t, a, http.MethodGet, "/peers", "", &peers); code != http.StatusOK {
+		t.Fatalf("GET /peers = %d", code)
+	}
+	if len(peers) != 2 || peers[0].Name != "laptop" || peers[1].Name != "phone" {
+		t.Fatalf("GET /peers = %+v", peers)
+	}
+	if peers[0].Connectedness != "Connected" || len(peers[0].Addrs) == 0 || peers[1].Connectedness != "NotConnected" {
+		t.Errorf("GET /peers = %+v", peers)
+	}
+
+	var list []tunnelStats
+	if code := adminCall(t, a, http.MethodGet, "/tunnels", "", &list); code != http.StatusOK || len(list) != 0 {
+		t.Errorf("GET /tunnels = %d, %+v", code, list)
+	}
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodPost, "/status", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/peers", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/forwards", http.StatusBadRequest},
+		{http.MethodDelete, "/forwards/web", http.StatusBadRequest},
+		{http.MethodGet, "/reload", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/reload", http.StatusBadRequest},
+		{http.MethodGet, "/nothing", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		a.handler().ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminForwards(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	node := newTestHost(t, newTestKey(t))
+	home := newTestHost(t, newTestKey(t))
+	if err := node.Connect(ctx, peer.AddrInfo{ID: home.ID(), Addrs: home.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	conf, file := newTestConf(t)
+	conf.Peers["home"] = Peer{ID: home.ID().Pretty()}
+	if err := writeConf(file, conf); err != nil {
+		t.Fatal(err)
+	}
+	fwd := newForwarder(ctx, node, nil)
+	defer func() {
+		cancel()
+		fwd.wait()
+	}()
+	reloads := 0
+	a := &adminServer{
+		mode:       "up",
+		configFile: file,
+		node:       node,
+		peers:      func() map[string]peer.ID { return nil },
+		forwards:   fwd,
+		reload: func() error {
+			reloads++
+			return reloadConf(file, func(conf *Config) error {
+				fwd.apply(conf)
+				return nil
+			})
+		},
+	}
+
+	addr := freeAddr(t)
+	body := `{"name": "web", "listen": "` + addr + `", "peer": "home", "service": "web"}`
+	if code := adminCall(t, a, http.MethodPost, "/forwards", body, nil); code != http.StatusOK {
+		t.Fatalf("POST /forwards = %d", code)
+	}
+	waitListening(t, addr, true)
+	var list map[string]Forward
+	if code := adminCall(t, a, http.MethodGet, "/forwards", "", &list); code != http.StatusOK || list["web"].Listen != addr {
+		t.Errorf("GET /forwards = %d, %+v", code, list)
+	}
+	saved, err := readConf(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Forwards["web"].Peer != "home" {
+		t.Errorf("forward not saved: %+v", saved.Forwards)
+	}
+
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPost, "/forwards", body, http.StatusBadRequest},
+		{http.MethodPost, "/forwards", `{"name": "db", "listen": "` + freeAddr(t) + `", "peer": "nobody"}`, http.StatusBadRequest},
+		{http.MethodPost, "/forwards", `{`, http.StatusBadRequest},
+		{http.MethodDelete, "/forwards/db", "", http.StatusNotFound},
+		{http.MethodGet, "/forwards/web", "", http.StatusMethodNotAllowed},
+		{http.MethodPut, "/forwards", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		var e map[string]string
+		if code := adminCall(t, a, tt.method, tt.path, tt.body, &e); code != tt.want || e["error"] == "" {
+			t.Errorf("%s %s = %d %v, want %d and an error", tt.method, tt.path, code, e, tt.want)
+		}
+	}
+	if reloads != 1 {
+		t.Errorf("%d reloads after failed changes, want 1", reloads)
+	}
+
+	if code := adminCall(t, a, http.MethodDelete, "/forwards/web", "", nil); code != http.StatusOK {
+		t.Fatalf("DELETE /forwards/web = %d", code)
+	}
+	waitListening(t, addr, false)
+	if code := adminCall(t, a, http.MethodPost, "/reload", "", nil); code != http.StatusOK || reloads != 3 {
+		t.Errorf("POST /reload = %d after %d reloads", code, reloads)
+	}
+}
+
+func TestServeAdminSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "p2ptunnel.sock")
+	a := &adminServer{mode: "agent", node: newTestHost(t, newTestKey(t)), peers: func() map[string]peer.ID { return nil }}
+	if err := serveAdmin(ctx, path, a); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v, want a socket for the owner only", fi.Mode())
+	}
+	if files, _ := os.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Errorf("%d files next to the socket, want none", len(files)-1)
+	}
+	if err := serveAdmin(ctx, path, a); err == nil {
+		t.Error("served twice on the same socket")
+	}
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("socket left behind")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,196 +2,357 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/p2ptunnel/p2ptunnel/pkg/httplogger"
+	"github.com/p2ptunnel/p2ptunnel/pkg/tunnel"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
-	"io"
-	"log"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var (
-	revLookup   map[string]string
+// agentServer serves the tunnels, pairings and file transfers of the peers in
+// the config applied last, for the agent and for `up`.
+type agentServer struct {
+	// node is the host the server runs on, set once it is created.
+	node host.Host
+	// forwardPort is the port given on the agent's command line, served as
+	// the default service.
 	forwardPort int
-)
+
+	// lock guards conf and lookup against concurrent reloads.
+	lock sync.RWMutex
+	conf *Config
+	// lookup maps the peer IDs of conf to their names.
+	lookup map[string]string
+}
+
+// newAgentServer returns a server applying conf, which it validates.
+func newAgentServer(conf *Config, forwardPort int) (*agentServer, error) {
+	a := &agentServer{forwardPort: forwardPort}
+	if _, _, err := a.swap(conf); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
 
 func agent(ctx *cli.Context) error {
 	conf, err := readConf(ctx.GlobalString("conf"))
 	if err != nil {
 		return err
 	}
-	if len(ctx.Args()) != 1 {
-		return errors.New("Please provide forwarding port number")
+	if len(ctx.Args()) > 1 {
+		return errors.New("Please provide at most one forwarding port number")
 	}
 
-	verbose = ctx.GlobalBool("verbose")
-	if verbose {
-		logger = httplogger.New(nil)
+	forwardPort := 0
+	if len(ctx.Args()) == 1 {
+		forwardPort, err = strconv.Atoi(ctx.Args()[0])
+		if err != nil {
+			return err
+		}
 	}
-
-	forwardPort, err = strconv.Atoi(ctx.Args()[0])
+	a, err := newAgentServer(conf, forwardPort)
 	if err != nil {
 		return err
 	}
-
-	// Setup reverse lookup hash map for authentication.
-	revLookup = make(map[string]string, len(conf.Peers))
-	// Setup Peer Table for Quick Packet --> Dest ID lookup
-	peerTable := make(map[string]peer.ID)
-	for name, p := range conf.Peers {
-		revLookup[p.ID] = name
-		peerTable[name], err = peer.Decode(p.ID)
-		if err != nil {
-			return err
-		}
+	if len(conf.Services) == 0 {
+		return errors.New("Please provide forwarding port number or configure services")
 	}
 
 	// Setup System Context
 	cctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	fmt.Println("[+] Creating LibP2P Node")
+	// Recording starts before the stream handlers which record tunnels.
+	if err := startRecording(ctx); err != nil {
+		return err
+	}
+	defer stopRecording()
 
 	// Create P2P Node
-	fmt.Printf("My ID: %s\n", conf.ID)
+	logger.Infow("creating libp2p node", "id", conf.ID)
+	key, err := loadPrivateKey(ctx, conf)
+	if err != nil {
+		return err
+	}
 	host, _, err := CreateNode(
 		cctx,
-		conf.PrivateKey,
+		key,
 		ctx.Uint("port"),
-		streamHandlerAgent,
+		a.handleStream,
 	)
 	if err != nil {
 		return err
 	}
+	a.node = host
+
+	// Let peers holding an invite token pair with us.
+	host.SetStreamHandler(PairProtocol, a.pairHandler(ctx.GlobalString("conf")))
+	// Store the files peers send, if the config enables receiving.
+	host.SetStreamHandler(FileProtocol, a.fileHandler(ctx.GlobalString("conf")))
 
 	// Register the application to listen for SIGINT/SIGTERM
 	go signalExit(cancel, host)
 
+	// Disconnect peers once their access expires.
+	go a.enforceGrants(cctx)
+
+	// Reload peers on SIGHUP, or whenever the config file changes.
+	configFile := ctx.GlobalString("conf")
+	go watchConf(cctx, configFile, ctx.Bool("watch"), a.reload)
+
+	if err := serveMetrics(cctx, ctx.String("metrics-listen"), host); err != nil {
+		return err
+	}
+
+	admin := &adminServer{
+		mode:       "agent",
+		name:       conf.Name,
+		configFile: configFile,
+		node:       host,
+		started:    time.Now(),
+		peers:      a.peers,
+		reload:     func() error { return reloadConf(configFile, a.reload) },
+	}
+	if err := serveAdmin(cctx, adminSocket(ctx), admin); err != nil {
+		logger.Warnw("admin API disabled", "error", err)
+	}
+
 	<-cctx.Done()
 	return nil
 }
 
-func streamHandlerAgent(stream network.Stream) {
-	// If the remote node ID isn't in the list of known nodes don't respond.
-	fmt.Printf("stream handle: %s from %+v\n", stream.Conn().RemotePeer().Pretty(), revLookup)
-	if _, ok := revLookup[stream.Conn().RemotePeer().Pretty()]; !ok {
-		fmt.Println("not found, need reset")
-		if err := stream.Reset(); err != nil {
-			log.Printf("while reset stream: %v", err)
-		}
+// addDefaultService exposes the forward port given on the command line as the
+// default service, unless the config defines one itself.
+func (a *agentServer) addDefaultService(conf *Config) {
+	if a.forwardPort == 0 {
 		return
 	}
-	/*
-		var requestSize = make([]byte, 2)
-		// Read the incoming packet's size as a binary value.
-		_, err := stream.Read(requestSize)
+	if _, ok := conf.Services[defaultService]; ok {
+		return
+	}
+	if conf.Services == nil {
+		conf.Services = make(map[string]Service)
+	}
+	conf.Services[defaultService] = Service{Addr: "localhost:" + strconv.Itoa(a.forwardPort)}
+}
+
+// buildRevLookup maps every peer ID in conf to its name, validating the IDs.
+func buildRevLookup(conf *Config) (map[string]string, error) {
+	lookup := make(map[string]string, len(conf.Peers))
+	for name, p := range conf.Peers {
+		id, err := peer.Decode(p.ID)
 		if err != nil {
-			stream.Close()
-			return
+			return nil, errors.Wrapf(err, "peer %s", name)
 		}
+		lookup[id.Pretty()] = name
+	}
+	return lookup, nil
+}
 
-		// Decode the incoming packet's size from binary.
-		size := binary.LittleEndian.Uint16(requestSize)
-	*/
-
-	// TODO: use persistent connection
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", "localhost:"+strconv.Itoa(forwardPort))
-	if err != nil {
-		fmt.Printf("resolve local service tcp:%d : %s", forwardPort, err)
-		return
+// swap validates conf and applies it, returning the config and lookup it
+// replaced.
+func (a *agentServer) swap(conf *Config) (*Config, map[string]string, error) {
+	a.addDefaultService(conf)
+	if err := conf.check(); err != nil {
+		return nil, nil, err
 	}
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
-	for err != nil {
-		fmt.Println(err)
-		return
+	lookup, err := buildRevLookup(conf)
+	if err != nil {
+		return nil, nil, err
 	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	old, oldLookup := a.conf, a.lookup
+	a.conf, a.lookup = conf, lookup
+	return old, oldLookup, nil
+}
 
-	defer func() {
-		if err = conn.Close(); err != nil {
-			fmt.Printf("close forwarding connection got: %v\n", err)
-		}
-	}()
+// config returns the applied config, which must not be changed.
+func (a *agentServer) config() *Config {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.conf
+}
 
-	//fmt.Printf("got %d byte, length: %d\n", requestSize, size)
+// authorize checks the request of the named peer against the applied config
+// and returns the address to forward the stream to.
+func (a *agentServer) authorize(name string, req tunnel.Request) (string, error) {
+	return a.config().authorize(name, req)
+}
 
-	// Read in the packet until completion.
-	var buffer = make([]byte, 1024)
-	defer func() {
-		// free memory explicitly
-		buffer = nil
-	}()
+// checkGrant checks the grant of the named peer in the applied config.
+func (a *agentServer) checkGrant(name string, now time.Time) error {
+	return a.config().checkGrant(name, now)
+}
 
-	if verbose {
-		logger.Reset()
-		fmt.Println("--->")
-	}
+// lookupPeer returns the configured name of a remote peer ID.
+func (a *agentServer) lookupPeer(id string) (string, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	name, ok := a.lookup[id]
+	return name, ok
+}
 
-	for {
-		readSize, err := stream.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				fmt.Println("(EOF)")
-				return
-			}
-			stream.Close()
-			fmt.Printf("read error: %v", err)
-			return
+// peers returns the peers of the applied config by name.
+func (a *agentServer) peers() map[string]peer.ID {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	peers := make(map[string]peer.ID, len(a.lookup))
+	for id, name := range a.lookup {
+		if pid, err := peer.Decode(id); err == nil {
+			peers[name] = pid
 		}
+	}
+	return peers
+}
 
-		if verbose {
-			logger.Print(buffer)
-		}
+// reload swaps in the peers of conf. Streams of peers that are unchanged are
+// left alone, while peers that were removed or changed ID are disconnected.
+func (a *agentServer) reload(conf *Config) error {
+	old, oldLookup, err := a.swap(conf)
+	if err != nil {
+		return err
+	}
 
-		writeSize, err := conn.Write(buffer[:readSize])
+	if old.ID != conf.ID || old.PrivateKey != conf.PrivateKey {
+		logger.Warn("identity changes are only applied after a restart")
+	}
+
+	diff := append(diffPeers(old.Peers, conf.Peers), diffServices(old.Services, conf.Services)...)
+	if len(diff) == 0 {
+		logger.Info("config reloaded, no changes")
+		return nil
+	}
+	logger.Infow("config reloaded", "changes", diff)
+
+	for id := range oldLookup {
+		if _, ok := a.lookupPeer(id); ok {
+			continue
+		}
+		pid, err := peer.Decode(id)
 		if err != nil {
-			fmt.Println(err)
-			return
+			continue
 		}
-		if writeSize != readSize {
-			fmt.Printf("forward expect write %d bytes, actually %d bytes\n", readSize, writeSize)
-			return
+		if err := a.node.Network().ClosePeer(pid); err != nil {
+			logger.Warnw("disconnect removed peer", "peer_id", id, "error", err)
 		}
+	}
+	return nil
+}
 
-		if readSize < 1024 {
-			break
+// handleStream forwards a tunnel stream of a configured peer to the service it
+// asks for.
+func (a *agentServer) handleStream(stream network.Stream) {
+	started := time.Now()
+	slog := logger.With(
+		"stream_id", stream.ID(),
+		"remote_addr", stream.Conn().RemoteMultiaddr().String(),
+	)
+	// If the remote node ID isn't in the list of known nodes don't respond.
+	name, ok := a.lookupPeer(stream.Conn().RemotePeer().Pretty())
+	if !ok {
+		slog.Warnw("reset stream of unknown peer", "peer_id", stream.Conn().RemotePeer().Pretty())
+		streamsRejected.WithLabelValues("", "").Inc()
+		if err := stream.Reset(); err != nil {
+			slog.Debugw("reset stream", "error", err)
 		}
+		return
 	}
+	slog = slog.With("peer", name)
 
-	if verbose {
-		logger.Reset()
-		fmt.Println("<---")
+	req, err := tunnel.ReceiveRequest(stream)
+	if err != nil {
+		slog.Warnw("read tunnel request", "error", err)
+		if err := stream.Reset(); err != nil {
+			slog.Debugw("reset stream", "error", err)
+		}
+		return
+	}
+	slog = slog.With("service", req.Service)
+	label := a.config().serviceLabel(req.Service)
+	addr, err := a.authorize(name, req)
+	if err != nil {
+		slog.Warnw("deny tunnel request", "error", err)
+		streamsRejected.WithLabelValues(name, label).Inc()
+		if err := tunnel.WriteResponse(stream, err.Error()); err != nil {
+			slog.Debugw("send denial", "error", err)
+		}
+		stream.Close()
+		return
 	}
 
-	readSize := 0
-	for readSize < len(buffer) {
-		readSize, err = conn.Read(buffer)
+	serve, builtin := builtinServices[req.Service]
+	var conn net.Conn
+	if !builtin {
+		// TODO: use persistent connection
+		conn, err = net.Dial("tcp", addr)
 		if err != nil {
-			if err == io.EOF {
-				fmt.Println("reach EOF of read reply")
-			} else {
-				fmt.Printf("failed to read reply: %s\n", err)
+			slog.Errorw("dial local service", "local", addr, "error", err)
+			streamsRejected.WithLabelValues(name, label).Inc()
+			if err := tunnel.WriteResponse(stream, "service unavailable"); err != nil {
+				slog.Debugw("send denial", "error", err)
 			}
+			stream.Close()
 			return
 		}
-		if readSize == 0 {
-			fmt.Println("read empty data")
-			break
-		}
-		if verbose {
-			logger.Print(buffer[:readSize])
-		}
-		writeSize, err := stream.Write(buffer[:readSize])
-		if err != nil {
-			fmt.Printf("failed to write reply to peer: %s\n", err)
-			return
+	}
+	if err := tunnel.WriteResponse(stream, ""); err != nil {
+		slog.Warnw("accept tunnel request", "error", err)
+		if conn != nil {
+			conn.Close()
 		}
-		if writeSize != readSize {
-			fmt.Printf("reply expect write %d bytes, actually %d bytes\n", readSize, writeSize)
+		return
+	}
+	streamsAccepted.WithLabelValues(name, label).Inc()
+	slog.Debugw("tunnel accepted", "local", addr)
+
+	stats := tunnels.add(&tunnelStats{Direction: "in", Peer: name, Service: req.Service, Dest: req.Dest, Local: addr})
+	defer tunnels.remove(stats)
+	stream = newCountingStream(stream, stats)
+	defer func() {
+		slog.Debugw("tunnel closed",
+			"bytes", atomic.LoadInt64(&stats.BytesIn)+atomic.LoadInt64(&stats.BytesOut),
+			"duration", time.Since(started),
+		)
+	}()
+
+	if builtin {
+		if err := serve(stream); err != nil {
+			slog.Warnw("serve built-in service", "error", err)
+			stream.Reset()
 			return
 		}
+		stream.Close()
+		return
+	}
+
+	httpLog := httplogger.NewConn(name, req.Service, httpSinks...)
+	defer httpLog.Close()
+
+	// forwarded is when the first bytes went to the local service, in Unix
+	// nanoseconds, for the time until its first reply.
+	var forwarded int64
+	var replied sync.Once
+	fromStream := func(b []byte) {
+		atomic.CompareAndSwapInt64(&forwarded, 0, time.Now().UnixNano())
+		httpLog.Request(b)
+	}
+	fromLocal := func(b []byte) {
+		replied.Do(func() {
+			if t := atomic.LoadInt64(&forwarded); t != 0 {
+				firstByteDuration.WithLabelValues(req.Service).Observe(time.Since(time.Unix(0, t)).Seconds())
+			}
+		})
+		httpLog.Response(b)
+	}
+	if err := pipe(stream, conn, fromStream, fromLocal); err != nil {
+		slog.Warnw("forward tunnel", "error", err)
 	}
 }
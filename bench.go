@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Services the agent serves itself, for bench. Their names can't clash with
+// configured services, which start with a letter or digit.
+const (
+	// echoService sends back what it receives.
+	echoService = "@echo"
+	// sinkService discards what it receives and answers the number of bytes
+	// as a little endian uint64 once the tunnel is closed for writing.
+	sinkService = "@sink"
+)
+
+// builtinServices serve the built-in services on accepted tunnels. Like other
+// services, they are available to the peers allowed to use them, which are
+// all peers without a services list.
+var builtinServices = map[string]func(rw io.ReadWriter) error{
+	echoService: func(rw io.ReadWriter) error {
+		_, err := io.Copy(rw, rw)
+		return err
+	},
+	sinkService: func(rw io.ReadWriter) error {
+		n, err := io.Copy(ioutil.Discard, rw)
+		if err != nil {
+			return err
+		}
+		return binary.Write(rw, binary.LittleEndian, uint64(n))
+	},
+}
+
+// benchDialer opens tunnels to a built-in service of the benchmarked peer.
+type benchDialer func(ctx context.Context, service string) (net.Conn, error)
+
+// benchStats summarizes the durations of a benchmark, in milliseconds for the
+// JSON report.
+type benchStats struct {
+	Count int     `json:"count"`
+	Min   float64 `json:"min_ms"`
+	Mean  float64 `json:"mean_ms"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+// newBenchStats returns the stats of samples, which it sorts.
+func newBenchStats(samples []time.Duration) benchStats {
+	if len(samples) == 0 {
+		return benchStats{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	var sum time.Duration
+	for _, d := range samples {
+		sum += d
+	}
+	return benchStats{
+		Count: len(samples),
+		Min:   ms(samples[0]),
+		Mean:  ms(sum / time.Duration(len(samples))),
+		P50:   ms(percentile(samples, 50)),
+		P90:   ms(percentile(samples, 90)),
+		P99:   ms(percentile(samples, 99)),
+		Max:   ms(samples[len(samples)-1]),
+	}
+}
+
+func (s benchStats) String() string {
+	return fmt.Sprintf("min %.2fms  p50 %.2fms  p90 %.2fms  p99 %.2fms  max %.2fms", s.Min, s.P50, s.P90, s.P99, s.Max)
+}
+
+// percentile returns the nearest-rank percentile p of the sorted samples.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(p/100*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// throughput is the result of a throughput benchmark.
+type throughput struct {
+	Streams int     `json:"streams"`
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+	// MiBps is the total throughput of all streams, in MiB per second.
+	MiBps float64 `json:"mib_per_second"`
+}
+
+func (t throughput) String() string {
+	return fmt.Sprintf("%.1f MiB in %.2fs  %.1f MiB/s", float64(t.Bytes)/(1<<20), t.Seconds, t.MiBps)
+}
+
+// benchReport is the result of bench, as written by --json.
+type benchReport struct {
+	Time time.Time `json:"time"`
+	Peer string    `json:"peer"`
+	// Path is "direct" or "relay", the kind of connection the tunnels took.
+	Path       string     `json:"path"`
+	RemoteAddr string     `json:"remote_addr"`
+	Latency    benchStats `json:"latency"`
+	Single     throughput `json:"single_stream"`
+	Multi      throughput `json:"multi_stream"`
+	Opens      benchStats `json:"stream_open"`
+	// OpenRate is the number of tunnels opened per second, one at a time.
+	OpenRate float64 `json:"stream_open_per_second"`
+}
+
+// bench measures the latency, throughput and stream-open rate of tunnels to a
+// peer, using the built-in services of its agent.
+func bench(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.New("Please provide the name of the peer to benchmark")
+	}
+	peerName := ctx.Args()[0]
+
+	cctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node, connector, err := newClient(cctx, ctx)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+	conf, err := readConf(ctx.GlobalString("conf"))
+	if err != nil {
+		return err
+	}
+	p, ok := conf.Peers[peerName]
+	if !ok {
+		return errors.Errorf("Peer %s is not in the config", peerName)
+	}
+	id, err := peer.Decode(p.ID)
+	if err != nil {
+		return err
+	}
+	if relay := ctx.String("relay"); relay != "" {
+		if err := useRelay(cctx, node, id, relay); err != nil {
+			return err
+		}
+	}
+
+	dial := func(ctx context.Context, service string) (net.Conn, error) {
+		return connector.Dial(ctx, peerName, service)
+	}
+	// The first tunnel connects to the peer, which isn't measured.
+	c, err := dial(cctx, echoService)
+	if err != nil {
+		return err
+	}
+	c.Close()
+
+	report := &benchReport{Time: time.Now().UTC(), Peer: peerName}
+	report.Path, report.RemoteAddr = connPath(node, id)
+	fmt.Printf("Benchmarking %s over a %s connection to %s\n", peerName, report.Path, report.RemoteAddr)
+	if err := runBench(cctx, dial, benchOptions{
+		Count:   ctx.Int("count"),
+		Size:    ctx.Int64("size") << 20,
+		Streams: ctx.Int("streams"),
+		Opens:   ctx.Int("opens"),
+	}, report); err != nil {
+		return err
+	}
+
+	if path := ctx.String("json"); path != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Report written to %s\n", path)
+	}
+	return nil
+}
+
+// benchOptions configures the benchmarks of runBench.
+type benchOptions struct {
+	// Count is the number of round trips measuring the latency.
+	Count int
+	// Size is the number of bytes sent by each throughput benchmark, split
+	// among Streams streams by the multi-stream one.
+	Size    int64
+	Streams int
+	// Opens is the number of tunnels opened measuring the stream-open rate.
+	Opens int
+}
+
+// runBench runs the benchmarks with tunnels opened by dial, printing their
+// results as they complete and adding them to report.
+func runBench(ctx context.Context, dial benchDialer, opts benchOptions, report *benchReport) error {
+	samples, err := benchLatency(ctx, dial, opts.Count)
+	if err != nil {
+		return errors.Wrap(err, "latency")
+	}
+	report.Latency = newBenchStats(samples)
+	printBench("latency", fmt.Sprintf("%d round trips", report.Latency.Count), report.Latency)
+
+	if report.Single, err = benchThroughput(ctx, dial, opts.Size, 1); err != nil {
+		return errors.Wrap(err, "single-stream throughput")
+	}
+	printBench("throughput", "1 stream", report.Single)
+	if report.Multi, err = benchThroughput(ctx, dial, opts.Size, opts.Streams); err != nil {
+		return errors.Wrap(err, "multi-stream throughput")
+	}
+	printBench("throughput", fmt.Sprintf("%d streams", report.Multi.Streams), report.Multi)
+
+	started := time.Now()
+	if samples, err = benchOpens(ctx, dial, opts.Opens); err != nil {
+		return errors.Wrap(err, "stream open")
+	}
+	report.Opens = newBenchStats(samples)
+	report.OpenRate = float64(len(samples)) / time.Since(started).Seconds()
+	printBench("stream open", fmt.Sprintf("%d opens", report.Opens.Count), fmt.Sprintf("%.1f/s  %s", report.OpenRate, report.Opens))
+	return nil
+}
+
+// printBench prints a result of runBench.
+func printBench(name, what string, result interface{}) {
+	fmt.Printf("%-13s%-18s%v\n", name, what, result)
+}
+
+// benchLatency measures count round trips of a small message through one echo
+// tunnel.
+func benchLatency(ctx context.Context, dial benchDialer, count int) ([]time.Duration, error) {
+	c, err := dial(ctx, echoService)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	msg := make([]byte, 32)
+	reply := make([]byte, len(msg))
+	samples := make([]time.Duration, 0, count)
+	for i := 0; i < count; i++ {
+		binary.LittleEndian.PutUint64(msg, uint64(i))
+		start := time.Now()
+		if _, err := c.Write(msg); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(c, reply); err != nil {
+			return nil, err
+		}
+		samples = append(samples, time.Since(start))
+		if binary.LittleEndian.Uint64(reply) != uint64(i) {
+			return nil, errors.New("echo sent back different bytes")
+		}
+	}
+	return samples, nil
+}
+
+// benchThroughput sends size bytes to the sink, split among streams tunnels
+// sending at the same time. It's done once the sink counted all bytes.
+func benchThroughput(ctx context.Context, dial benchDialer, size int64, streams int) (throughput, error) {
+	if streams < 1 {
+		streams = 1
+	}
+	conns := make([]net.Conn, streams)
+	for i := range conns {
+		c, err := dial(ctx, sinkService)
+		if err != nil {
+			for _, c := range conns[:i] {
+				c.Close()
+			}
+			return throughput{}, err
+		}
+		conns[i] = c
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, streams)
+	start := time.Now()
+	for i, c := range conns {
+		n := size / int64(streams)
+		if i == 0 {
+			n += size % int64(streams)
+		}
+		wg.Add(1)
+		go func(c net.Conn, n int64) {
+			defer wg.Done()
+			defer c.Close()
+			errs <- sinkSend(c, n)
+		}(c, n)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return throughput{}, err
+		}
+	}
+	return throughput{
+		Streams: streams,
+		Bytes:   size,
+		Seconds: elapsed.Seconds(),
+		MiBps:   float64(size) / (1 << 20) / elapsed.Seconds(),
+	}, nil
+}
+
+// sinkSend sends n bytes to the sink tunnel c and waits for it to count them.
+func sinkSend(c net.Conn, n int64) error {
+	buf := make([]byte, 32<<10)
+	for left := n; left > 0; {
+		chunk := buf
+		if left < int64(len(chunk)) {
+			chunk = chunk[:left]
+		}
+		if _, err := c.Write(chunk); err != nil {
+			return err
+		}
+		left -= int64(len(chunk))
+	}
+	if err := closeWrite(c); err != nil {
+		return err
+	}
+	var got uint64
+	if err := binary.Read(c, binary.LittleEndian, &got); err != nil {
+		return errors.Wrap(err, "read count of the sink")
+	}
+	if got != uint64(n) {
+		return errors.Errorf("sink received %d of %d bytes", got, n)
+	}
+	return nil
+}
+
+// benchOpens measures opening count echo tunnels one after the other, until
+// the agent accepted each.
+func benchOpens(ctx context.Context, dial benchDialer, count int) ([]time.Duration, error) {
+	samples := make([]time.Duration, 0, count)
+	for i := 0; i < count; i++ {
+		start := time.Now()
+		c, err := dial(ctx, echoService)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, time.Since(start))
+		c.Close()
+	}
+	return samples, nil
+}
+
+// useRelay makes node reach the peer id only through a circuit of the relay
+// at the multiaddr relay, which has to end with the relay's /p2p ID.
+func useRelay(ctx context.Context, node host.Host, id peer.ID, relay string) error {
+	addr, err := ma.NewMultiaddr(relay)
+	if err != nil {
+		return errors.Wrap(err, "relay address")
+	}
+	info, err := peer.AddrInfoFromP2pAddr(addr)
+	if err != nil {
+		return errors.Wrap(err, "relay address")
+	}
+	if err := node.Connect(ctx, *info); err != nil {
+		return errors.Wrap(err, "connect to relay")
+	}
+	circuit, err := ma.NewMultiaddr("/p2p-circuit")
+	if err != nil {
+		return err
+	}
+	if err := node.Network().ClosePeer(id); err != nil {
+		return err
+	}
+	node.Peerstore().ClearAddrs(id)
+	node.Peerstore().AddAddr(id, addr.Encapsulate(circuit), peerstore.TempAddrTTL)
+	return nil
+}
+
+// connPath returns whether node is connected to the peer id directly or
+// through a relay, and the address of the connection.
+func connPath(node host.Host, id peer.ID) (string, string) {
+	conns := node.Network().ConnsToPeer(id)
+	if len(conns) == 0 {
+		return "unknown", ""
+	}
+	addr := conns[0].RemoteMultiaddr()
+	if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+		return "relay", addr.String()
+	}
+	return "direct", addr.String()
+}
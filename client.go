@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/p2ptunnel/p2ptunnel/pkg/tunnel"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// newClient creates a node for commands opening tunnels to the peers of the
+// config, and the connector opening them. The node runs until ctx is done.
+func newClient(ctx context.Context, cctx *cli.Context) (host.Host, *tunnel.Connector, error) {
+	node, dht, peers, err := newClientNode(ctx, cctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := tunnel.NewConnector(tunnel.Options{Host: node, Peers: peers, Routing: dht})
+	if err != nil {
+		node.Close()
+		return nil, nil, err
+	}
+	return node, c, nil
+}
+
+// newClientNode creates a node which accepts no tunnels, and returns it with
+// its DHT and the peers of the config by name.
+func newClientNode(ctx context.Context, cctx *cli.Context) (host.Host, *dht.IpfsDHT, map[string]peer.ID, error) {
+	conf, err := readConf(cctx.GlobalString("conf"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	peers := make(map[string]peer.ID, len(conf.Peers))
+	for name, p := range conf.Peers {
+		id, err := peer.Decode(p.ID)
+		if err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "peer %s", name)
+		}
+		peers[name] = id
+	}
+	key, err := loadPrivateKey(cctx, conf)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	logger.Infow("creating libp2p node", "id", conf.ID)
+	node, dht, err := CreateNode(ctx, key, 0, func(s network.Stream) {
+		if err := s.Reset(); err != nil {
+			logger.Debugw("reset stream", "error", err)
+		}
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return node, dht, peers, nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configVersion is the version of the config schema written by this release.
+const configVersion = 1
+
+// migrations upgrade a config from version i+1 to version i+2, none are needed
+// yet.
+var migrations []func(conf *Config)
+
+// migrateConf upgrades conf to configVersion. It reports whether anything was
+// migrated.
+func migrateConf(conf *Config) (bool, error) {
+	if conf.Version > configVersion {
+		return false, errors.Errorf("config version %d is newer than the supported version %d, please upgrade p2ptunnel", conf.Version, configVersion)
+	}
+	if conf.Version < 0 {
+		return false, errors.Errorf("invalid config version %d", conf.Version)
+	}
+	// The unversioned format of the first releases holds name, id,
+	// private_key and peers as version 1 does, which only adds optional
+	// fields.
+	if conf.Version == 0 {
+		conf.Version = 1
+	}
+	migrated := conf.Version < configVersion
+	for conf.Version < configVersion {
+		migrations[conf.Version-1](conf)
+		conf.Version++
+	}
+	return migrated, nil
+}
+
+// serviceName restricts service names to what is safe to type and to log.
+var serviceName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// configError is a problem found by validate, with the line it was found on
+// when known.
+type configError struct {
+	Line int
+	Msg  string
+}
+
+func (e configError) String() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return e.Msg
+}
+
+// in formats the problem as found in file, with the line if known.
+func (e configError) in(file string) string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", file, e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", file, e.Msg)
+}
+
+// validate checks the config for mistakes which would otherwise only show up
+// once the agent or connector runs into them.
+func (c *Config) validate() []configError {
+	var errs []configError
+	report := func(keys []string, format string, args ...interface{}) {
+		errs = append(errs, configError{Line: yamlLine(c.raw, keys...), Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Name == "" {
+		report([]string{"name"}, "name is empty")
+	}
+	id, err := peer.Decode(c.ID)
+	if err != nil {
+		report([]string{"id"}, "invalid id %q: %v", c.ID, err)
+	}
+	if key := c.plainKey(); key != "" {
+		priv, err := crypto.UnmarshalPrivateKey([]byte(key))
+		if err != nil {
+			report([]string{"private_key"}, "invalid private key: %v", err)
+		} else if keyID, err := peer.IDFromPrivateKey(priv); err == nil && id != "" && keyID != id {
+			report([]string{"id"}, "id %s doesn't match the private key of %s", c.ID, keyID.Pretty())
+		}
+	}
+	if c.PrivateKey != "" && c.EncryptedKey != nil {
+		report([]string{"encrypted_private_key"}, "both private_key and encrypted_private_key are set")
+	}
+	if c.EncryptedKey != nil && c.EncryptedKey.KDF != kdfArgon2id {
+		report([]string{"encrypted_private_key", "kdf"}, "unsupported key derivation function %q", c.EncryptedKey.KDF)
+	}
+
+	for _, name := range sortedKeys(c.Services) {
+		svc := c.Services[name]
+		if !serviceName.MatchString(name) {
+			report([]string{"services", name}, "invalid service name %q", name)
+		}
+		switch {
+		case svc.Proxy && svc.Addr != "":
+			report([]string{"services", name}, "service %s is a proxy and can't have an addr", name)
+		case !svc.Proxy:
+			if err := checkHostPort(svc.Addr); err != nil {
+				report([]string{"services", name, "addr"}, "service %s: %v", name, err)
+			}
+		}
+	}
+
+	ids := make(map[string]string)
+	for _, name := range sortedKeys(c.Peers) {
+		p := c.Peers[name]
+		if _, err := peer.Decode(p.ID); err != nil {
+			report([]string{"peers", name, "id"}, "peer %s: invalid id %q: %v", name, p.ID, err)
+		} else if other, ok := ids[p.ID]; ok {
+			report([]string{"peers", name, "id"}, "peer %s has the same id as peer %s", name, other)
+		}
+		ids[p.ID] = name
+		for i, s := range p.Services {
+			if _, ok := c.Services[s]; !ok && s != "*" && s != defaultService && s != fileService && builtinServices[s] == nil {
+				report([]string{"peers", name, "services", strconv.Itoa(i)}, "peer %s: unknown service %q", name, s)
+			}
+		}
+		for i, d := range p.Destinations {
+			if _, err := path.Match(d, ""); err != nil {
+				report([]string{"peers", name, "destinations", strconv.Itoa(i)}, "peer %s: invalid destination pattern %q", name, d)
+			}
+		}
+		if p.NotBefore != nil && p.Expires != nil && !p.NotBefore.Before(*p.Expires) {
+			report([]string{"peers", name, "expires"}, "peer %s expires before its access starts", name)
+		}
+	}
+
+	if r := c.Receive; r != nil {
+		if r.Dir == "" {
+			report([]string{"receive"}, "receive dir is empty")
+		}
+		if r.MaxSize < 0 {
+			report([]string{"receive", "max_size"}, "invalid receive max_size %d", r.MaxSize)
+		}
+	}
+
+	listeners := make(map[string]string)
+	for _, name := range sortedKeys(c.Forwards) {
+		fwd := c.Forwards[name]
+		if !serviceName.MatchString(name) {
+			report([]string{"forwards", name}, "invalid forward name %q", name)
+		}
+		if err := checkHostPort(fwd.Listen); err != nil {
+			report([]string{"forwards", name, "listen"}, "forward %s: %v", name, err)
+		} else if other, ok := listeners[fwd.Listen]; ok {
+			report([]string{"forwards", name, "listen"}, "forward %s listens on the same address as forward %s", name, other)
+		}
+		listeners[fwd.Listen] = name
+		if _, ok := c.Peers[fwd.Peer]; !ok {
+			report([]string{"forwards", name, "peer"}, "forward %s: unknown peer %q", name, fwd.Peer)
+		}
+		if fwd.Service != "" && !serviceName.MatchString(fwd.Service) {
+			report([]string{"forwards", name, "service"}, "forward %s: invalid service name %q", name, fwd.Service)
+		}
+		if fwd.Dest != "" {
+			if err := checkHostPort(fwd.Dest); err != nil {
+				report([]string{"forwards", name, "dest"}, "forward %s: dest: %v", name, err)
+			}
+		}
+	}
+
+	for i, r := range c.Revoked {
+		if _, err := peer.Decode(r); err != nil {
+			report([]string{"revoked", strconv.Itoa(i)}, "invalid revoked id %q: %v", r, err)
+		}
+	}
+	for i, inv := range c.Invites {
+		if _, err := hex.DecodeString(inv.Secret); err != nil || inv.Secret == "" {
+			report([]string{"invites", strconv.Itoa(i), "secret"}, "invite %d has an invalid secret", i+1)
+		}
+	}
+	return errs
+}
+
+// check validates the config and returns all problems as one error.
+func (c *Config) check() error {
+	errs := c.validate()
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.String()
+	}
+	return errors.Errorf("invalid config:\n  %s", strings.Join(msgs, "\n  "))
+}
+
+// plainKey returns the private key if it is available without a passphrase.
+func (c *Config) plainKey() string {
+	if c.resolvedKey != "" {
+		return c.resolvedKey
+	}
+	return c.PrivateKey
+}
+
+func checkHostPort(addr string) error {
+	if addr == "" {
+		return errors.New("addr is empty")
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return errors.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]Service:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]Peer:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]Forward:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// yamlLine finds the line of a value in a block style YAML document, as
+// written by the yaml encoder, following keys through nested mappings. Numeric
+// keys select an item of a sequence. It returns the line of the deepest key
+// found, or 0 if not even the first one is there.
+func yamlLine(data []byte, keys ...string) int {
+	lines := strings.Split(string(data), "\n")
+	found, start, parent := 0, 0, -1
+	for _, key := range keys {
+		idx, err := strconv.Atoi(key)
+		isIndex := err == nil
+		match, item, indent := -1, -1, -1
+		for i := start; i < len(lines); i++ {
+			trimmed := strings.TrimLeft(lines[i], " ")
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			ind := len(lines[i]) - len(trimmed)
+			isItem := strings.HasPrefix(trimmed, "- ") || trimmed == "-"
+			if i == start && found > 0 && isItem && !isIndex {
+				// The first key of a mapping inside a sequence item.
+				trimmed, ind = trimmed[2:], ind+2
+				isItem = false
+			}
+			// Sequences may be indented as much as their parent key.
+			if ind < parent || ind == parent && !(isIndex && isItem) {
+				break
+			}
+			if indent < 0 {
+				indent = ind
+			}
+			if ind != indent {
+				continue
+			}
+			if isIndex {
+				if isItem {
+					item++
+					if item == idx {
+						match = i
+						break
+					}
+				}
+				continue
+			}
+			if strings.HasPrefix(trimmed, key+":") || strings.HasPrefix(trimmed, strconv.Quote(key)+":") {
+				match = i
+				break
+			}
+		}
+		if match < 0 {
+			break
+		}
+		found = match + 1
+		parent = indent
+		start = match + 1
+		if isIndex {
+			start = match
+		}
+	}
+	return found
+}
+
+func validateConf(ctx *cli.Context) error {
+	configFile := ctx.GlobalString("conf")
+	conf, err := readConf(configFile)
+	if err != nil {
+		return err
+	}
+	if conf.migratedFrom >= 0 {
+		fmt.Printf("%s uses config version %d, run `p2ptunnel config migrate` to upgrade it to %d\n", configFile, conf.migratedFrom, configVersion)
+	}
+	errs := conf.validate()
+	if err := resolvePrivateKey(conf, configFile); err != nil {
+		errs = append(errs, configError{Line: yamlLine(conf.raw, "private_key_file"), Msg: err.Error()})
+	}
+	for _, e := range errs {
+		fmt.Println(e.in(configFile))
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("%d problems found in %s", len(errs), configFile)
+	}
+	fmt.Printf("%s is valid\n", configFile)
+	return nil
+}
+
+func migrateConfCmd(ctx *cli.Context) error {
+	configFile := ctx.GlobalString("conf")
+	from := -1
+	_, err := updateConf(configFile, func(conf *Config) error {
+		from = conf.migratedFrom
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if from < 0 {
+		fmt.Printf("%s is already at config version %d\n", configFile, configVersion)
+		return nil
+	}
+	fmt.Printf("%s has been migrated from config version %d to %d, the previous file is kept as %s.bak\n", configFile, from, configVersion, configFile)
+	return nil
+}
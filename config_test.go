@@ -0,0 +1,176 @@
+package main
+
+import (
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const yamlLineDoc = `version: 1
+name: home
+# comment
+id: QmHome
+services:
+  ssh:
+    addr: localhost:22
+  "web.v2":
+    proxy: true
+peers:
+  laptop:
+    id: QmLaptop
+    services:
+    - ssh
+    - web
+    destinations:
+      - "*.lan:22"
+invites:
+- secret: aa
+  expires: 2030-01-01T00:00:00Z
+- name: ci
+  secret: bb
+`
+
+func TestYamlLine(t *testing.T) {
+	tests := []struct {
+		keys []string
+		want int
+	}{
+		{[]string{"version"}, 1},
+		{[]string{"name"}, 2},
+		{[]string{"id"}, 4},
+		{[]string{"services", "ssh", "addr"}, 7},
+		{[]string{"services", "web.v2"}, 8},
+		{[]string{"services", "web.v2", "proxy"}, 9},
+		{[]string{"peers", "laptop", "id"}, 12},
+		{[]string{"peers", "laptop", "services", "1"}, 15},
+		{[]string{"peers", "laptop", "destinations", "0"}, 17},
+		{[]string{"invites", "0", "secret"}, 19},
+		{[]string{"invites", "0", "expires"}, 20},
+		{[]string{"invites", "1", "name"}, 21},
+		{[]string{"invites", "1", "secret"}, 22},
+		// Missing keys give the line of the deepest key found.
+		{[]string{"peers", "phone"}, 10},
+		{[]string{"peers", "laptop", "expires"}, 11},
+		{[]string{"invites", "2"}, 18},
+		{[]string{"services", "addr"}, 5},
+		{[]string{"missing"}, 0},
+	}
+	for _, tt := range tests {
+		if got := yamlLine([]byte(yamlLineDoc), tt.keys...); got != tt.want {
+			t.Errorf("yamlLine(%q) = %d, want %d", tt.keys, got, tt.want)
+		}
+	}
+}
+
+func TestValidateLines(t *testing.T) {
+	conf, file := newTestConf(t)
+	data := "version: 1\nname: home\nid: " + conf.ID + `
+services:
+  ssh:
+    addr: localhost
+  "bad name":
+    addr: localhost:22
+peers:
+  laptop:
+    id: QmLaptop
+    services:
+    - ssh
+    - web
+`
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := readConf(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]string{
+		6:  "service ssh",
+		7:  "bad name",
+		11: "QmLaptop",
+		14: "web",
+	}
+	errs := conf.validate()
+	if len(errs) != len(want) {
+		t.Errorf("validate() = %v, want %d problems", errs, len(want))
+	}
+	for _, e := range errs {
+		if !strings.Contains(e.Msg, want[e.Line]) || want[e.Line] == "" {
+			t.Errorf("unexpected problem %q", e)
+		}
+	}
+}
+
+func TestMigrateConf(t *testing.T) {
+	tests := []struct {
+		version      int
+		wantMigrated bool
+		wantErr      bool
+	}{
+		{0, false, false},
+		{configVersion, false, false},
+		{configVersion + 1, false, true},
+		{-1, false, true},
+	}
+	for _, tt := range tests {
+		conf := &Config{Version: tt.version}
+		migrated, err := migrateConf(conf)
+		if migrated != tt.wantMigrated || (err != nil) != tt.wantErr {
+			t.Errorf("migrateConf(version %d) = %v, %v, want %v, error %v", tt.version, migrated, err, tt.wantMigrated, tt.wantErr)
+		}
+		if err == nil && conf.Version != configVersion {
+			t.Errorf("migrateConf(version %d) left version %d", tt.version, conf.Version)
+		}
+	}
+}
+
+// TestReadLegacyConf reads a config as written by the first releases, which
+// had no version, and checks it is read as version 1 with its settings.
+func TestReadLegacyConf(t *testing.T) {
+	conf, file := newTestConf(t)
+	laptop := newTestHost(t, newTestKey(t)).ID().Pretty()
+	legacy := &struct {
+		Name       string          `yaml:"name"`
+		ID         string          `yaml:"id"`
+		PrivateKey string          `yaml:"private_key"`
+		Peers      map[string]Peer `yaml:"peers"`
+	}{conf.Name, conf.ID, conf.PrivateKey, map[string]Peer{"laptop": {ID: laptop}}}
+	data, err := yaml.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := readConf(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.migratedFrom != -1 || old.Version != 1 {
+		t.Errorf("legacy config read as version %d migrated from %d", old.Version, old.migratedFrom)
+	}
+	if old.Name != conf.Name || old.ID != conf.ID || old.PrivateKey != conf.PrivateKey ||
+		old.Peers["laptop"].ID != laptop {
+		t.Errorf("legacy config read as %+v", old)
+	}
+	if err := old.check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfigErrorIn(t *testing.T) {
+	tests := []struct {
+		err  configError
+		want string
+	}{
+		{configError{Line: 3, Msg: "peer bob: invalid id"}, "p2ptunnel.yml:3: peer bob: invalid id"},
+		{configError{Msg: "missing private key"}, "p2ptunnel.yml: missing private key"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.in("p2ptunnel.yml"); got != tt.want {
+			t.Errorf("in() = %q, want %q", got, tt.want)
+		}
+	}
+}
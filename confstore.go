@@ -0,0 +1,141 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// All changes to a config file go through updateConf or writeConf. Writers
+// hold an advisory lock on "<config>.lock", so concurrent commands don't lose
+// each other's changes, and replace the file by renaming a complete temporary
+// file over it, so readers such as a reloading agent never see a partial
+// config. The previous version is kept as "<config>.bak", without its key when
+// the key changes.
+
+// updateConf locks configFile, reads it, lets fn change it and writes it back.
+// Nothing is written if fn fails.
+func updateConf(configFile string, fn func(conf *Config) error) (*Config, error) {
+	unlock, err := lockConf(configFile)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	conf, err := readConf(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(conf); err != nil {
+		return nil, err
+	}
+	if err := saveConf(configFile, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// writeConf replaces configFile with conf, creating it if needed.
+func writeConf(configFile string, conf *Config) error {
+	unlock, err := lockConf(configFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return saveConf(configFile, conf)
+}
+
+// lockConf takes the advisory lock of configFile, waiting for other holders.
+func lockConf(configFile string) (func(), error) {
+	f, err := os.OpenFile(configFile+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "open config lock")
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "lock config")
+	}
+	return func() {
+		// Closing the file releases the lock too, unlocking first just
+		// doesn't wait for that.
+		_ = unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// saveConf atomically replaces configFile with conf. The caller holds the lock.
+func saveConf(configFile string, conf *Config) error {
+	data, err := yaml.Marshal(conf)
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0600)
+	old, err := ioutil.ReadFile(configFile)
+	switch {
+	case err == nil:
+		if fi, err := os.Stat(configFile); err == nil {
+			mode = fi.Mode().Perm()
+		}
+		backup, err := backupConf(old, conf)
+		if err != nil {
+			return errors.Wrap(err, "write config backup")
+		}
+		if err := ioutil.WriteFile(configFile+".bak", backup, mode); err != nil {
+			return errors.Wrap(err, "write config backup")
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(configFile), "."+filepath.Base(configFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), configFile)
+}
+
+// backupConf returns what to keep of the config file content old when conf
+// replaces it. If conf changes the key material, the old key is left out, so
+// a key that was just encrypted or rotated away doesn't linger in the backup.
+func backupConf(old []byte, conf *Config) ([]byte, error) {
+	prev := &Config{}
+	if err := yaml.Unmarshal(old, prev); err != nil {
+		// Not a config, there is nothing to compare the key with.
+		return old, nil
+	}
+	if prev.PrivateKey == conf.PrivateKey && reflect.DeepEqual(prev.EncryptedKey, conf.EncryptedKey) {
+		return old, nil
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(old, &doc); err != nil {
+		return nil, err
+	}
+	kept := doc[:0]
+	for _, item := range doc {
+		if item.Key == "private_key" || item.Key == "encrypted_private_key" {
+			continue
+		}
+		kept = append(kept, item)
+	}
+	return yaml.Marshal(kept)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+func TestUpdateConfConcurrent(t *testing.T) {
+	_, file := newTestConf(t)
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := updateConf(file, func(conf *Config) error {
+				conf.Peers[fmt.Sprintf("peer%d", i)] = Peer{ID: fmt.Sprintf("id%d", i)}
+				return nil
+			})
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf, err := readConf(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Peers) != n {
+		t.Errorf("%d peers in the config, want %d: updates were lost", len(conf.Peers), n)
+	}
+}
+
+func TestUpdateConfBackup(t *testing.T) {
+	tests := []struct {
+		name    string
+		update  func(conf *Config) error
+		keepKey bool
+	}{
+		{"add peer", func(conf *Config) error {
+			conf.Peers["laptop"] = Peer{ID: "QmLaptop"}
+			return nil
+		}, true},
+		{"encrypt key", func(conf *Config) error {
+			return encryptConfKeyWith(conf, []byte("passphrase"))
+		}, false},
+		{"replace key", func(conf *Config) error {
+			conf.PrivateKey = "new key"
+			return nil
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, file := newTestConf(t)
+			key := conf.PrivateKey
+			old, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := updateConf(file, tt.update); err != nil {
+				t.Fatal(err)
+			}
+			backup, err := ioutil.ReadFile(file + ".bak")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.keepKey {
+				if !bytes.Equal(backup, old) {
+					t.Errorf("backup is\n%s\nwant the previous file\n%s", backup, old)
+				}
+				return
+			}
+			if bytes.Contains(backup, []byte(key)) || bytes.Contains(backup, []byte(base64.StdEncoding.EncodeToString([]byte(key)))) {
+				t.Errorf("backup holds the old private key:\n%s", backup)
+			}
+			if bytes.Contains(backup, []byte("private_key")) {
+				t.Errorf("backup holds key material:\n%s", backup)
+			}
+			if !bytes.Contains(backup, []byte(conf.ID)) {
+				t.Errorf("backup lost the rest of the config:\n%s", backup)
+			}
+		})
+	}
+}
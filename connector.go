@@ -2,36 +2,47 @@ package main
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/p2ptunnel/p2ptunnel/pkg/httplogger"
+	"github.com/p2ptunnel/p2ptunnel/pkg/tunnel"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"io"
-	"log"
 	"net"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
-var (
-	agentName string
-	agentID   peer.ID
-)
-
 func connector(ctx *cli.Context) error {
 	conf, err := readConf(ctx.GlobalString("conf"))
 	if err != nil {
 		return err
 	}
+	if err := conf.check(); err != nil {
+		return err
+	}
 
-	verbose = ctx.GlobalBool("verbose")
-	if verbose {
-		logger = httplogger.New(nil)
+	if path := ctx.String("capture"); path != "" {
+		redact := append(append([]string(nil), httplogger.DefaultRedact...), ctx.StringSlice("capture-redact")...)
+		capture, err := httplogger.NewHARCapture(path, httplogger.CaptureOptions{
+			BodyLimit: ctx.Int("capture-body-limit"),
+			Redact:    redact,
+			Creator:   httplogger.HARCreator{Name: "p2ptunnel"},
+		})
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := capture.Close(); err != nil {
+				logger.Errorw("write capture", "file", path, "error", err)
+			}
+		}()
+		httpSinks = append(httpSinks, capture)
 	}
 
 	// TODO: support multiple peers.
@@ -48,28 +59,34 @@ func connector(ctx *cli.Context) error {
 
 	peerTable := make(map[string]peer.ID)
 	for name, p := range conf.Peers {
-		agentName = name
-		agentID, err = peer.Decode(p.ID)
+		id, err := peer.Decode(p.ID)
 		if err != nil {
 			return err
 		}
-		peerTable[agentName] = agentID
-		break
+		peerTable[name] = id
 	}
 
 	// Setup System Context
 	cctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	fmt.Println("[+] Creating LibP2P Node")
+	// Recording starts before the stream handlers which record tunnels.
+	if err := startRecording(ctx); err != nil {
+		return err
+	}
+	defer stopRecording()
 
 	// Create P2P Node
-	fmt.Printf("My ID: %s\n", conf.ID)
+	logger.Infow("creating libp2p node", "id", conf.ID)
+	key, err := loadPrivateKey(ctx, conf)
+	if err != nil {
+		return err
+	}
 	host, dht, err := CreateNode(
 		cctx,
-		conf.PrivateKey,
-		uint(forwardPort),
-		streamHandlerConnector,
+		key,
+		0,
+		streamHandlerConnector(peerTable),
 	)
 	if err != nil {
 		return err
@@ -82,6 +99,24 @@ func connector(ctx *cli.Context) error {
 	// Register the application to listen for SIGINT/SIGTERM
 	go signalExit(cancel, host)
 
+	if err := serveMetrics(cctx, ctx.String("metrics-listen"), host); err != nil {
+		return err
+	}
+
+	admin := &adminServer{
+		mode:       "connector",
+		name:       conf.Name,
+		configFile: ctx.GlobalString("conf"),
+		node:       host,
+		started:    time.Now(),
+		peers:      func() map[string]peer.ID { return peerTable },
+	}
+	if err := serveAdmin(cctx, adminSocket(ctx), admin); err != nil {
+		logger.Warnw("admin API disabled", "error", err)
+	}
+
+	req := tunnel.Request{Service: ctx.String("service"), Dest: ctx.String("dest")}
+
 	localAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", ctx.Uint("port")))
 	if err != nil {
 		return err
@@ -91,10 +126,19 @@ func connector(ctx *cli.Context) error {
 		return err
 	}
 	defer l.Close()
+	return serveForward(cctx, host, l, peerTable, req)
+}
+
+// redialDelay is the time between attempts to reach a peer.
+var redialDelay = 5 * time.Second
+
+// serveForward accepts local connections on l and tunnels each of them to the
+// peer of peerTable with req, until ctx is done or accepting fails.
+func serveForward(ctx context.Context, node host.Host, l *net.TCPListener, peerTable map[string]peer.ID, req tunnel.Request) error {
 	for {
 		select {
-		case <-cctx.Done():
-			return cctx.Err()
+		case <-ctx.Done():
+			return ctx.Err()
 		default:
 			// Wait for a connection.
 			if err := l.SetDeadline(time.Now().Add(time.Second)); err != nil {
@@ -113,127 +157,117 @@ func connector(ctx *cli.Context) error {
 			// The loop then returns to accepting, so that
 			// multiple connections may be served concurrently.
 			go func(ctx context.Context, c net.Conn) {
-				// Echo all incoming data.
-				buf := make([]byte, 1000000)
-				size, err := c.Read(buf)
-				if err != nil {
-					fmt.Println(err)
-				}
-				//body := make([]byte, 2)
-				//binary.LittleEndian.PutUint16(body, uint16(size))
-				//body = append(body, buf[:size]...)
-
-				err = sendToRemote(ctx, host, peerTable, buf[:size], c)
-				if err != nil {
-					fmt.Println(err)
-				}
 				// Shut down the connection.
-				c.Close()
-			}(cctx, conn)
+				defer c.Close()
+				// A panicking tunnel takes only its own connection down,
+				// not the process with every other tunnel.
+				defer func() {
+					if p := recover(); p != nil {
+						logger.Errorw("tunnel panicked", "service", req.Service, "remote_addr", c.RemoteAddr().String(), "panic", p)
+					}
+				}()
+				if err := sendToRemote(ctx, node, peerTable, req, c); err != nil {
+					logger.Warnw("tunnel failed", "service", req.Service, "remote_addr", c.RemoteAddr().String(), "error", err)
+				}
+			}(ctx, conn)
 		}
 	}
 }
 
-func sendToRemote(ctx context.Context, node host.Host, peerTable map[string]peer.ID, body []byte, local io.Writer) error {
-	fmt.Printf("remote table: %+v\n", peerTable)
-retry:
+// sendToRemote tunnels the local connection to the peer of peerTable with req,
+// retrying while the peer can't be reached.
+func sendToRemote(ctx context.Context, node host.Host, peerTable map[string]peer.ID, req tunnel.Request, local net.Conn) error {
 	for name, id := range peerTable {
-		fmt.Printf("discover peer: %s - %v\n", name, id)
-		stream, err := node.NewStream(ctx, id, Protocol)
-		if err != nil {
-			if strings.HasPrefix(err.Error(), "failed to dial") ||
-				strings.HasPrefix(err.Error(), "no addresses") {
-				// Attempt to connect to peers slowly when they aren't found.
-				fmt.Println(err)
-				time.Sleep(5 * time.Second)
-				goto retry
-			} else {
-				return err
-			}
-		}
-		fmt.Printf("[+] Connection to %s Successful. Network Ready.\n", name)
-		if verbose {
-			logger.Reset()
-			fmt.Println("--->")
-			logger.Print(body)
-		}
-
-		l, err := stream.Write(body)
+		start := time.Now()
+		stream, err := openTunnel(ctx, node, name, id, req)
 		if err != nil {
 			return err
 		}
-		if l <= 0 {
-			fmt.Printf("write wrong size payload: %d\n", l)
-		}
-
-		// Decode the incoming packet's size from binary.
-		//size := binary.LittleEndian.Uint16(requestSize)
-		size := 100000
+		slog := logger.With("peer", name, "service", req.Service, "stream_id", stream.ID())
+		stats := tunnels.add(&tunnelStats{Direction: "out", Peer: name, Service: req.Service, Dest: req.Dest, Local: local.RemoteAddr().String()})
+		defer tunnels.remove(stats)
+		defer func() {
+			slog.Debugw("tunnel closed",
+				"bytes", atomic.LoadInt64(&stats.BytesIn)+atomic.LoadInt64(&stats.BytesOut),
+				"duration", time.Since(start),
+			)
+		}()
+		httpLog := httplogger.NewConn(name, req.Service, httpSinks...)
+		defer httpLog.Close()
+		return pipe(newCountingStream(stream, stats), local, httpLog.Response, httpLog.Request)
+	}
+	return nil
+}
 
-		reply := make([]byte, size)
-		r, err := stream.Read(reply)
+// openTunnel opens a stream to the peer id called name and asks its agent for
+// req, retrying while the peer can't be reached until ctx is done. A refusal of
+// the agent is returned as a *tunnel.RefusedError.
+func openTunnel(ctx context.Context, node host.Host, name string, id peer.ID, req tunnel.Request) (network.Stream, error) {
+	logger.Debugw("opening tunnel", "peer", name, "service", req.Service)
+	for {
+		start := time.Now()
+		stream, err := node.NewStream(ctx, id, Protocol)
 		if err != nil {
-			return err
-		}
-		if r == 0 {
-			return errors.Errorf("read empty data")
+			if !strings.HasPrefix(err.Error(), "failed to dial") &&
+				!strings.HasPrefix(err.Error(), "no addresses") {
+				return nil, err
+			}
+			// Attempt to connect to peers slowly when they aren't found.
+			logger.Infow("peer unreachable, retrying", "peer", name, "in", redialDelay, "error", err)
+			select {
+			case <-time.After(redialDelay):
+			case <-ctx.Done():
+				return nil, err
+			}
+			reconnectAttempts.WithLabelValues(name).Inc()
+			continue
 		}
-		if verbose {
-			logger.Reset()
-			fmt.Println("<---")
-			logger.Print(reply)
+		streamsOpened.WithLabelValues(name, req.Service).Inc()
+		if err := tunnel.SendRequest(ctx, stream, req); err != nil {
+			return nil, err
 		}
+		dialDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		logger.Debugw("tunnel opened", "peer", name, "service", req.Service, "stream_id", stream.ID(), "duration", time.Since(start))
+		return stream, nil
+	}
+}
 
-		w, err := local.Write(reply)
-		if err != nil {
-			return err
-		}
-		if int(size) != w {
-			return errors.Errorf("expect reply write %d, actual write %d\n", size, w)
-		}
-		err = stream.Close()
-		if err != nil {
-			return err
+// streamHandlerConnector returns the handler of the streams peers open to the
+// connector, which only logs the frames of the peers in peerTable.
+func streamHandlerConnector(peerTable map[string]peer.ID) network.StreamHandler {
+	return func(stream network.Stream) {
+		// If the remote node ID isn't in the list of known nodes don't respond.
+		if !hasPeer(peerTable, stream.Conn().RemotePeer()) {
+			if err := stream.Reset(); err != nil {
+				logger.Debugw("reset stream", "stream_id", stream.ID(), "error", err)
+			}
+			return
 		}
-
-		// only support one peer
-		break
+		readFrames(stream, func(packet []byte) {
+			logger.Debugw("read packet", "stream_id", stream.ID(), "bytes", len(packet))
+		})
+		stream.Close()
 	}
-	return nil
 }
 
-func streamHandlerConnector(stream network.Stream) {
-	// If the remote node ID isn't in the list of known nodes don't respond.
-	if _, ok := revLookup[stream.Conn().RemotePeer().Pretty()]; !ok {
-		if err := stream.Reset(); err != nil {
-			log.Printf("while lookup: %v\n", err)
+// hasPeer reports whether id is one of the peers of peerTable.
+func hasPeer(peerTable map[string]peer.ID, id peer.ID) bool {
+	for _, p := range peerTable {
+		if p == id {
+			return true
 		}
-		return
 	}
-	var packet = make([]byte, 1000000)
-	var packetSize = make([]byte, 2)
+	return false
+}
+
+// readFrames passes the frames read from r to packet until reading fails, and
+// returns the error, io.EOF at the end of r.
+func readFrames(r io.Reader, packet func([]byte)) error {
 	for {
-		// Read the incoming packet's size as a binary value.
-		_, err := stream.Read(packetSize)
+		b, err := tunnel.ReadFrame(r)
 		if err != nil {
-			stream.Close()
-			return
-		}
-
-		// Decode the incoming packet's size from binary.
-		size := binary.LittleEndian.Uint16(packetSize)
-
-		// Read in the packet until completion.
-		var plen uint16 = 0
-		for plen < size {
-			tmp, err := stream.Read(packet[plen:size])
-			plen += uint16(tmp)
-			if err != nil {
-				stream.Close()
-				return
-			}
+			return err
 		}
-
-		fmt.Printf("read %d from %s: %s\n", size, stream.ID(), string(packet[:size]))
+		packet(b)
 	}
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/p2ptunnel/p2ptunnel/pkg/tunnel"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestReadFrames(t *testing.T) {
+	frames := [][]byte{[]byte("ssh"), {}, bytes.Repeat([]byte{'x'}, 1500), bytes.Repeat([]byte{'y'}, tunnel.MaxFrameSize)}
+	buf := &bytes.Buffer{}
+	for _, f := range frames {
+		if err := tunnel.WriteFrame(buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Streams return as few bytes as they have, down to one byte of a
+	// frame's size.
+	for name, r := range map[string]func(io.Reader) io.Reader{
+		"whole":    func(r io.Reader) io.Reader { return r },
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+	} {
+		var got [][]byte
+		err := readFrames(r(bytes.NewReader(buf.Bytes())), func(b []byte) {
+			got = append(got, b)
+		})
+		if err != io.EOF {
+			t.Errorf("%s: expect EOF, get %v", name, err)
+		}
+		if len(got) != len(frames) {
+			t.Fatalf("%s: expect %d frames, get %d", name, len(frames), len(got))
+		}
+		for i := range frames {
+			if !bytes.Equal(got[i], frames[i]) {
+				t.Errorf("%s: frame %d: expect %d bytes, get %d", name, i, len(frames[i]), len(got[i]))
+			}
+		}
+	}
+}
+
+func TestPrettyDiscovery(t *testing.T) {
+	node, agent := newTestHost(t, newTestKey(t)), newTestHost(t, newTestKey(t))
+	streams := make(chan struct{}, 1)
+	agent.SetStreamHandler(Protocol, func(s network.Stream) {
+		streams <- struct{}{}
+		s.Reset()
+	})
+	node.Peerstore().AddAddrs(agent.ID(), agent.Addrs(), peerstore.PermanentAddrTTL)
+
+	prettyDiscovery(context.Background(), node, map[string]peer.ID{"home": agent.ID()})
+	if node.Network().Connectedness(agent.ID()) != network.Connected {
+		t.Error("peer not connected")
+	}
+	select {
+	case <-streams:
+		t.Error("discovery opened a tunnel stream")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
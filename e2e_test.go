@@ -0,0 +1,667 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-tcp-transport"
+	"github.com/p2ptunnel/p2ptunnel/pkg/tunnel"
+	"github.com/urfave/cli"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testNet is an agent and a connector on the loopback interface, which need
+// no bootstrap nodes or other outside services. The agent forwards to local
+// servers.
+type testNet struct {
+	t   *testing.T
+	ctx context.Context
+	// agent knows connector as "laptop", stranger isn't configured.
+	agent, connector, stranger host.Host
+	agentKey                   crypto.PrivKey
+	conf                       *Config
+	server                     *agentServer
+}
+
+// newTestHost creates a host with key listening on the loopback interface
+// only.
+func newTestHost(t *testing.T, key crypto.PrivKey) host.Host {
+	h, err := libp2p.New(
+		libp2p.Identity(key),
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+		libp2p.Transport(tcp.NewTCPTransport),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func newTestKey(t *testing.T) crypto.PrivKey {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// newTestConf writes a config named "home" with a new key to a temporary
+// directory, and returns it and the path of the file.
+func newTestConf(t *testing.T) (*Config, string) {
+	key := newTestKey(t)
+	data, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &Config{
+		Version:    configVersion,
+		Name:       "home",
+		ID:         id.Pretty(),
+		PrivateKey: string(data),
+		Peers:      map[string]Peer{},
+	}
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := writeConf(file, conf); err != nil {
+		t.Fatal(err)
+	}
+	return conf, file
+}
+
+// newTestContext returns the context a command gets from the command line,
+// with the global and command flags set to the given values and args.
+func newTestContext(global, flags map[string]string, args ...string) *cli.Context {
+	newSet := func(name string, values map[string]string) *flag.FlagSet {
+		set := flag.NewFlagSet(name, flag.ContinueOnError)
+		for name, value := range values {
+			set.String(name, value, "")
+		}
+		return set
+	}
+	parent := cli.NewContext(nil, newSet("p2ptunnel", global), nil)
+	set := newSet("command", flags)
+	set.Parse(args)
+	return cli.NewContext(nil, set, parent)
+}
+
+// newTestNet starts the agent with services and the connector. It replaces
+// the config of the agent, so tests using it can't run in parallel.
+func newTestNet(t *testing.T, services map[string]Service) *testNet {
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &testNet{t: t, ctx: ctx, agentKey: newTestKey(t)}
+	t.Cleanup(func() {
+		cancel()
+		n.waitTunnelsClosed()
+	})
+	agentID, err := peer.IDFromPrivateKey(n.agentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.connector = newTestHost(t, newTestKey(t))
+	n.connector.SetStreamHandler(Protocol, streamHandlerConnector(map[string]peer.ID{"home": agentID}))
+	n.stranger = newTestHost(t, newTestKey(t))
+
+	n.conf = &Config{
+		Name:     "home",
+		ID:       agentID.Pretty(),
+		Services: services,
+		Peers:    map[string]Peer{"laptop": {ID: n.connector.ID().Pretty()}},
+	}
+	n.server, err = newAgentServer(n.conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.startAgent()
+	return n
+}
+
+// startAgent starts the host of the agent, as after a restart, and tells the
+// others its addresses.
+func (n *testNet) startAgent() {
+	n.agent = newTestHost(n.t, n.agentKey)
+	n.server.node = n.agent
+	n.agent.SetStreamHandler(Protocol, n.server.handleStream)
+	for _, h := range []host.Host{n.connector, n.stranger} {
+		h.Peerstore().AddAddrs(n.agent.ID(), n.agent.Addrs(), peerstore.PermanentAddrTTL)
+		n.agent.Peerstore().AddAddrs(h.ID(), h.Addrs(), peerstore.PermanentAddrTTL)
+	}
+}
+
+// apply makes n.conf the config of the agent.
+func (n *testNet) apply() {
+	if _, _, err := n.server.swap(n.conf); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+// newTestServer returns the agent server of node, applying conf.
+func newTestServer(t *testing.T, node host.Host, conf *Config) *agentServer {
+	a, err := newAgentServer(conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.node = node
+	return a
+}
+
+// forward listens on a local port tunneled to the agent with req, as the
+// connector does, and returns its address.
+func (n *testNet) forward(req tunnel.Request) string {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	n.t.Cleanup(func() { l.Close() })
+	peerTable := map[string]peer.ID{"home": n.agent.ID()}
+	go serveForward(n.ctx, n.connector, l, peerTable, req)
+	return l.Addr().String()
+}
+
+// waitTunnelsClosed fails the test if tunnels are left open.
+func (n *testNet) waitTunnelsClosed() {
+	deadline := time.Now().Add(5 * time.Second)
+	for tunnels.count() > 0 {
+		if time.Now().After(deadline) {
+			n.t.Errorf("%d tunnels left open", tunnels.count())
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// echoServer starts a local server sending back whatever it receives.
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// echo sends data through the tunnel at addr and returns what comes back.
+func echo(addr string, data []byte) ([]byte, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Write(data)
+		if err == nil {
+			err = c.(*net.TCPConn).CloseWrite()
+		}
+		errs <- err
+	}()
+	got, err := ioutil.ReadAll(c)
+	if err != nil {
+		return nil, err
+	}
+	return got, <-errs
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestE2ELargeTransfer(t *testing.T) {
+	n := newTestNet(t, map[string]Service{"echo": {Addr: echoServer(t)}})
+	addr := n.forward(tunnel.Request{Service: "echo"})
+
+	data := randomBytes(t, 8<<20)
+	got, err := echo(addr, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("expect %d bytes echoed, get %d different ones", len(data), len(got))
+	}
+}
+
+func TestE2EConcurrentTunnels(t *testing.T) {
+	n := newTestNet(t, map[string]Service{"echo": {Addr: echoServer(t)}})
+	addr := n.forward(tunnel.Request{Service: "echo"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(data []byte) {
+			defer wg.Done()
+			got, err := echo(addr, data)
+			if err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(got, data) {
+				t.Errorf("expect %d bytes echoed, get %d different ones", len(data), len(got))
+			}
+		}(randomBytes(t, 64<<10+i))
+	}
+	wg.Wait()
+}
+
+func TestE2EHTTP(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+	defer web.Close()
+	n := newTestNet(t, map[string]Service{"web": {Addr: web.Listener.Addr().String()}})
+	addr := n.forward(tunnel.Request{Service: "web"})
+
+	// The requests share a persistent connection, so one tunnel.
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+	for _, path := range []string{"/", "/status", "/index.html"} {
+		res, err := client.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := "GET " + path; string(body) != exp {
+			t.Errorf(" Expect: %q\n Get: %q\n", exp, body)
+		}
+	}
+}
+
+func TestE2EUnauthorized(t *testing.T) {
+	n := newTestNet(t, map[string]Service{
+		"echo": {Addr: echoServer(t)},
+		"db":   {Addr: echoServer(t)},
+	})
+	n.conf.Peers["laptop"] = Peer{ID: n.connector.ID().Pretty(), Services: []string{"echo"}}
+	n.apply()
+
+	open := func(h host.Host, to peer.ID, service string) error {
+		s, err := h.NewStream(n.ctx, to, Protocol)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		if err := tunnel.WriteRequest(s, tunnel.Request{Service: service}); err != nil {
+			return err
+		}
+		return tunnel.ReadResponse(s)
+	}
+	if err := open(n.connector, n.agent.ID(), "echo"); err != nil {
+		t.Errorf("expect echo to be allowed, get %v", err)
+	}
+	if _, ok := open(n.connector, n.agent.ID(), "db").(*tunnel.RefusedError); !ok {
+		t.Error("expect db to be refused")
+	}
+	if _, ok := open(n.connector, n.agent.ID(), "unknown").(*tunnel.RefusedError); !ok {
+		t.Error("expect unknown services to be refused")
+	}
+	// Streams of unknown peers are reset without an answer, by the agent
+	// and the connector.
+	if err := open(n.stranger, n.agent.ID(), "echo"); err == nil {
+		t.Error("expect the agent to reset streams of unknown peers")
+	}
+	if err := open(n.stranger, n.connector.ID(), "echo"); err == nil {
+		t.Error("expect the connector to reset streams of unknown peers")
+	}
+
+	// Local connections of refused tunnels are closed.
+	got, err := echo(n.forward(tunnel.Request{Service: "db"}), []byte("SELECT 1"))
+	if err == nil && len(got) > 0 {
+		t.Errorf("expect refused tunnel to be closed, get %q", got)
+	}
+}
+
+func TestE2EReconnect(t *testing.T) {
+	n := newTestNet(t, map[string]Service{"echo": {Addr: echoServer(t)}})
+	addr := n.forward(tunnel.Request{Service: "echo"})
+	check := func(when string) {
+		data := randomBytes(t, 1<<10)
+		got, err := echo(addr, data)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: tunnel failed: %v", when, err)
+		}
+	}
+
+	check("connected")
+	if err := n.connector.Network().ClosePeer(n.agent.ID()); err != nil {
+		t.Fatal(err)
+	}
+	check("after disconnect")
+
+	// Tunnels opened while the agent is down wait for it to come back.
+	redialDelay = 100 * time.Millisecond
+	defer func() { redialDelay = 5 * time.Second }()
+	n.agent.Close()
+	for n.connector.Network().Connectedness(n.agent.ID()) == network.Connected {
+		time.Sleep(10 * time.Millisecond)
+	}
+	restarted := make(chan struct{})
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		n.startAgent()
+		close(restarted)
+	}()
+	check("after agent restart")
+	<-restarted
+
+	// Peers removed from the config are disconnected, and can connect
+	// again once added back.
+	laptop := n.conf.Peers["laptop"]
+	n.conf = &Config{Name: n.conf.Name, ID: n.conf.ID, Services: n.conf.Services, Peers: map[string]Peer{}}
+	if err := n.server.reload(n.conf); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := echo(addr, []byte("ping")); err == nil && len(got) > 0 {
+		t.Errorf("expect removed peer to be refused, get %q", got)
+	}
+	n.conf = &Config{Name: n.conf.Name, ID: n.conf.ID, Services: n.conf.Services, Peers: map[string]Peer{"laptop": laptop}}
+	if err := n.server.reload(n.conf); err != nil {
+		t.Fatal(err)
+	}
+	check("after adding the peer back")
+}
+
+func TestE2EBench(t *testing.T) {
+	n := newTestNet(t, nil)
+	c, err := tunnel.NewConnector(tunnel.Options{Host: n.connector, Peers: map[string]peer.ID{"home": n.agent.ID()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(ctx context.Context, service string) (net.Conn, error) {
+		return c.Dial(ctx, "home", service)
+	}
+
+	report := &benchReport{}
+	opts := benchOptions{Count: 20, Size: 4 << 20, Streams: 4, Opens: 20}
+	if err := runBench(n.ctx, dial, opts, report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Latency.Count != 20 || report.Latency.P50 <= 0 || report.Latency.P50 > report.Latency.P99 {
+		t.Errorf("unexpected latency %+v", report.Latency)
+	}
+	if report.Single.Bytes != 4<<20 || report.Multi.Streams != 4 || report.Multi.MiBps <= 0 {
+		t.Errorf("unexpected throughput %+v, %+v", report.Single, report.Multi)
+	}
+	if report.Opens.Count != 20 || report.OpenRate <= 0 {
+		t.Errorf("unexpected stream opens %+v", report.Opens)
+	}
+	if path, _ := connPath(n.connector, n.agent.ID()); path != "direct" {
+		t.Errorf("expect direct path, get %s", path)
+	}
+
+	// The built-in services are services like others for the ACLs.
+	n.conf.Peers["laptop"] = Peer{ID: n.connector.ID().Pretty(), Services: []string{defaultService}}
+	n.apply()
+	if _, err := dial(n.ctx, echoService); err == nil {
+		t.Error("expect peers restricted to other services to be refused")
+	}
+}
+
+func TestE2EPing(t *testing.T) {
+	n := newTestNet(t, nil)
+	if err := connectPeer(n.ctx, n.connector, nil, n.agent.ID(), &tracer{}); err != nil {
+		t.Fatal(err)
+	}
+	path, addr := connPath(n.connector, n.agent.ID())
+	if path != "direct" || transportName(addr) != "TCP" {
+		t.Errorf("expect a direct TCP connection, get %s over %s", path, transportName(addr))
+	}
+	replies := 0
+	rtts, err := pingPeer(n.ctx, n.connector, n.agent.ID(), 3, time.Millisecond, func(int, time.Duration) { replies++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rtts) != 3 || replies != 3 {
+		t.Errorf("expect 3 replies, get %d", len(rtts))
+	}
+
+	if err := connectPeer(n.ctx, n.connector, nil, n.stranger.ID(), &tracer{}); err == nil {
+		t.Error("expect error connecting to a peer without known addresses")
+	}
+}
+
+// closeBuffer is the stdout of nc in tests.
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestE2ENC(t *testing.T) {
+	n := newTestNet(t, map[string]Service{"echo": {Addr: echoServer(t)}})
+
+	data := randomBytes(t, 1<<20)
+	out := &closeBuffer{}
+	err := netcat(n.ctx, n.connector, nil, "home", n.agent.ID(), tunnel.Request{Service: "echo"}, time.Second, bytes.NewReader(data), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) || !out.closed {
+		t.Errorf("expect %d bytes echoed and stdout closed, get %d bytes, closed %v", len(data), out.Len(), out.closed)
+	}
+
+	exitCode := func(err error) int {
+		if e, ok := err.(interface{ ExitCode() int }); ok {
+			return e.ExitCode()
+		}
+		return 1
+	}
+	err = netcat(n.ctx, n.connector, nil, "home", n.agent.ID(), tunnel.Request{Service: "db"}, time.Second, bytes.NewReader(nil), &closeBuffer{})
+	if exitCode(err) != exitRefused {
+		t.Errorf("expect exit code %d for refused tunnels, get %v", exitRefused, err)
+	}
+	err = netcat(n.ctx, n.connector, nil, "stranger", n.stranger.ID(), tunnel.Request{Service: "echo"}, time.Second, bytes.NewReader(nil), &closeBuffer{})
+	if exitCode(err) != exitUnreachable {
+		t.Errorf("expect exit code %d for unreachable peers, get %v", exitUnreachable, err)
+	}
+}
+
+func TestE2ESendIdle(t *testing.T) {
+	defer func(timeout time.Duration) { fileIdleTimeout = timeout }(fileIdleTimeout)
+	fileIdleTimeout = 200 * time.Millisecond
+	n := newTestNet(t, nil)
+	dir := t.TempDir()
+	n.agent.SetStreamHandler(FileProtocol, n.server.fileHandler(""))
+	n.conf.Receive = &Receive{Dir: dir}
+	n.apply()
+
+	stream, err := n.connector.NewStream(n.ctx, n.agent.ID(), FileProtocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	data, _ := json.Marshal(fileOffer{Name: "slow.bin", Size: 1 << 20, SHA256: strings.Repeat("00", 32)})
+	if err := tunnel.WriteFrame(stream, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tunnel.ReadResponse(stream); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tunnel.ReadFrame(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	// Data arriving in time keeps the transfer going past the idle timeout.
+	for i := 0; i < 5; i++ {
+		if _, err := stream.Write(make([]byte, 1024)); err != nil {
+			t.Fatalf("write after %d pauses: %v", i, err)
+		}
+		time.Sleep(fileIdleTimeout / 2)
+	}
+
+	// A silent sender is dropped.
+	done := make(chan error, 1)
+	go func() {
+		_, err := stream.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expect the stream of a silent sender to be reset")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent sender not dropped")
+	}
+	part := partPath(filepath.Join(dir, "slow.bin"), strings.Repeat("00", 32))
+	if st, err := os.Stat(part); err != nil || st.Size() != 5*1024 {
+		t.Errorf("expect the received part to be kept for resuming, get %v", err)
+	}
+}
+
+func TestE2ESend(t *testing.T) {
+	n := newTestNet(t, nil)
+	dir := t.TempDir()
+	n.agent.SetStreamHandler(FileProtocol, n.server.fileHandler(""))
+	n.conf.Receive = &Receive{Dir: dir, MaxSize: 4}
+	n.apply()
+
+	src := t.TempDir()
+	write := func(name string, data []byte) string {
+		file := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	big := randomBytes(t, 3<<20)
+	small := []byte("hello")
+	write("docs/notes/small.txt", small)
+	files, err := collectFiles([]string{write("big.bin", big), filepath.Join(src, "docs"), write("empty", nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collectFiles([]string{filepath.Join(src, "missing")}); err == nil {
+		t.Error("expect error collecting a missing file")
+	}
+	sendAll := func(files []localFile) []int64 {
+		var offsets []int64
+		for _, f := range files {
+			offset, err := sendFile(n.ctx, n.connector, n.agent.ID(), f, func(int64, int64) {})
+			if err != nil {
+				t.Fatalf("send %s: %v", f.name, err)
+			}
+			offsets = append(offsets, offset)
+		}
+		return offsets
+	}
+	check := func(name string, expect []byte) {
+		got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expect) {
+			t.Errorf("%s: expect %d bytes, get %d", name, len(expect), len(got))
+		}
+	}
+	sendAll(files)
+	check("big.bin", big)
+	check("docs/notes/small.txt", small)
+	check("empty", nil)
+
+	// Sending again finds the files complete.
+	if offsets := sendAll(files[:1]); offsets[0] != int64(len(big)) {
+		t.Errorf("expect received file to be skipped, resumed at %d", offsets[0])
+	}
+
+	// A partial file is resumed, and verified as a whole.
+	resumed := write("resumed.bin", big)
+	sum, err := sha256File(resumed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := partPath(filepath.Join(dir, "resumed.bin"), sum)
+	if err := ioutil.WriteFile(part, big[:1<<20], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if offsets := sendAll([]localFile{{path: resumed, name: "resumed.bin"}}); offsets[0] != 1<<20 {
+		t.Errorf("expect transfer resumed at 1 MiB, get %d", offsets[0])
+	}
+	check("resumed.bin", big)
+
+	// A partial file larger than the offer is started over.
+	oversized := append(append([]byte(nil), big...), "trailing"...)
+	if err := ioutil.WriteFile(partPath(filepath.Join(dir, "oversized.bin"), sum), oversized, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if offsets := sendAll([]localFile{{path: resumed, name: "oversized.bin"}}); offsets[0] != 0 {
+		t.Errorf("expect transfer started over, resumed at %d", offsets[0])
+	}
+	check("oversized.bin", big)
+
+	corrupt := append([]byte(nil), big[:1<<20]...)
+	corrupt[0]++
+	if err := ioutil.WriteFile(partPath(filepath.Join(dir, "corrupt.bin"), sum), corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = sendFile(n.ctx, n.connector, n.agent.ID(), localFile{path: resumed, name: "corrupt.bin"}, func(int64, int64) {})
+	if _, ok := err.(*tunnel.RefusedError); !ok {
+		t.Errorf("expect checksum mismatch, get %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "corrupt.bin")); err == nil {
+		t.Error("expect file with checksum mismatch to be dropped")
+	}
+
+	refused := func(f localFile) {
+		t.Helper()
+		if _, err := sendFile(n.ctx, n.connector, n.agent.ID(), f, func(int64, int64) {}); err == nil {
+			t.Errorf("expect %s to be refused", f.name)
+		}
+	}
+	refused(localFile{path: write("large.bin", randomBytes(t, 5<<20)), name: "large.bin"})
+	refused(localFile{path: resumed, name: "../escape.bin"})
+	refused(localFile{path: files[1].path, name: "big.bin"})
+
+	n.conf.Peers["laptop"] = Peer{ID: n.connector.ID().Pretty(), Services: []string{echoService}}
+	n.apply()
+	refused(localFile{path: resumed, name: "other.bin"})
+	n.conf.Peers["laptop"] = Peer{ID: n.connector.ID().Pretty()}
+	n.conf.Receive = nil
+	n.apply()
+	refused(localFile{path: resumed, name: "other.bin"})
+}
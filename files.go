@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/p2ptunnel/p2ptunnel/pkg/tunnel"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// fileService names file transfers in the services lists of peers.
+	fileService = "@files"
+	// defaultReceiveMaxSize is the size limit of received files in MiB.
+	defaultReceiveMaxSize = 1024
+	// fileOfferTimeout bounds reading and answering the offer of a file.
+	fileOfferTimeout = time.Minute
+)
+
+// fileIdleTimeout bounds the pauses of the sender while sending a file, and
+// answering it once the file is stored.
+var fileIdleTimeout = time.Minute
+
+// fileOffer starts a FileProtocol stream. The agent answers with a response,
+// and if it accepts with a frame holding the little-endian uint64 offset to
+// resume from. The sender then sends the rest of the file and closes the
+// stream for writing, and the agent answers with a second response once the
+// file is verified and stored.
+type fileOffer struct {
+	// Name is the slash separated path of the file in the receive directory.
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// check validates the offer against the size limit in bytes.
+func (o fileOffer) check(maxSize int64) error {
+	if err := checkFileName(o.Name); err != nil {
+		return err
+	}
+	if o.Size < 0 || o.Size > maxSize {
+		return errors.Errorf("%s is larger than the limit of %s", o.Name, formatBytes(maxSize))
+	}
+	if sum, err := hex.DecodeString(o.SHA256); err != nil || len(sum) != sha256.Size {
+		return errors.Errorf("invalid checksum %q", o.SHA256)
+	}
+	return nil
+}
+
+// checkFileName accepts relative slash separated paths which stay inside the
+// receive directory.
+func checkFileName(name string) error {
+	if name == "" || path.Clean(name) != name || path.IsAbs(name) ||
+		filepath.IsAbs(filepath.FromSlash(name)) || filepath.VolumeName(filepath.FromSlash(name)) != "" {
+		return errors.Errorf("invalid file name %q", name)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "." || elem == ".." || strings.ContainsRune(elem, filepath.Separator) {
+			return errors.Errorf("invalid file name %q", name)
+		}
+	}
+	return nil
+}
+
+// partPath is where a file is written until it is complete. The checksum in
+// the name keeps a changed file from resuming the data of an older version.
+func partPath(file, sum string) string {
+	return fmt.Sprintf("%s.%s.part", file, sum[:16])
+}
+
+// sha256File returns the hex encoded SHA-256 checksum of the file.
+func sha256File(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// receiveDir returns the receive directory and size limit of the applied
+// config for the named peer.
+func (a *agentServer) receiveDir(name, configFile string) (string, int64, error) {
+	conf := a.config()
+	if err := conf.checkGrant(name, time.Now()); err != nil {
+		return "", 0, err
+	}
+	r := conf.Receive
+	if r == nil || r.Dir == "" {
+		return "", 0, errors.New("receiving files is disabled")
+	}
+	if !conf.Peers[name].allowsService(fileService) {
+		return "", 0, errors.Errorf("peer %s is not allowed to send files", name)
+	}
+	dir := r.Dir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(configFile), dir)
+	}
+	maxSize := r.MaxSize
+	if maxSize == 0 {
+		maxSize = defaultReceiveMaxSize
+	}
+	return dir, maxSize << 20, nil
+}
+
+// fileHandler returns the agent side of FileProtocol, storing the files of
+// configured peers in the receive directory of the config.
+func (a *agentServer) fileHandler(configFile string) network.StreamHandler {
+	return func(stream network.Stream) {
+		slog := logger.With("stream_id", stream.ID(), "remote_addr", stream.Conn().RemoteMultiaddr().String())
+		name, ok := a.lookupPeer(stream.Conn().RemotePeer().Pretty())
+		if !ok {
+			slog.Warnw("reset file stream of unknown peer", "peer_id", stream.Conn().RemotePeer().Pretty())
+			if err := stream.Reset(); err != nil {
+				slog.Debugw("reset stream", "error", err)
+			}
+			return
+		}
+		slog = slog.With("peer", name)
+		if err := a.receiveFile(stream, name, configFile, slog); err != nil {
+			slog.Warnw("receive file", "error", err)
+			stream.Reset()
+			return
+		}
+		stream.Close()
+	}
+}
+
+// receiveFile answers the offer read from stream and stores the file. Refused
+// offers and failed checksums are answered and logged, not returned.
+func (a *agentServer) receiveFile(stream network.Stream, name, configFile string, slog *zap.SugaredLogger) error {
+	started := time.Now()
+	if err := stream.SetDeadline(started.Add(fileOfferTimeout)); err != nil {
+		return err
+	}
+	data, err := tunnel.ReadFrame(stream)
+	if err != nil {
+		return errors.Wrap(err, "read offer")
+	}
+	var offer fileOffer
+	if err := json.Unmarshal(data, &offer); err != nil {
+		return errors.Wrap(err, "read offer")
+	}
+
+	dir, maxSize, err := a.receiveDir(name, configFile)
+	if err == nil {
+		err = offer.check(maxSize)
+	}
+	var file string
+	var offset int64
+	var received bool
+	if err == nil {
+		file = filepath.Join(dir, filepath.FromSlash(offer.Name))
+		offset, received, err = resumeOffset(file, offer)
+	}
+	if err != nil {
+		slog.Warnw("refuse file", "file", offer.Name, "error", err)
+		return tunnel.WriteResponse(stream, err.Error())
+	}
+	if err := tunnel.WriteResponse(stream, ""); err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(offset))
+	if err := tunnel.WriteFrame(stream, buf); err != nil {
+		return err
+	}
+
+	if received {
+		slog.Infow("file already received", "file", offer.Name)
+		return tunnel.WriteResponse(stream, "")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	part := partPath(file, offer.SHA256)
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// Drop whatever the part file holds beyond the offset, e.g. of a larger
+	// file sent before under the same checksum.
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	n, err := io.CopyN(f, &idleReader{stream: stream, timeout: fileIdleTimeout}, offer.Size-offset)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		slog.Infow("file transfer interrupted, kept for resuming", "file", offer.Name, "bytes", offset+n, "size", offer.Size, "error", err)
+		return err
+	}
+	sum, err := sha256File(part)
+	if err != nil {
+		return err
+	}
+	if err := stream.SetWriteDeadline(time.Now().Add(fileIdleTimeout)); err != nil {
+		return err
+	}
+	if sum != offer.SHA256 {
+		os.Remove(part)
+		slog.Warnw("file checksum mismatch", "file", offer.Name, "expect", offer.SHA256, "get", sum)
+		return tunnel.WriteResponse(stream, "checksum mismatch, send the file again")
+	}
+	if err := os.Rename(part, file); err != nil {
+		return err
+	}
+	slog.Infow("file received", "file", offer.Name, "bytes", offer.Size, "resumed_at", offset, "duration", time.Since(started))
+	return tunnel.WriteResponse(stream, "")
+}
+
+// idleReader reads from a stream, failing once it stays silent for timeout.
+type idleReader struct {
+	stream  network.Stream
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	if err := r.stream.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+		return 0, err
+	}
+	return r.stream.Read(p)
+}
+
+// resumeOffset returns the offset to resume the offered file from, the size
+// of its partial file, or the full size and true if the file was received
+// already.
+func resumeOffset(file string, offer fileOffer) (int64, bool, error) {
+	if st, err := os.Stat(file); err == nil {
+		if st.Size() == offer.Size {
+			if sum, err := sha256File(file); err == nil && sum == offer.SHA256 {
+				return offer.Size, true, nil
+			}
+		}
+		return 0, false, errors.Errorf("%s exists already", offer.Name)
+	}
+	st, err := os.Stat(partPath(file, offer.SHA256))
+	if err != nil || st.Size() > offer.Size {
+		return 0, false, nil
+	}
+	return st.Size(), false, nil
+}
+
+// localFile is a file given to send, with the name it is sent under.
+type localFile struct {
+	path, name string
+}
+
+// collectFiles lists the files of paths. Directories are sent with their
+// files, under the name of the directory.
+func collectFiles(paths []string) ([]localFile, error) {
+	var files []localFile
+	for _, p := range paths {
+		st, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !st.IsDir() {
+			if !st.Mode().IsRegular() {
+				return nil, errors.Errorf("%s is not a regular file", p)
+			}
+			files = append(files, localFile{path: p, name: filepath.Base(p)})
+			continue
+		}
+		base := filepath.Dir(filepath.Clean(p))
+		err = filepath.Walk(p, func(file string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(base, file)
+			if err != nil {
+				return err
+			}
+			files = append(files, localFile{path: file, name: filepath.ToSlash(rel)})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// send sends files to the receive directory of a peer.
+func send(ctx *cli.Context) error {
+	if len(ctx.Args()) < 2 {
+		return errors.New("Please provide the name of the peer and the files to send")
+	}
+	name := ctx.Args()[0]
+	files, err := collectFiles(ctx.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	cctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node, dht, peers, err := newClientNode(cctx, ctx)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+	id, ok := peers[name]
+	if !ok {
+		return errors.Errorf("Peer %s is not in the config", name)
+	}
+	dctx, dcancel := context.WithTimeout(cctx, ctx.Duration("timeout"))
+	defer dcancel()
+	if err := connectPeer(dctx, node, dht, id, &tracer{}); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		p := newProgress(f.name, !ctx.Bool("quiet") && isTerminal(os.Stdout))
+		offset, err := sendFile(cctx, node, id, f, p.update)
+		if err != nil {
+			p.clear()
+			return errors.Wrapf(err, "send %s", f.path)
+		}
+		p.done(offset)
+	}
+	return nil
+}
+
+// sendFile sends the file f to the peer id, passing the bytes sent so far and
+// the size to progress. It returns the offset the transfer resumed from.
+func sendFile(ctx context.Context, node host.Host, id peer.ID, f localFile, progress func(sent, size int64)) (int64, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return 0, err
+	}
+	offer := fileOffer{Name: f.name, Size: st.Size(), SHA256: hex.EncodeToString(h.Sum(nil))}
+
+	stream, err := node.NewStream(ctx, id, FileProtocol)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	data, _ := json.Marshal(offer)
+	if err := tunnel.WriteFrame(stream, data); err != nil {
+		stream.Reset()
+		return 0, err
+	}
+	if err := tunnel.ReadResponse(stream); err != nil {
+		return 0, err
+	}
+	buf, err := tunnel.ReadFrame(stream)
+	if err != nil {
+		stream.Reset()
+		return 0, errors.Wrap(err, "read offset")
+	}
+	if len(buf) != 8 || binary.LittleEndian.Uint64(buf) > uint64(offer.Size) {
+		stream.Reset()
+		return 0, errors.Errorf("invalid offset %x", buf)
+	}
+	offset := int64(binary.LittleEndian.Uint64(buf))
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		stream.Reset()
+		return 0, err
+	}
+	sent := offset
+	progress(sent, offer.Size)
+	w := tapWriter{stream, func(b []byte) {
+		sent += int64(len(b))
+		progress(sent, offer.Size)
+	}}
+	if _, err := io.CopyN(w, file, offer.Size-offset); err != nil {
+		stream.Reset()
+		return 0, err
+	}
+	if err := stream.CloseWrite(); err != nil {
+		stream.Reset()
+		return 0, err
+	}
+	if err := tunnel.ReadResponse(stream); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// progress shows the progress of sending a file on a terminal, and a line per
+// sent file.
+type progress struct {
+	name        string
+	live        bool
+	start, last time.Time
+	size        int64
+}
+
+func newProgress(name string, live bool) *progress {
+	return &progress{name: name, live: live}
+}
+
+func (p *progress) update(sent, size int64) {
+	if p.start.IsZero() {
+		// The first update comes once the transfer starts.
+		p.start = time.Now()
+	}
+	p.size = size
+	if !p.live || time.Since(p.last) < 100*time.Millisecond {
+		return
+	}
+	p.last = time.Now()
+	percent := 100.0
+	if size > 0 {
+		percent = float64(sent) * 100 / float64(size)
+	}
+	fmt.Printf("\r%-32s %5.1f%%  %s / %s\033[K", p.name, percent, formatBytes(sent), formatBytes(size))
+}
+
+func (p *progress) clear() {
+	if p.live {
+		fmt.Print("\r\033[K")
+	}
+}
+
+func (p *progress) done(offset int64) {
+	p.clear()
+	if offset > 0 && offset == p.size {
+		fmt.Printf("%-32s already received\n", p.name)
+		return
+	}
+	elapsed := time.Since(p.start)
+	rate := float64(p.size-offset) / elapsed.Seconds()
+	resumed := ""
+	if offset > 0 {
+		resumed = fmt.Sprintf(", resumed at %s", formatBytes(offset))
+	}
+	fmt.Printf("%-32s %s in %s (%s/s%s), sha256 verified\n", p.name, formatBytes(p.size),
+		elapsed.Round(time.Millisecond), formatBytes(int64(rate)), resumed)
+}
+
+// isTerminal reports whether f is a terminal, where progress is redrawn.
+func isTerminal(f *os.File) bool {
+	st, err := f.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,31 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func FuzzParseInviteToken(f *testing.F) {
+	f.Add((&inviteToken{Name: "laptop", ID: "12D3KooWExample", Addrs: []string{"/ip4/192.0.2.1/tcp/4001"}, Secret: "00ff", Expires: 1700000000}).String())
+	f.Add(tokenPrefix)
+	f.Fuzz(func(t *testing.T, s string) {
+		tok, err := parseInviteToken(s)
+		if err != nil {
+			return
+		}
+		if len(tok.Addrs) == 0 {
+			// An empty list is left out of the token.
+			tok.Addrs = nil
+		}
+		got, err := parseInviteToken(tok.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tok) {
+			t.Errorf(" Expect: %+v\n Get: %+v\n", tok, got)
+		}
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"net/http"
+	"time"
+)
+
+// grantCheckInterval is how often open connections are checked for expired or
+// revoked grants.
+const grantCheckInterval = 5 * time.Second
+
+// isRevoked reports whether the peer ID is in the revoked list.
+func (c *Config) isRevoked(id string) bool {
+	for _, r := range c.Revoked {
+		if r == id {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGrant returns why the named peer may not open tunnels at the given time,
+// or nil if its grant is valid.
+func (c *Config) checkGrant(name string, now time.Time) error {
+	p, ok := c.Peers[name]
+	if !ok {
+		return errors.Errorf("unknown peer %s", name)
+	}
+	if c.isRevoked(p.ID) {
+		return errors.Errorf("access of peer %s has been revoked", name)
+	}
+	if p.NotBefore != nil && now.Before(*p.NotBefore) {
+		return errors.Errorf("access of peer %s starts at %s", name, p.NotBefore.Format(time.RFC3339))
+	}
+	if p.Expires != nil && !now.Before(*p.Expires) {
+		return errors.Errorf("access of peer %s expired at %s", name, p.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// enforceGrants disconnects connected peers once their grant expires or is
+// revoked.
+func (a *agentServer) enforceGrants(ctx context.Context) {
+	ticker := time.NewTicker(grantCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, id := range a.node.Network().Peers() {
+				name, ok := a.lookupPeer(id.Pretty())
+				if !ok {
+					continue
+				}
+				err := a.checkGrant(name, now)
+				if err == nil {
+					continue
+				}
+				logger.Infow("disconnecting peer", "peer", name, "reason", err)
+				if err := a.node.Network().ClosePeer(id); err != nil {
+					logger.Warnw("disconnect peer", "peer", name, "error", err)
+				}
+			}
+		}
+	}
+}
+
+func grantPeer(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return errors.New("Please provide both peer name and peer ID")
+	}
+	name, id := ctx.Args()[0], ctx.Args()[1]
+	if _, err := peer.Decode(id); err != nil {
+		return errors.Wrapf(err, "invalid peer ID %s", id)
+	}
+
+	var p Peer
+	configFile := ctx.GlobalString("conf")
+	_, err := updateConf(configFile, func(conf *Config) error {
+		var ok bool
+		p, ok = conf.Peers[name]
+		if ok && p.ID != id {
+			return errors.Errorf("Peer %s has been added with ID %s", name, p.ID)
+		}
+		p.ID = id
+
+		now := time.Now()
+		p.NotBefore = nil
+		if from := ctx.String("from"); from != "" {
+			t, err := time.Parse(time.RFC3339, from)
+			if err != nil {
+				return errors.Wrap(err, "invalid --from time")
+			}
+			p.NotBefore = &t
+			now = t
+		}
+		p.Expires = nil
+		if d := ctx.Duration("for"); d > 0 {
+			t := now.Add(d).Truncate(time.Second)
+			p.Expires = &t
+		}
+
+		// Granting access again lifts an earlier revocation.
+		revoked := conf.Revoked[:0]
+		for _, r := range conf.Revoked {
+			if r != id {
+				revoked = append(revoked, r)
+			}
+		}
+		conf.Revoked = revoked
+		conf.Peers[name] = p
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if p.Expires != nil {
+		fmt.Printf("%s - %s has been granted access until %s\n", name, id, p.Expires.Format(time.RFC3339))
+	} else {
+		fmt.Printf("%s - %s has been granted access\n", name, id)
+	}
+	return nil
+}
+
+func revokePeer(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.New("Please provide the peer name")
+	}
+	name := ctx.Args()[0]
+
+	var p Peer
+	configFile := ctx.GlobalString("conf")
+	_, err := updateConf(configFile, func(conf *Config) error {
+		var ok bool
+		p, ok = conf.Peers[name]
+		if !ok {
+			return errors.Errorf("Peer %s is not in config file %s", name, configFile)
+		}
+		delete(conf.Peers, name)
+		if !conf.isRevoked(p.ID) {
+			conf.Revoked = append(conf.Revoked, p.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s - %s has been revoked in config file %s\n", name, p.ID, configFile)
+
+	// A running agent closes the open connections of the peer once it
+	// reloads the config.
+	if err := adminRequest(ctx, http.MethodPost, "/reload", nil, nil); err != nil {
+		fmt.Printf("The running agent was not reloaded: %v\n", err)
+		fmt.Printf("Open connections of %s stay open until the agent reloads its config, e.g. on SIGHUP.\n", name)
+		return nil
+	}
+	fmt.Printf("The running agent reloaded its config and closed the connections of %s\n", name)
+	return nil
+}
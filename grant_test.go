@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/p2ptunnel/p2ptunnel/pkg/tunnel"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckGrant(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	conf := &Config{
+		Peers: map[string]Peer{
+			"laptop":  {ID: "QmLaptop"},
+			"temp":    {ID: "QmTemp", Expires: &future},
+			"expired": {ID: "QmExpired", Expires: &past},
+			"ends":    {ID: "QmEnds", Expires: &now},
+			"later":   {ID: "QmLater", NotBefore: &future},
+			"started": {ID: "QmStarted", NotBefore: &now, Expires: &future},
+			"revoked": {ID: "QmRevoked", Expires: &future},
+		},
+		Revoked: []string{"QmRevoked", "QmGone"},
+	}
+	tests := []struct {
+		peer    string
+		wantErr bool
+	}{
+		{"laptop", false},
+		{"temp", false},
+		{"expired", true},
+		{"ends", true},
+		{"later", true},
+		{"started", false},
+		{"revoked", true},
+		{"stranger", true},
+	}
+	for _, tt := range tests {
+		if err := conf.checkGrant(tt.peer, now); (err != nil) != tt.wantErr {
+			t.Errorf("checkGrant(%q) = %v, want error %v", tt.peer, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIsRevoked(t *testing.T) {
+	conf := &Config{Revoked: []string{"QmRevoked", "QmGone"}}
+	for id, want := range map[string]bool{"QmRevoked": true, "QmGone": true, "QmLaptop": false, "": false} {
+		if got := conf.isRevoked(id); got != want {
+			t.Errorf("isRevoked(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestRevokeClosesTunnels(t *testing.T) {
+	n := newTestNet(t, map[string]Service{"echo": {Addr: echoServer(t)}})
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	n.conf.Version = configVersion
+	if err := writeConf(file, n.conf); err != nil {
+		t.Fatal(err)
+	}
+	global := map[string]string{"conf": file, "socket": ""}
+	admin := &adminServer{
+		mode:  "agent",
+		node:  n.agent,
+		peers: n.server.peers,
+		reload: func() error {
+			return reloadConf(file, n.server.reload)
+		},
+	}
+	if err := serveAdmin(n.ctx, adminSocket(newTestContext(global, nil)), admin); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("tcp", n.forward(tunnel.Request{Service: "echo"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	buf := make([]byte, 5)
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := revokePeer(newTestContext(global, nil, "laptop")); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(buf); err == nil || os.IsTimeout(err) {
+		t.Errorf("expect the tunnel of the revoked peer to be closed, get %v", err)
+	}
+	if n.agent.Network().Connectedness(n.connector.ID()) == network.Connected {
+		t.Error("revoked peer still connected")
+	}
+}
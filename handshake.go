@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/p2ptunnel/p2ptunnel/pkg/tunnel"
+	"github.com/pkg/errors"
+	"path"
+	"time"
+)
+
+// defaultService is the service name used by the agent's forward port argument
+// and by connectors which don't ask for a specific service.
+const defaultService = tunnel.DefaultService
+
+// allowsService reports whether the peer may use the named service. A peer
+// without a services list may use every service.
+func (p Peer) allowsService(name string) bool {
+	if len(p.Services) == 0 {
+		return true
+	}
+	for _, s := range p.Services {
+		if s == "*" || s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsDestination reports whether the peer may reach dest through a proxy
+// service. Patterns use path.Match syntax, such as "*.staging.lan:443".
+func (p Peer) allowsDestination(dest string) bool {
+	for _, pattern := range p.Destinations {
+		if ok, err := path.Match(pattern, dest); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks req against the ACLs of the named peer and returns the local
+// address the tunnel should be forwarded to, empty for built-in services.
+func (c *Config) authorize(name string, req tunnel.Request) (string, error) {
+	if err := c.checkGrant(name, time.Now()); err != nil {
+		return "", err
+	}
+	p := c.Peers[name]
+	if _, ok := builtinServices[req.Service]; ok {
+		if !p.allowsService(req.Service) {
+			return "", errors.Errorf("peer %s is not allowed to use service %q", name, req.Service)
+		}
+		return "", nil
+	}
+	svc, ok := c.Services[req.Service]
+	if !ok {
+		return "", errors.Errorf("unknown service %q", req.Service)
+	}
+	if !p.allowsService(req.Service) {
+		return "", errors.Errorf("peer %s is not allowed to use service %q", name, req.Service)
+	}
+	if !svc.Proxy {
+		return svc.Addr, nil
+	}
+	if req.Dest == "" {
+		return "", errors.Errorf("service %q needs a destination", req.Service)
+	}
+	if !p.allowsDestination(req.Dest) {
+		return "", errors.Errorf("peer %s is not allowed to reach %s", name, req.Dest)
+	}
+	return req.Dest, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/p2ptunnel/p2ptunnel/pkg/tunnel"
+	"testing"
+)
+
+func TestAllowsService(t *testing.T) {
+	tests := []struct {
+		services []string
+		name     string
+		want     bool
+	}{
+		{nil, "ssh", true},
+		{nil, "@echo", true},
+		{[]string{"ssh"}, "ssh", true},
+		{[]string{"ssh"}, "web", false},
+		{[]string{"ssh", "web"}, "web", true},
+		{[]string{"*"}, "db", true},
+		{[]string{"ssh"}, "@echo", false},
+		{[]string{"@echo"}, "@echo", true},
+	}
+	for _, tt := range tests {
+		p := Peer{Services: tt.services}
+		if got := p.allowsService(tt.name); got != tt.want {
+			t.Errorf("Peer{Services: %q}.allowsService(%q) = %v, want %v", tt.services, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAllowsDestination(t *testing.T) {
+	tests := []struct {
+		destinations []string
+		dest         string
+		want         bool
+	}{
+		{nil, "db.lan:5432", false},
+		{[]string{"db.lan:5432"}, "db.lan:5432", true},
+		{[]string{"db.lan:5432"}, "db.lan:5433", false},
+		{[]string{"*.staging.lan:443"}, "web.staging.lan:443", true},
+		{[]string{"*.staging.lan:443"}, "web.staging.lan:80", false},
+		{[]string{"*.staging.lan:443"}, "web.prod.lan:443", false},
+		{[]string{"10.0.0.*:*"}, "10.0.0.7:22", true},
+		{[]string{"[bad"}, "[bad", false},
+		{[]string{"[bad", "*:22"}, "host:22", true},
+	}
+	for _, tt := range tests {
+		p := Peer{Destinations: tt.destinations}
+		if got := p.allowsDestination(tt.dest); got != tt.want {
+			t.Errorf("Peer{Destinations: %q}.allowsDestination(%q) = %v, want %v", tt.destinations, tt.dest, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	conf := &Config{
+		Services: map[string]Service{
+			"ssh":   {Addr: "localhost:22"},
+			"web":   {Addr: "localhost:8080"},
+			"proxy": {Proxy: true},
+		},
+		Peers: map[string]Peer{
+			"admin":  {ID: "QmAdmin"},
+			"guest":  {ID: "QmGuest", Services: []string{"web"}},
+			"dev":    {ID: "QmDev", Services: []string{"proxy", "@echo"}, Destinations: []string{"*.staging.lan:443"}},
+			"banned": {ID: "QmBanned"},
+		},
+		Revoked: []string{"QmBanned"},
+	}
+	tests := []struct {
+		peer    string
+		req     tunnel.Request
+		want    string
+		wantErr bool
+	}{
+		{"admin", tunnel.Request{Service: "ssh"}, "localhost:22", false},
+		{"admin", tunnel.Request{Service: "web"}, "localhost:8080", false},
+		{"admin", tunnel.Request{Service: "db"}, "", true},
+		{"admin", tunnel.Request{Service: "@echo"}, "", false},
+		{"admin", tunnel.Request{Service: "proxy"}, "", true},
+		{"admin", tunnel.Request{Service: "proxy", Dest: "web.staging.lan:443"}, "", true},
+		{"guest", tunnel.Request{Service: "web"}, "localhost:8080", false},
+		{"guest", tunnel.Request{Service: "ssh"}, "", true},
+		{"guest", tunnel.Request{Service: "@echo"}, "", true},
+		{"dev", tunnel.Request{Service: "proxy", Dest: "web.staging.lan:443"}, "web.staging.lan:443", false},
+		{"dev", tunnel.Request{Service: "proxy", Dest: "web.prod.lan:443"}, "", true},
+		{"dev", tunnel.Request{Service: "proxy"}, "", true},
+		{"dev", tunnel.Request{Service: "@echo"}, "", false},
+		{"dev", tunnel.Request{Service: "ssh"}, "", true},
+		{"banned", tunnel.Request{Service: "ssh"}, "", true},
+		{"stranger", tunnel.Request{Service: "ssh"}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := conf.authorize(tt.peer, tt.req)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("authorize(%q, %+v) = %q, %v, want %q, error %v", tt.peer, tt.req, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
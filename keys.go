@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	pb "github.com/libp2p/go-libp2p-core/crypto/pb"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultKeyType is the key type of new identities.
+	defaultKeyType = "ed25519"
+	// rsaKeyBits is the size of new RSA keys.
+	rsaKeyBits = 2048
+	// rotationPrefix marks key rotation statements and their format version.
+	rotationPrefix = "p2ptrot1:"
+)
+
+// keyTypes maps the names accepted by --key-type to libp2p key types.
+var keyTypes = map[string]int{
+	"ed25519": crypto.Ed25519,
+	"rsa":     crypto.RSA,
+	"ecdsa":   crypto.ECDSA,
+}
+
+// generateKey creates a new private key of the named type.
+func generateKey(keyType string) (crypto.PrivKey, error) {
+	typ, ok := keyTypes[keyType]
+	if !ok {
+		return nil, errors.Errorf("unsupported key type %q, use ed25519, rsa or ecdsa", keyType)
+	}
+	priv, _, err := crypto.GenerateKeyPair(typ, rsaKeyBits)
+	return priv, err
+}
+
+// keyTypeName returns the --key-type name of key.
+func keyTypeName(key crypto.PrivKey) string {
+	switch key.Type() {
+	case pb.KeyType_RSA:
+		return "rsa"
+	case pb.KeyType_ECDSA:
+		return "ecdsa"
+	default:
+		return defaultKeyType
+	}
+}
+
+// keyRotation states that the identity OldID moved to NewID. It is signed by
+// the old private key, whose public key is included as RSA peer IDs are only
+// hashes of it.
+type keyRotation struct {
+	OldKey    []byte `json:"old_key"`
+	NewID     string `json:"new_id"`
+	Time      int64  `json:"time"`
+	Signature []byte `json:"sig"`
+}
+
+func (r *keyRotation) signedData(oldID peer.ID) []byte {
+	return []byte(fmt.Sprintf("p2ptunnel key rotation\n%s\n%s\n%d", oldID.Pretty(), r.NewID, r.Time))
+}
+
+func (r *keyRotation) String() string {
+	data, _ := json.Marshal(r)
+	return rotationPrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseRotation decodes a rotation statement and verifies its signature. It
+// returns the old peer ID the statement is about.
+func parseRotation(s string) (*keyRotation, peer.ID, error) {
+	if !strings.HasPrefix(s, rotationPrefix) {
+		return nil, "", errors.New("not a p2ptunnel key rotation statement")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, rotationPrefix))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "decode rotation statement")
+	}
+	r := &keyRotation{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, "", errors.Wrap(err, "decode rotation statement")
+	}
+	pub, err := crypto.UnmarshalPublicKey(r.OldKey)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "decode old public key")
+	}
+	oldID, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := peer.Decode(r.NewID); err != nil {
+		return nil, "", errors.Wrap(err, "decode new peer ID")
+	}
+	ok, err := pub.Verify(r.signedData(oldID), r.Signature)
+	if err != nil || !ok {
+		return nil, "", errors.New("invalid signature of rotation statement")
+	}
+	return r, oldID, nil
+}
+
+func rotateKey(ctx *cli.Context) error {
+	var (
+		oldID, newID       peer.ID
+		r                  *keyRotation
+		keyFile, stagedKey string
+	)
+	configFile := ctx.GlobalString("conf")
+	_, err := updateConf(configFile, func(conf *Config) error {
+		if err := resolvePrivateKey(conf, configFile); err != nil {
+			return err
+		}
+		// A key file named by the config is rotated in place, other key sources
+		// have to be updated by hand.
+		if conf.PrivateKeyFile != "" && conf.keySource == conf.keyFilePath(configFile) {
+			keyFile = conf.keySource
+		} else if err := conf.keyElsewhere(); err != nil {
+			return err
+		}
+
+		var (
+			pass []byte
+			err  error
+		)
+		keyBytes := []byte(conf.PrivateKey)
+		if keyFile != "" {
+			keyBytes = []byte(conf.resolvedKey)
+		} else if conf.EncryptedKey != nil {
+			pass, err = readPassphrase(ctx, false)
+			if err != nil {
+				return err
+			}
+			keyBytes, err = conf.EncryptedKey.Decrypt(pass)
+			if err != nil {
+				return err
+			}
+		}
+		oldKey, err := crypto.UnmarshalPrivateKey(keyBytes)
+		if err != nil {
+			return err
+		}
+		oldID, err = peer.IDFromPrivateKey(oldKey)
+		if err != nil {
+			return err
+		}
+
+		keyType := ctx.String("key-type")
+		if keyType == "" {
+			keyType = keyTypeName(oldKey)
+		}
+		newKey, err := generateKey(keyType)
+		if err != nil {
+			return err
+		}
+		newID, err = peer.IDFromPrivateKey(newKey)
+		if err != nil {
+			return err
+		}
+		newKeyBytes, err := crypto.MarshalPrivateKey(newKey)
+		if err != nil {
+			return err
+		}
+
+		r = &keyRotation{NewID: newID.Pretty(), Time: time.Now().Unix()}
+		r.OldKey, err = crypto.MarshalPublicKey(oldKey.GetPublic())
+		if err != nil {
+			return err
+		}
+		r.Signature, err = oldKey.Sign(r.signedData(oldID))
+		if err != nil {
+			return err
+		}
+
+		conf.ID = newID.Pretty()
+		if keyFile != "" {
+			// The old key stays in place until the config naming the new
+			// ID is saved.
+			stagedKey, err = stageKeyFile(keyFile, newKeyBytes)
+			if err != nil {
+				return err
+			}
+		} else if pass != nil {
+			conf.EncryptedKey, err = encryptKey(newKeyBytes, pass)
+			if err != nil {
+				return err
+			}
+		} else {
+			conf.PrivateKey = string(newKeyBytes)
+		}
+		return nil
+	})
+	if err != nil {
+		if stagedKey != "" {
+			os.Remove(stagedKey)
+		}
+		return err
+	}
+	if stagedKey != "" {
+		if err := os.Rename(stagedKey, keyFile); err != nil {
+			return errors.Wrapf(err, "replace private key file, the new key is in %s", stagedKey)
+		}
+	}
+
+	fmt.Printf("Rotated identity %s to %s\n", oldID.Pretty(), newID.Pretty())
+	fmt.Println("Restart the agent or connector to use it. Let your peers run:")
+	fmt.Printf("\n  p2ptunnel accept-rotation %s\n\n", r)
+	return nil
+}
+
+func acceptRotation(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.New("Please provide the rotation statement")
+	}
+	r, oldID, err := parseRotation(ctx.Args()[0])
+	if err != nil {
+		return err
+	}
+
+	var name string
+	configFile := ctx.GlobalString("conf")
+	_, err = updateConf(configFile, func(conf *Config) error {
+		for n, p := range conf.Peers {
+			if p.ID != oldID.Pretty() {
+				continue
+			}
+			p.ID = r.NewID
+			conf.Peers[n] = p
+			name = n
+			return nil
+		}
+		return errors.Errorf("No peer with ID %s in config file %s", oldID.Pretty(), configFile)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s - %s has been updated to %s in config file %s\n", name, oldID.Pretty(), r.NewID, configFile)
+	return nil
+}
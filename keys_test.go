@@ -0,0 +1,116 @@
+package main
+
+import (
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRotation(t *testing.T) {
+	oldKey, other := newTestKey(t), newTestKey(t)
+	oldID, err := peer.IDFromPrivateKey(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newID, err := peer.IDFromPrivateKey(newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := crypto.MarshalPublicKey(oldKey.GetPublic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, err := crypto.MarshalPublicKey(other.GetPublic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rotation returns a statement signed by key after change modified it.
+	rotation := func(key crypto.PrivKey, change func(r *keyRotation)) string {
+		r := &keyRotation{OldKey: pub, NewID: newID.Pretty(), Time: 1700000000}
+		sig, err := key.Sign(r.signedData(oldID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Signature = sig
+		change(r)
+		return r.String()
+	}
+	valid := rotation(oldKey, func(r *keyRotation) {})
+	r, id, err := parseRotation(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != oldID || r.NewID != newID.Pretty() {
+		t.Errorf("parseRotation() = %s -> %s, want %s -> %s", id, r.NewID, oldID, newID)
+	}
+
+	tests := []struct {
+		name      string
+		statement string
+	}{
+		{"no prefix", valid[len(rotationPrefix):]},
+		{"bad base64", rotationPrefix + "!!"},
+		{"bad json", rotationPrefix + "e30K"},
+		{"signed by other key", rotation(other, func(r *keyRotation) {})},
+		{"other old key", rotation(oldKey, func(r *keyRotation) { r.OldKey = otherPub })},
+		{"changed new id", rotation(oldKey, func(r *keyRotation) { r.NewID = oldID.Pretty() })},
+		{"changed time", rotation(oldKey, func(r *keyRotation) { r.Time++ })},
+		{"truncated signature", rotation(oldKey, func(r *keyRotation) { r.Signature = r.Signature[:10] })},
+		{"no signature", rotation(oldKey, func(r *keyRotation) { r.Signature = nil })},
+		{"invalid new id", rotation(oldKey, func(r *keyRotation) { r.NewID = "nope" })},
+		{"invalid old key", rotation(oldKey, func(r *keyRotation) { r.OldKey = []byte("nope") })},
+	}
+	for _, tt := range tests {
+		if _, _, err := parseRotation(tt.statement); err == nil {
+			t.Errorf("%s: parseRotation() accepted the statement", tt.name)
+		}
+	}
+}
+
+// TestRotateKeyFile checks that a key file is replaced by the new key once the
+// config is saved, without leaving temporary files behind.
+func TestRotateKeyFile(t *testing.T) {
+	conf, file := newTestConf(t)
+	oldID := conf.ID
+	if err := writeKeyFile(filepath.Join(filepath.Dir(file), "keys", "node.key"), []byte(conf.PrivateKey)); err != nil {
+		t.Fatal(err)
+	}
+	conf.PrivateKey = ""
+	conf.PrivateKeyFile = filepath.Join("keys", "node.key")
+	if err := writeConf(file, conf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rotateKey(newTestContext(map[string]string{"conf": file}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := readConf(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolvePrivateKey(rotated, file); err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ID == oldID {
+		t.Fatal("ID not rotated")
+	}
+	if rotated.PrivateKey != "" {
+		t.Error("new key written to the config instead of the key file")
+	}
+	key, err := crypto.UnmarshalPrivateKey([]byte(rotated.resolvedKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := peer.IDFromPrivateKey(key); id.Pretty() != rotated.ID {
+		t.Errorf("key file holds the key of %s, config has %s", id, rotated.ID)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(filepath.Dir(file), "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("%d files in the key directory, want only the key", len(files))
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// kdfArgon2id is the only key derivation function supported so far.
+const kdfArgon2id = "argon2id"
+
+// Argon2id parameters for new keys, following the RFC 9106 second
+// recommendation (64 MiB of memory).
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
+
+// Bounds of the Argon2id parameters read from a config, so that an edited or
+// corrupted file can neither weaken the key nor exhaust the machine. Memory is
+// in KiB.
+const (
+	argon2MinTime    = 1
+	argon2MaxTime    = 64
+	argon2MinMemory  = 8 * 1024
+	argon2MaxMemory  = 1024 * 1024
+	argon2MinThreads = 1
+)
+
+// EncryptedKey is a private key encrypted with a passphrase derived key. It
+// replaces Config.PrivateKey when the key is encrypted at rest.
+type EncryptedKey struct {
+	KDF     string `yaml:"kdf"`
+	Time    uint32 `yaml:"time"`
+	Memory  uint32 `yaml:"memory"`
+	Threads uint8  `yaml:"threads"`
+	// Salt, Nonce and Ciphertext are base64 encoded.
+	Salt       string `yaml:"salt"`
+	Nonce      string `yaml:"nonce"`
+	Ciphertext string `yaml:"ciphertext"`
+}
+
+// encryptKey encrypts key with XChaCha20-Poly1305 under an Argon2id key derived
+// from passphrase.
+func encryptKey(key, passphrase []byte) (*EncryptedKey, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ek := &EncryptedKey{
+		KDF:     kdfArgon2id,
+		Time:    argon2Time,
+		Memory:  argon2Memory,
+		Threads: argon2Threads,
+		Salt:    base64.StdEncoding.EncodeToString(salt),
+		Nonce:   base64.StdEncoding.EncodeToString(nonce),
+	}
+	aead, err := chacha20poly1305.NewX(ek.derive(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	ek.Ciphertext = base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, key, []byte(ek.KDF)))
+	return ek, nil
+}
+
+// Decrypt returns the private key, failing if the passphrase is wrong.
+func (ek *EncryptedKey) Decrypt(passphrase []byte) ([]byte, error) {
+	if ek.KDF != kdfArgon2id {
+		return nil, errors.Errorf("unsupported key derivation function %q", ek.KDF)
+	}
+	if err := ek.checkParams(); err != nil {
+		return nil, err
+	}
+	salt, err := base64.StdEncoding.DecodeString(ek.Salt)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode salt")
+	}
+	nonce, err := base64.StdEncoding.DecodeString(ek.Nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode nonce")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(ek.Ciphertext)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode ciphertext")
+	}
+	aead, err := chacha20poly1305.NewX(ek.derive(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+	key, err := aead.Open(nil, nonce, ciphertext, []byte(ek.KDF))
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted private key")
+	}
+	return key, nil
+}
+
+// checkParams checks the Argon2id parameters before they are used, threads 0
+// panics and a large memory value takes that much memory.
+func (ek *EncryptedKey) checkParams() error {
+	if ek.Time < argon2MinTime || ek.Time > argon2MaxTime {
+		return errors.Errorf("invalid key derivation time %d, expected %d to %d", ek.Time, argon2MinTime, argon2MaxTime)
+	}
+	if ek.Memory < argon2MinMemory || ek.Memory > argon2MaxMemory {
+		return errors.Errorf("invalid key derivation memory %d KiB, expected %d to %d KiB", ek.Memory, argon2MinMemory, argon2MaxMemory)
+	}
+	if ek.Threads < argon2MinThreads {
+		return errors.Errorf("invalid key derivation threads %d, expected at least %d", ek.Threads, argon2MinThreads)
+	}
+	return nil
+}
+
+func (ek *EncryptedKey) derive(passphrase, salt []byte) []byte {
+	return argon2.IDKey(passphrase, salt, ek.Time, ek.Memory, ek.Threads, chacha20poly1305.KeySize)
+}
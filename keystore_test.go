@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestEncryptKey(t *testing.T) {
+	key := []byte("marshaled private key")
+	ek, err := encryptKey(key, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ek.Decrypt([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Fatalf("Decrypt() = %q, want %q", got, key)
+	}
+
+	ciphertext, _ := base64.StdEncoding.DecodeString(ek.Ciphertext)
+	flipped := append([]byte(nil), ciphertext...)
+	flipped[0] ^= 1
+	tests := []struct {
+		name       string
+		change     func(ek *EncryptedKey)
+		passphrase string
+	}{
+		{"wrong passphrase", func(ek *EncryptedKey) {}, "battery staple"},
+		{"empty passphrase", func(ek *EncryptedKey) {}, ""},
+		{"truncated ciphertext", func(ek *EncryptedKey) {
+			ek.Ciphertext = base64.StdEncoding.EncodeToString(ciphertext[:len(ciphertext)-1])
+		}, "correct horse"},
+		{"short ciphertext", func(ek *EncryptedKey) {
+			ek.Ciphertext = base64.StdEncoding.EncodeToString(ciphertext[:4])
+		}, "correct horse"},
+		{"tampered ciphertext", func(ek *EncryptedKey) {
+			ek.Ciphertext = base64.StdEncoding.EncodeToString(flipped)
+		}, "correct horse"},
+		{"invalid base64", func(ek *EncryptedKey) { ek.Ciphertext = "!" }, "correct horse"},
+		{"short nonce", func(ek *EncryptedKey) { ek.Nonce = base64.StdEncoding.EncodeToString([]byte("nonce")) }, "correct horse"},
+		{"other salt", func(ek *EncryptedKey) { ek.Salt = base64.StdEncoding.EncodeToString([]byte("other salt")) }, "correct horse"},
+		{"unknown kdf", func(ek *EncryptedKey) { ek.KDF = "scrypt" }, "correct horse"},
+		{"no threads", func(ek *EncryptedKey) { ek.Threads = 0 }, "correct horse"},
+		{"no time", func(ek *EncryptedKey) { ek.Time = 0 }, "correct horse"},
+		{"too much time", func(ek *EncryptedKey) { ek.Time = argon2MaxTime + 1 }, "correct horse"},
+		{"too little memory", func(ek *EncryptedKey) { ek.Memory = argon2MinMemory - 1 }, "correct horse"},
+		{"too much memory", func(ek *EncryptedKey) { ek.Memory = argon2MaxMemory + 1 }, "correct horse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := *ek
+			tt.change(&changed)
+			if key, err := changed.Decrypt([]byte(tt.passphrase)); err == nil {
+				t.Errorf("Decrypt() = %q, want an error", key)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/p2ptunnel/p2ptunnel/pkg/httplogger"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"os"
+)
+
+// logger is the logger of the process. It logs at info level as text until
+// setupLogging applies the --log-level and --log-format flags.
+//
+// Log entries about tunnels use the fields peer, service, stream_id,
+// remote_addr, bytes and duration.
+var logger = newLogger(zapcore.InfoLevel, "text")
+
+// setupLogging replaces logger with one configured by the global flags, and sets
+// up the HTTP access log with --verbose. Nothing changes if a flag is invalid.
+func setupLogging(ctx *cli.Context) error {
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(ctx.GlobalString("log-level"))); err != nil {
+		return errors.Errorf("invalid log level %q, use debug, info, warn or error", ctx.GlobalString("log-level"))
+	}
+	format := ctx.GlobalString("log-format")
+	if format != "text" && format != "json" {
+		return errors.Errorf("invalid log format %q, use text or json", format)
+	}
+	var access httplogger.Sink
+	if ctx.GlobalBool("verbose") {
+		l, err := httplogger.NewAccessLog(os.Stdout, ctx.GlobalString("access-log-format"))
+		if err != nil {
+			return err
+		}
+		access = l
+	}
+
+	logger = newLogger(level, format)
+	if access != nil {
+		httpSinks = append(httpSinks, access)
+	}
+	return nil
+}
+
+// newLogger returns a logger writing entries of level and above to stderr, as
+// text or JSON.
+func newLogger(level zapcore.Level, format string) *zap.SugaredLogger {
+	var enc zapcore.Encoder
+	if format == "json" {
+		cfg := zap.NewProductionEncoderConfig()
+		cfg.EncodeTime = zapcore.ISO8601TimeEncoder
+		cfg.EncodeDuration = zapcore.StringDurationEncoder
+		enc = zapcore.NewJSONEncoder(cfg)
+	} else {
+		cfg := zap.NewDevelopmentEncoderConfig()
+		cfg.CallerKey = ""
+		enc = zapcore.NewConsoleEncoder(cfg)
+	}
+	core := zapcore.NewCore(enc, zapcore.Lock(os.Stderr), level)
+	return zap.New(core).Sugar()
+}
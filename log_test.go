@@ -0,0 +1,58 @@
+package main
+
+import (
+	"go.uber.org/zap/zapcore"
+	"testing"
+)
+
+func TestSetupLogging(t *testing.T) {
+	defaults := map[string]string{"log-level": "info", "log-format": "text", "access-log-format": "common"}
+	tests := []struct {
+		name    string
+		flags   map[string]string
+		level   zapcore.Level
+		sinks   int
+		wantErr bool
+	}{
+		{name: "defaults", level: zapcore.InfoLevel},
+		{name: "debug json", flags: map[string]string{"log-level": "debug", "log-format": "json"}, level: zapcore.DebugLevel},
+		{name: "upper case level", flags: map[string]string{"log-level": "WARN"}, level: zapcore.WarnLevel},
+		{name: "verbose", flags: map[string]string{"verbose": "true"}, level: zapcore.InfoLevel, sinks: 1},
+		{name: "bad level", flags: map[string]string{"log-level": "loud"}, wantErr: true},
+		{name: "empty level", flags: map[string]string{"log-level": ""}, level: zapcore.InfoLevel},
+		{name: "bad format", flags: map[string]string{"log-format": "xml"}, wantErr: true},
+		{name: "bad access log format", flags: map[string]string{"verbose": "true", "access-log-format": "xml"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldLogger, oldSinks := logger, httpSinks
+			defer func() { logger, httpSinks = oldLogger, oldSinks }()
+			httpSinks = nil
+
+			global := make(map[string]string)
+			for k, v := range defaults {
+				global[k] = v
+			}
+			for k, v := range tt.flags {
+				global[k] = v
+			}
+			err := setupLogging(newTestContext(global, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setupLogging() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if logger != oldLogger {
+					t.Error("logger replaced despite the error")
+				}
+				return
+			}
+			core := logger.Desugar().Core()
+			if !core.Enabled(tt.level) || core.Enabled(tt.level-1) {
+				t.Errorf("logger doesn't log from level %v", tt.level)
+			}
+			if len(httpSinks) != tt.sinks {
+				t.Errorf("%d HTTP sinks, want %d", len(httpSinks), tt.sinks)
+			}
+		})
+	}
+}
@@ -2,17 +2,15 @@ package main
 
 import (
 	"fmt"
-	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/p2ptunnel/p2ptunnel/pkg/httplogger"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
-	"gopkg.in/yaml.v2"
-	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"sort"
+	"time"
 )
 
 const (
@@ -21,10 +19,21 @@ const (
 	defaultConnectorPort = 8012
 )
 
-var (
-	verbose bool
-	logger  *httplogger.HTTPLogger
-)
+// httpSinks receive the HTTP requests passing through tunnels, from the access
+// log of --verbose and the capture of the connector.
+var httpSinks []httplogger.Sink
+
+// metricsFlag serves Prometheus metrics from the agent, connector and up.
+var metricsFlag = cli.StringFlag{
+	Name:  "metrics-listen",
+	Usage: "serve Prometheus metrics at /metrics on this address, e.g. :9100",
+}
+
+// jsonFlag makes the admin commands print the raw answer of the admin API.
+var jsonFlag = cli.BoolFlag{
+	Name:  "json",
+	Usage: "print JSON instead of a table",
+}
 
 func main() {
 	app := cli.NewApp()
@@ -39,9 +48,33 @@ func main() {
 		},
 		cli.BoolFlag{
 			Name:  "verbose, v",
-			Usage: "print more debug message",
+			Usage: "log the HTTP requests passing through tunnels to stdout",
+		},
+		cli.StringFlag{
+			Name:  "access-log-format",
+			Usage: "format of the HTTP access log: common or json",
+			Value: httplogger.FormatCommon,
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Usage: "log level: debug, info, warn or error",
+			Value: "info",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Usage: "log format: text or json",
+			Value: "text",
+		},
+		cli.StringFlag{
+			Name:  "socket",
+			Usage: "admin socket of the running agent, connector or up (the config path with a .sock extension by default)",
+		},
+		cli.StringFlag{
+			Name:  "passphrase-file",
+			Usage: "file holding the passphrase of an encrypted private key (or set " + passphraseEnv + ")",
 		},
 	}
+	app.Before = setupLogging
 	app.Commands = []cli.Command{
 		{
 			Name:      "init",
@@ -49,6 +82,60 @@ func main() {
 			ArgsUsage: "[name]",
 			Aliases:   []string{"i"},
 			Action:    initConf,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "encrypt",
+					Usage: "encrypt the private key with a passphrase",
+				},
+				cli.StringFlag{
+					Name:  "key-type",
+					Usage: "type of the private key: ed25519, rsa or ecdsa",
+					Value: defaultKeyType,
+				},
+				cli.StringFlag{
+					Name:  "key-file",
+					Usage: "write the private key to this file instead of the config, relative to the config",
+				},
+			},
+		},
+		{
+			Name:   "export-config",
+			Usage:  "print the config, with --redact leaving out the secrets so it can be shared",
+			Action: exportConfig,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "redact",
+					Usage: "leave out the private key and pending invites",
+				},
+			},
+		},
+		{
+			Name:   "rotate-key",
+			Usage:  "replace the private key and print a statement for peers to follow",
+			Action: rotateKey,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key-type",
+					Usage: "type of the new private key: ed25519, rsa or ecdsa (same as the old one by default)",
+				},
+			},
+		},
+		{
+			Name:      "accept-rotation",
+			Usage:     "update a peer's ID from its key rotation statement",
+			ArgsUsage: "[statement]",
+			Action:    acceptRotation,
+		},
+		{
+			Name:   "encrypt-key",
+			Usage:  "encrypt the private key with a passphrase, or change the passphrase",
+			Action: encryptKeyCmd,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "new-passphrase-file",
+					Usage: "file holding the new passphrase when changing it (or set " + newPassphraseEnv + ")",
+				},
+			},
 		},
 		{
 			Name:      "add",
@@ -64,22 +151,322 @@ func main() {
 			Aliases:   []string{"a"},
 			Action:    removePeer,
 		},
+		{
+			Name:      "grant",
+			Usage:     "grant peer access, optionally for a limited time",
+			ArgsUsage: "[peer name] [peer id]",
+			Action:    grantPeer,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "for",
+					Usage: "duration of the access, e.g. 24h (unlimited by default)",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "RFC 3339 time the access starts (now by default)",
+				},
+			},
+		},
+		{
+			Name:      "revoke",
+			Usage:     "revoke the access of a peer",
+			ArgsUsage: "[peer name]",
+			Action:    revokePeer,
+		},
+		{
+			Name:      "invite",
+			Usage:     "create a one-time token for a peer to pair with this agent",
+			ArgsUsage: "[peer name]",
+			Action:    invite,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "for",
+					Usage: "validity of the token",
+					Value: defaultInviteTTL,
+				},
+				cli.StringSliceFlag{
+					Name:  "addr",
+					Usage: "multiaddr the agent is reachable at, looked up in the DHT if absent",
+				},
+			},
+		},
+		{
+			Name:      "join",
+			Usage:     "pair with the agent which created the invite token",
+			ArgsUsage: "[token]",
+			Action:    join,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "name",
+					Usage: "peer name for the agent (the agent's own name by default)",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "give up pairing after this long",
+					Value: 2 * pairTimeout,
+				},
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "check or upgrade the config file",
+			Subcommands: []cli.Command{
+				{
+					Name:   "validate",
+					Usage:  "check peer IDs, addresses, services and access lists",
+					Action: validateConf,
+				},
+				{
+					Name:   "migrate",
+					Usage:  "upgrade the config file to the current version",
+					Action: migrateConfCmd,
+				},
+			},
+		},
 		{
 			Name:      "agent",
 			Usage:     "start p2p tunnel agent service",
 			Action:    agent,
 			ArgsUsage: "[forward port]",
+			Flags: []cli.Flag{
+				metricsFlag,
+				recordFlag,
+				recordSizeFlag,
+				recordFilesFlag,
+				cli.BoolFlag{
+					Name:  "watch, w",
+					Usage: "reload config when the file changes (SIGHUP always reloads)",
+				},
+			},
+		},
+		{
+			Name:   "up",
+			Usage:  "run every service and forward of the config in one node",
+			Action: up,
+			Flags: []cli.Flag{
+				metricsFlag,
+				recordFlag,
+				recordSizeFlag,
+				recordFilesFlag,
+				cli.UintFlag{
+					Name:  "port, p",
+					Usage: "libp2p listening port (random by default)",
+				},
+				cli.BoolFlag{
+					Name:  "watch, w",
+					Usage: "reload config when the file changes (SIGHUP always reloads)",
+				},
+			},
+		},
+		{
+			Name:   "status",
+			Usage:  "show the status of the running agent, connector or up",
+			Action: statusCmd,
+			Flags:  []cli.Flag{jsonFlag},
+		},
+		{
+			Name:   "peers",
+			Usage:  "list the peers of the running agent, connector or up",
+			Action: peersCmd,
+			Flags:  []cli.Flag{jsonFlag},
+		},
+		{
+			Name:   "tunnels",
+			Usage:  "list the open tunnels of the running agent, connector or up",
+			Action: tunnelsCmd,
+			Flags:  []cli.Flag{jsonFlag},
 		},
 		{
 			Name:   "connector",
 			Usage:  "start p2p tunnel connector service",
 			Action: connector,
 			Flags: []cli.Flag{
+				metricsFlag,
+				recordFlag,
+				recordSizeFlag,
+				recordFilesFlag,
 				cli.UintFlag{
 					Name:  "port, p",
 					Usage: "connector's listening port",
 					Value: defaultConnectorPort,
 				},
+				cli.StringFlag{
+					Name:  "service, s",
+					Usage: "name of the agent's service to connect to",
+					Value: defaultService,
+				},
+				cli.StringFlag{
+					Name:  "dest, d",
+					Usage: "destination address for proxy services, e.g. web.lan:80",
+				},
+				cli.StringFlag{
+					Name:  "capture",
+					Usage: "record the HTTP requests and responses to this HAR file",
+				},
+				cli.IntFlag{
+					Name:  "capture-body-limit",
+					Usage: "capture at most this many bytes of each body",
+					Value: 64 << 10,
+				},
+				cli.StringSliceFlag{
+					Name:  "capture-redact",
+					Usage: "also redact this header in the capture, besides Authorization, cookies and API keys",
+				},
+			},
+		},
+		{
+			Name:      "dump",
+			Usage:     "print recordings of tunnels made with --record",
+			ArgsUsage: "[file...]",
+			Action:    dump,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "text",
+					Usage: "print the bytes as text instead of a hex dump",
+				},
+				cli.Uint64Flag{
+					Name:  "stream",
+					Usage: "only print the stream with this number",
+				},
+				cli.StringFlag{
+					Name:  "peer",
+					Usage: "only print the streams of this peer",
+				},
+				cli.StringFlag{
+					Name:  "service, s",
+					Usage: "only print the streams of this service",
+				},
+			},
+		},
+		{
+			Name:      "bench",
+			Usage:     "measure the latency and throughput of tunnels to a peer",
+			ArgsUsage: "[peer name]",
+			Action:    bench,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "count",
+					Usage: "round trips measuring the latency",
+					Value: 100,
+				},
+				cli.Int64Flag{
+					Name:  "size",
+					Usage: "MiB sent by each throughput benchmark",
+					Value: 64,
+				},
+				cli.IntFlag{
+					Name:  "streams",
+					Usage: "tunnels sending at the same time in the multi-stream benchmark",
+					Value: 8,
+				},
+				cli.IntFlag{
+					Name:  "opens",
+					Usage: "tunnels opened measuring the stream-open rate",
+					Value: 100,
+				},
+				cli.StringFlag{
+					Name:  "relay",
+					Usage: "reach the peer only through the relay at this multiaddr, ending with /p2p/<relay ID>",
+				},
+				cli.StringFlag{
+					Name:  "json",
+					Usage: "write the results to this JSON file",
+				},
+			},
+		},
+		{
+			Name:      "ping",
+			Usage:     "measure the round-trip time to a peer and show how it is reached",
+			ArgsUsage: "[peer name]",
+			Action:    ping,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "count",
+					Usage: "number of pings",
+					Value: 4,
+				},
+				cli.DurationFlag{
+					Name:  "interval",
+					Usage: "time between pings",
+					Value: time.Second,
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "give up finding and connecting to the peer after this long",
+					Value: time.Minute,
+				},
+				cli.StringFlag{
+					Name:  "service, s",
+					Usage: "also time opening a tunnel to this service",
+				},
+				cli.DurationFlag{
+					Name:  "nat-wait",
+					Usage: "wait this long for AutoNAT to find out whether we are reachable",
+					Value: 5 * time.Second,
+				},
+				cli.BoolFlag{
+					Name:  "trace",
+					Usage: "show each discovery and dial step",
+				},
+			},
+		},
+		{
+			Name:      "send",
+			Usage:     "send files and directories to the receive directory of a peer",
+			ArgsUsage: "<peer name> <path...>",
+			Description: "Files are checked with SHA-256 once received. Interrupted transfers resume\n" +
+				"   where they stopped when the same files are sent again.",
+			Action: send,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "give up finding and connecting to the peer after this long",
+					Value: time.Minute,
+				},
+				cli.BoolFlag{
+					Name:  "quiet, q",
+					Usage: "don't show the progress of each file",
+				},
+			},
+		},
+		{
+			Name:      "nc",
+			Usage:     "tunnel stdin and stdout to a service of a peer, e.g. as an SSH ProxyCommand",
+			ArgsUsage: "<peer name> <service>",
+			Description: "Exits with 2 if the peer can't be reached and 3 if its agent refuses the tunnel.\n" +
+				"   Logs go to stderr, e.g. ssh -o ProxyCommand='p2ptunnel --log-level warn nc home ssh' home",
+			Action: nc,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "dest, d",
+					Usage: "destination address for proxy services, e.g. web.lan:80",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "give up opening the tunnel after this long",
+					Value: time.Minute,
+				},
+			},
+		},
+		{
+			Name:      "replay",
+			Usage:     "re-issue the requests of a HAR capture through a tunnel and diff the responses",
+			ArgsUsage: "[file.har]",
+			Action:    replay,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "peer",
+					Usage: "name of the peer to send the requests to",
+				},
+				cli.StringFlag{
+					Name:  "service, s",
+					Usage: "service to send the requests to (the captured service by default)",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "give up on a request after this long",
+					Value: 30 * time.Second,
+				},
 			},
 		},
 	}
@@ -87,7 +474,7 @@ func main() {
 	sort.Sort(cli.CommandsByName(app.Commands))
 
 	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
 }
 
@@ -95,39 +482,56 @@ func initConf(ctx *cli.Context) error {
 	if len(ctx.Args()) != 1 {
 		return errors.New("Please provide one user friendly name for the agent or connector")
 	}
-	// Create New Libp2p Node
-	host, err := libp2p.New()
+	// Generate the node's private key.
+	key, err := generateKey(ctx.String("key-type"))
 	if err != nil {
 		return err
 	}
-
-	// Get Node's Private Key
-	keyBytes, err := crypto.MarshalPrivateKey(host.Peerstore().PrivKey(host.ID()))
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyBytes, err := crypto.MarshalPrivateKey(key)
 	if err != nil {
 		return err
 	}
 
 	// Setup an initial default command.
 	conf := &Config{
+		Version:    configVersion,
 		Name:       ctx.Args()[0],
-		ID:         host.ID().Pretty(),
+		ID:         id.Pretty(),
 		PrivateKey: string(keyBytes),
 	}
 
 	configFile := ctx.GlobalString("conf")
-	err = os.MkdirAll(filepath.Dir(configFile), os.ModePerm)
+	if keyFile := ctx.String("key-file"); keyFile != "" {
+		if ctx.Bool("encrypt") {
+			return errors.New("Encrypting a separate key file isn't supported")
+		}
+		conf.PrivateKeyFile = keyFile
+		conf.PrivateKey = ""
+		if err := writeKeyFile(conf.keyFilePath(configFile), keyBytes); err != nil {
+			return err
+		}
+	}
+	if ctx.Bool("encrypt") {
+		if err := encryptConfKey(ctx, conf); err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(configFile), 0700)
 	if err != nil {
 		return err
 	}
 
-	f, err := os.Create(configFile)
+	// Write out config to file, readable by the owner only as it holds the key.
+	err = writeConf(configFile, conf)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	// Write out config to file.
-	err = yaml.NewEncoder(f).Encode(conf)
+	err = os.Chmod(configFile, 0600)
 	if err != nil {
 		return err
 	}
@@ -143,31 +547,18 @@ func addPeer(ctx *cli.Context) error {
 		return errors.New("Please provide both peer name and peer ID")
 	}
 
-	conf := &Config{}
 	configFile := ctx.GlobalString("conf")
-	f, err := os.OpenFile(configFile, os.O_RDWR, 0755)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	err = yaml.NewDecoder(f).Decode(conf)
-	if err != nil {
-		return err
-	}
-
-	p, ok := conf.Peers[ctx.Args()[0]]
-	if ok {
-		return errors.Errorf("Peer %s has been added with ID %s", ctx.Args()[0], p.ID)
-	}
-	conf.Peers[ctx.Args()[0]] = Peer{ID: ctx.Args()[1]}
-
-	// Write out config to file.
-	_, err = f.Seek(0, io.SeekStart)
-	if err != nil {
-		return err
-	}
-	err = yaml.NewEncoder(f).Encode(conf)
+	_, err := updateConf(configFile, func(conf *Config) error {
+		p, ok := conf.Peers[ctx.Args()[0]]
+		if ok {
+			return errors.Errorf("Peer %s has been added with ID %s", ctx.Args()[0], p.ID)
+		}
+		if conf.isRevoked(ctx.Args()[1]) {
+			return errors.Errorf("Peer ID %s has been revoked, use grant to allow it again", ctx.Args()[1])
+		}
+		conf.Peers[ctx.Args()[0]] = Peer{ID: ctx.Args()[1]}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -182,29 +573,17 @@ func removePeer(ctx *cli.Context) error {
 	}
 
 	configFile := ctx.GlobalString("conf")
-	conf, err := readConf(configFile)
-	if err != nil {
-		return err
-	}
-
-	p, ok := conf.Peers[ctx.Args()[0]]
-	if !ok {
-		return errors.Errorf("Peer %s is not in config file %s", ctx.Args()[0], configFile)
-	}
-	if p.ID != ctx.Args()[1] {
-		return errors.Errorf("To-be-removed Peer ID %s is different from input %s", p.ID, ctx.Args()[1])
-	}
-
-	delete(conf.Peers, ctx.Args()[0])
-
-	f, err := os.OpenFile(configFile, os.O_WRONLY|os.O_TRUNC, 0755)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	// Write out config to file.
-	err = yaml.NewEncoder(f).Encode(conf)
+	_, err := updateConf(configFile, func(conf *Config) error {
+		p, ok := conf.Peers[ctx.Args()[0]]
+		if !ok {
+			return errors.Errorf("Peer %s is not in config file %s", ctx.Args()[0], configFile)
+		}
+		if p.ID != ctx.Args()[1] {
+			return errors.Errorf("To-be-removed Peer ID %s is different from input %s", p.ID, ctx.Args()[1])
+		}
+		delete(conf.Peers, ctx.Args()[0])
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/metrics"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// bandwidth counts the traffic of all libp2p transports of the node.
+var bandwidth = metrics.NewBandwidthCounter()
+
+// The connection gauges are registered once and count the connections of the
+// node metrics were last served for.
+var (
+	registerConns sync.Once
+	connsLock     sync.Mutex
+	connsNode     host.Host
+)
+
+var (
+	streamsOpened = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "p2ptunnel_streams_opened_total",
+		Help: "Tunnel streams opened to agents.",
+	}, []string{"peer", "service"})
+	streamsAccepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "p2ptunnel_streams_accepted_total",
+		Help: "Tunnel streams of peers accepted by the agent.",
+	}, []string{"peer", "service"})
+	streamsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "p2ptunnel_streams_rejected_total",
+		Help: "Tunnel streams of peers refused by the agent. The peer is empty for unknown peers.",
+	}, []string{"peer", "service"})
+	tunnelBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "p2ptunnel_tunnel_bytes_total",
+		Help: "Bytes passed through tunnels, received from (in) or sent to (out) the peer.",
+	}, []string{"peer", "service", "direction"})
+	dialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "p2ptunnel_dial_duration_seconds",
+		Help:    "Time to open a tunnel to the agent, including the handshake.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"peer"})
+	firstByteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "p2ptunnel_local_first_byte_seconds",
+		Help:    "Time from forwarding a request to the local service until its first reply byte.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"service"})
+	reconnectAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "p2ptunnel_reconnect_attempts_total",
+		Help: "Attempts to reach an agent again after dialing it failed.",
+	}, []string{"peer"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		streamsOpened,
+		streamsAccepted,
+		streamsRejected,
+		tunnelBytes,
+		dialDuration,
+		firstByteDuration,
+		reconnectAttempts,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "p2ptunnel_transport_bytes_total",
+			Help:        "Bytes sent and received by the libp2p transports, including protocol overhead.",
+			ConstLabels: prometheus.Labels{"direction": "in"},
+		}, func() float64 { return float64(bandwidth.GetBandwidthTotals().TotalIn) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "p2ptunnel_transport_bytes_total",
+			Help:        "Bytes sent and received by the libp2p transports, including protocol overhead.",
+			ConstLabels: prometheus.Labels{"direction": "out"},
+		}, func() float64 { return float64(bandwidth.GetBandwidthTotals().TotalOut) }),
+	)
+}
+
+// serveMetrics serves the Prometheus metrics at /metrics on addr until ctx is
+// done. Nothing is served if addr is empty.
+func serveMetrics(ctx context.Context, addr string, node host.Host) error {
+	if addr == "" {
+		return nil
+	}
+	connsLock.Lock()
+	connsNode = node
+	connsLock.Unlock()
+	registerConns.Do(func() {
+		for _, kind := range []string{"direct", "relay"} {
+			relayed := kind == "relay"
+			prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "p2ptunnel_connections",
+				Help:        "Open libp2p connections, direct or through a relay.",
+				ConstLabels: prometheus.Labels{"kind": kind},
+			}, func() float64 {
+				connsLock.Lock()
+				node := connsNode
+				connsLock.Unlock()
+				return float64(countConns(node, relayed))
+			}))
+		}
+	})
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			logger.Errorw("metrics", "error", err)
+		}
+	}()
+	logger.Infow("serving metrics", "url", "http://"+l.Addr().String()+"/metrics")
+	return nil
+}
+
+// countConns counts the connections of node which are relayed, or direct.
+func countConns(node host.Host, relayed bool) int {
+	n := 0
+	for _, c := range node.Network().Conns() {
+		_, err := c.RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT)
+		if (err == nil) == relayed {
+			n++
+		}
+	}
+	return n
+}
+
+// serviceLabel returns the metrics label of the service a peer asked for:
+// its name if it is configured or built in, otherwise "unknown", so peers
+// can't add label values at will.
+func (c *Config) serviceLabel(service string) string {
+	if _, ok := c.Services[service]; ok {
+		return service
+	}
+	if _, ok := builtinServices[service]; ok {
+		return service
+	}
+	return "unknown"
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+	"testing"
+)
+
+// gaugeValue returns the value of the gauge name with the label value given,
+// and whether it is registered.
+func gaugeValue(t *testing.T, name, label, value string) (float64, bool) {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == label && l.GetValue() == value {
+					return m.GetGauge().GetValue(), true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+func TestServeMetricsTwice(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first, second := newTestHost(t, newTestKey(t)), newTestHost(t, newTestKey(t))
+	if err := serveMetrics(ctx, "127.0.0.1:0", first); err != nil {
+		t.Fatal(err)
+	}
+	// A second run, e.g. of the same process embedding p2ptunnel, must not
+	// panic on the gauges registered already.
+	if err := serveMetrics(ctx, "127.0.0.1:0", second); err != nil {
+		t.Fatal(err)
+	}
+	other := newTestHost(t, newTestKey(t))
+	if err := second.Connect(ctx, peer.AddrInfo{ID: other.ID(), Addrs: other.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := gaugeValue(t, "p2ptunnel_connections", "kind", "direct"); !ok || n != 1 {
+		t.Errorf("direct connections = %v, %v, want those of the last node", n, ok)
+	}
+	if n, ok := gaugeValue(t, "p2ptunnel_connections", "kind", "relay"); !ok || n != 0 {
+		t.Errorf("relayed connections = %v, %v, want 0", n, ok)
+	}
+}
+
+func TestServiceLabel(t *testing.T) {
+	conf := &Config{Services: map[string]Service{"ssh": {Addr: "localhost:22"}}}
+	tests := []struct {
+		service, want string
+	}{
+		{"ssh", "ssh"},
+		{echoService, echoService},
+		{"web", "unknown"},
+		{"", "unknown"},
+		{"@other", "unknown"},
+	}
+	for _, tt := range tests {
+		if got := conf.serviceLabel(tt.service); got != tt.want {
+			t.Errorf("serviceLabel(%q) = %q, want %q", tt.service, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+	"github.com/p2ptunnel/p2ptunnel/pkg/tunnel"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Exit codes of nc, besides 1 for other errors, telling scripts why no tunnel
+// was opened.
+const (
+	exitUnreachable = 2
+	exitRefused     = 3
+)
+
+// nc tunnels stdin and stdout to a service of a peer, for use as an SSH
+// ProxyCommand.
+func nc(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return errors.New("Please provide the name of the peer and the service")
+	}
+	name := ctx.Args()[0]
+	req := tunnel.Request{Service: ctx.Args()[1], Dest: ctx.String("dest")}
+
+	cctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node, dht, peers, err := newClientNode(cctx, ctx)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+	id, ok := peers[name]
+	if !ok {
+		return errors.Errorf("Peer %s is not in the config", name)
+	}
+	return netcat(cctx, node, dht, name, id, req, ctx.Duration("timeout"), os.Stdin, os.Stdout)
+}
+
+// netcat tunnels in and out to the peer id called name with req, giving up
+// opening the tunnel after timeout. It returns a cli.ExitCoder with
+// exitUnreachable or exitRefused if the tunnel couldn't be opened.
+func netcat(ctx context.Context, node host.Host, r routing.PeerRouting, name string, id peer.ID, req tunnel.Request, timeout time.Duration, in io.Reader, out io.WriteCloser) error {
+	dctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := connectPeer(dctx, node, r, id, &tracer{}); err != nil {
+		return cli.NewExitError(errors.Wrapf(err, "Peer %s is unreachable", name), exitUnreachable)
+	}
+	stream, err := openTunnel(dctx, node, name, id, req)
+	if refused, ok := err.(*tunnel.RefusedError); ok {
+		return cli.NewExitError(errors.Errorf("Peer %s refused %s: %s", name, req.Service, refused.Reason), exitRefused)
+	} else if err != nil {
+		return cli.NewExitError(errors.Wrapf(err, "Peer %s is unreachable", name), exitUnreachable)
+	}
+	return pipe(stream, newStdio(in, out), nil, nil)
+}
+
+// stdio is the local side of nc. Reads of in happen in the background so
+// that closing it stops a read blocked on an open stdin.
+type stdio struct {
+	out    io.WriteCloser
+	reads  chan stdioRead
+	data   []byte
+	err    error
+	closed chan struct{}
+	once   sync.Once
+}
+
+type stdioRead struct {
+	data []byte
+	err  error
+}
+
+func newStdio(in io.Reader, out io.WriteCloser) *stdio {
+	s := &stdio{out: out, reads: make(chan stdioRead), closed: make(chan struct{})}
+	go func() {
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := in.Read(buf)
+			select {
+			case s.reads <- stdioRead{buf[:n], err}:
+			case <-s.closed:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *stdio) Read(b []byte) (int, error) {
+	if len(s.data) == 0 && s.err == nil {
+		select {
+		case r := <-s.reads:
+			s.data, s.err = r.data, r.err
+		case <-s.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	n := copy(b, s.data)
+	s.data = s.data[n:]
+	if len(s.data) == 0 && s.err != nil {
+		return n, s.err
+	}
+	return n, nil
+}
+
+func (s *stdio) Write(b []byte) (int, error) {
+	return s.out.Write(b)
+}
+
+// CloseWrite closes out, telling the program reading it that the tunnel
+// ended.
+func (s *stdio) CloseWrite() error {
+	return s.out.Close()
+}
+
+func (s *stdio) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.closed)
+		err = s.out.Close()
+	})
+	return err
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/p2ptunnel/p2ptunnel/pkg/tunnel"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"strings"
+	"time"
+)
+
+// PairProtocol is the protocol used by join to exchange peer entries with an
+// agent that handed out an invite token.
+const PairProtocol = "/p2ptunnel/pair/0.0.1"
+
+const (
+	// tokenPrefix marks invite tokens and their format version.
+	tokenPrefix = "p2pt1:"
+	// defaultInviteTTL is how long an invite token stays valid.
+	defaultInviteTTL = time.Hour
+	// pairTimeout bounds a whole pairing exchange.
+	pairTimeout = time.Minute
+)
+
+// Invite is a pending invitation created by `p2ptunnel invite`.
+type Invite struct {
+	// Secret is the hex encoded secret the joining peer has to prove.
+	Secret string `yaml:"secret"`
+	// Name is the peer name given to the joining peer, its own name if empty.
+	Name    string    `yaml:"name,omitempty"`
+	Expires time.Time `yaml:"expires"`
+}
+
+// inviteToken is the content of the token printed by `p2ptunnel invite`.
+type inviteToken struct {
+	Name    string   `json:"n"`
+	ID      string   `json:"id"`
+	Addrs   []string `json:"a,omitempty"`
+	Secret  string   `json:"s"`
+	Expires int64    `json:"e"`
+}
+
+func (t *inviteToken) String() string {
+	data, _ := json.Marshal(t)
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseInviteToken(s string) (*inviteToken, error) {
+	if !strings.HasPrefix(s, tokenPrefix) {
+		return nil, errors.New("not a p2ptunnel invite token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, tokenPrefix))
+	if err != nil {
+		return nil, errors.Wrap(err, "decode invite token")
+	}
+	t := &inviteToken{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, errors.Wrap(err, "decode invite token")
+	}
+	return t, nil
+}
+
+// pairProof is the proof of knowing an invite secret, bound to both peers of
+// the exchange and to the nonce picked by the agent.
+func pairProof(secret, nonce []byte, joiner, agent peer.ID) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	mac.Write([]byte(joiner))
+	mac.Write([]byte(agent))
+	return mac.Sum(nil)
+}
+
+func invite(ctx *cli.Context) error {
+	if len(ctx.Args()) > 1 {
+		return errors.New("Please provide at most one peer name")
+	}
+	var addrs []string
+	for _, a := range ctx.StringSlice("addr") {
+		if _, err := ma.NewMultiaddr(a); err != nil {
+			return errors.Wrapf(err, "invalid address %s", a)
+		}
+		addrs = append(addrs, a)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	inv := Invite{
+		Secret:  hex.EncodeToString(secret),
+		Expires: time.Now().Add(ctx.Duration("for")).Truncate(time.Second),
+	}
+	if len(ctx.Args()) == 1 {
+		inv.Name = ctx.Args()[0]
+	}
+
+	configFile := ctx.GlobalString("conf")
+	conf, err := updateConf(configFile, func(conf *Config) error {
+		// Drop expired invites while at it.
+		now := time.Now()
+		invites := []Invite{inv}
+		for _, i := range conf.Invites {
+			if now.Before(i.Expires) {
+				invites = append(invites, i)
+			}
+		}
+		conf.Invites = invites
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	token := &inviteToken{
+		Name:    conf.Name,
+		ID:      conf.ID,
+		Addrs:   addrs,
+		Secret:  inv.Secret,
+		Expires: inv.Expires.Unix(),
+	}
+	fmt.Printf("Invite created, valid until %s. On the other device run:\n\n", inv.Expires.Format(time.RFC3339))
+	fmt.Printf("  p2ptunnel join %s\n\n", token)
+	fmt.Println("The agent has to be running for the other device to join.")
+	return nil
+}
+
+// pairHandler returns the agent side of PairProtocol. A joining peer proving
+// the secret of a pending invite is added to the peers of configFile, and the
+// invite is consumed.
+func (a *agentServer) pairHandler(configFile string) network.StreamHandler {
+	return func(stream network.Stream) {
+		defer stream.Close()
+		if err := stream.SetDeadline(time.Now().Add(pairTimeout)); err != nil {
+			logger.Debugw("pair: set deadline", "error", err)
+			return
+		}
+		remote := stream.Conn().RemotePeer()
+
+		joinerName, err := tunnel.ReadFrame(stream)
+		if err != nil {
+			return
+		}
+		nonce := make([]byte, 32)
+		if _, err := rand.Read(nonce); err != nil {
+			return
+		}
+		if err := tunnel.WriteFrame(stream, nonce); err != nil {
+			return
+		}
+		proof, err := tunnel.ReadFrame(stream)
+		if err != nil {
+			return
+		}
+
+		name, err := a.acceptInvite(configFile, remote, string(joinerName), nonce, proof)
+		if err != nil {
+			logger.Warnw("pairing refused", "peer_id", remote.Pretty(), "error", err)
+			if err := tunnel.WriteResponse(stream, err.Error()); err != nil {
+				logger.Debugw("pair: send refusal", "error", err)
+			}
+			return
+		}
+		logger.Infow("paired", "peer", name, "peer_id", remote.Pretty())
+		if err := tunnel.WriteResponse(stream, ""); err != nil {
+			logger.Debugw("pair: send acceptance", "error", err)
+		}
+	}
+}
+
+// acceptInvite checks proof against the pending invites and adds the remote
+// peer to the config. It returns the name the peer was added under.
+func (a *agentServer) acceptInvite(configFile string, remote peer.ID, joinerName string, nonce, proof []byte) (string, error) {
+	var name string
+	conf, err := updateConf(configFile, func(conf *Config) error {
+		now := time.Now()
+		match := -1
+		for i, inv := range conf.Invites {
+			secret, err := hex.DecodeString(inv.Secret)
+			if err != nil || !now.Before(inv.Expires) {
+				continue
+			}
+			if hmac.Equal(proof, pairProof(secret, nonce, remote, a.node.ID())) {
+				match = i
+				break
+			}
+		}
+		if match < 0 {
+			return errors.New("invalid or expired invite")
+		}
+		if conf.isRevoked(remote.Pretty()) {
+			return errors.New("peer has been revoked")
+		}
+
+		name = conf.Invites[match].Name
+		if name == "" {
+			name = joinerName
+		}
+		if name == "" {
+			return errors.New("missing peer name")
+		}
+		// The name is chosen by the joining peer unless the invite sets it.
+		if !serviceName.MatchString(name) {
+			return errors.Errorf("invalid peer name %q", name)
+		}
+		if p, ok := conf.Peers[name]; ok && p.ID != remote.Pretty() {
+			return errors.Errorf("peer name %s is already in use", name)
+		}
+
+		conf.Invites = append(conf.Invites[:match], conf.Invites[match+1:]...)
+		if conf.Peers == nil {
+			conf.Peers = make(map[string]Peer)
+		}
+		conf.Peers[name] = Peer{ID: remote.Pretty()}
+		// Line numbers of the file read would be misleading now.
+		conf.raw = nil
+		return conf.check()
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := a.reload(conf); err != nil {
+		return "", errors.Wrap(err, "apply config")
+	}
+	return name, nil
+}
+
+func join(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.New("Please provide the invite token")
+	}
+	token, err := parseInviteToken(ctx.Args()[0])
+	if err != nil {
+		return err
+	}
+	if time.Now().After(time.Unix(token.Expires, 0)) {
+		return errors.New("The invite token has expired")
+	}
+	secret, err := hex.DecodeString(token.Secret)
+	if err != nil {
+		return errors.Wrap(err, "decode invite secret")
+	}
+	agentPeer, err := peer.Decode(token.ID)
+	if err != nil {
+		return errors.Wrap(err, "decode agent ID")
+	}
+
+	configFile := ctx.GlobalString("conf")
+	conf, err := readConf(configFile)
+	if err != nil {
+		return err
+	}
+	name := ctx.String("name")
+	if name == "" {
+		name = token.Name
+	}
+	if p, ok := conf.Peers[name]; ok && p.ID != token.ID {
+		return errors.Errorf("Peer %s has been added with ID %s", name, p.ID)
+	}
+
+	key, err := loadPrivateKey(ctx, conf)
+	if err != nil {
+		return err
+	}
+
+	cctx, cancel := context.WithTimeout(context.Background(), ctx.Duration("timeout"))
+	defer cancel()
+
+	logger.Info("creating libp2p node")
+	node, dht, err := CreateNode(cctx, key, 0, func(s network.Stream) {
+		if err := s.Reset(); err != nil {
+			logger.Debugw("reset stream", "error", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	for _, a := range token.Addrs {
+		addr, err := ma.NewMultiaddr(a)
+		if err != nil {
+			return errors.Wrapf(err, "invalid address %s", a)
+		}
+		node.Peerstore().AddAddr(agentPeer, addr, time.Until(time.Unix(token.Expires, 0)))
+	}
+	if len(token.Addrs) == 0 {
+		logger.Infow("looking up agent", "peer_id", token.ID)
+		info, err := dht.FindPeer(cctx, agentPeer)
+		if err != nil {
+			return errors.Wrap(err, "find agent")
+		}
+		node.Peerstore().AddAddrs(agentPeer, info.Addrs, pairTimeout)
+	}
+
+	stream, err := node.NewStream(cctx, agentPeer, PairProtocol)
+	if err != nil {
+		return errors.Wrap(err, "connect to agent")
+	}
+	defer stream.Close()
+	if deadline, ok := cctx.Deadline(); ok {
+		if err := stream.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	if err := tunnel.WriteFrame(stream, []byte(conf.Name)); err != nil {
+		return err
+	}
+	nonce, err := tunnel.ReadFrame(stream)
+	if err != nil {
+		return errors.Wrap(err, "read challenge")
+	}
+	if err := tunnel.WriteFrame(stream, pairProof(secret, nonce, node.ID(), agentPeer)); err != nil {
+		return err
+	}
+	if err := tunnel.ReadResponse(stream); err != nil {
+		return err
+	}
+
+	_, err = updateConf(configFile, func(conf *Config) error {
+		if p, ok := conf.Peers[name]; ok && p.ID != token.ID {
+			return errors.Errorf("Peer %s has been added with ID %s", name, p.ID)
+		}
+		conf.Peers[name] = Peer{ID: token.ID}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s - %s has been saved in config file: %s\n", name, token.ID, configFile)
+	return nil
+}
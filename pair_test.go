@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"testing"
+	"time"
+)
+
+func TestPairProof(t *testing.T) {
+	secret, nonce := []byte("secret"), []byte("nonce")
+	joiner, agent := peer.ID("joiner"), peer.ID("agent")
+	proof := pairProof(secret, nonce, joiner, agent)
+	if !bytes.Equal(proof, pairProof(secret, nonce, joiner, agent)) {
+		t.Fatal("proof isn't deterministic")
+	}
+	tests := []struct {
+		name          string
+		secret, nonce []byte
+		joiner, agent peer.ID
+	}{
+		{"secret", []byte("other"), nonce, joiner, agent},
+		{"nonce", secret, []byte("other"), joiner, agent},
+		{"joiner", secret, nonce, "other", agent},
+		{"agent", secret, nonce, joiner, "other"},
+		{"swapped peers", secret, nonce, agent, joiner},
+	}
+	for _, tt := range tests {
+		if bytes.Equal(proof, pairProof(tt.secret, tt.nonce, tt.joiner, tt.agent)) {
+			t.Errorf("proof doesn't depend on the %s", tt.name)
+		}
+	}
+}
+
+func TestAcceptInvite(t *testing.T) {
+	node := newTestHost(t, newTestKey(t))
+	joiner := newTestHost(t, newTestKey(t)).ID()
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	nonce := []byte("nonce")
+	proof := pairProof(secret, nonce, joiner, node.ID())
+	valid := Invite{Secret: hex.EncodeToString(secret), Expires: time.Now().Add(time.Hour)}
+	expired := Invite{Secret: valid.Secret, Expires: time.Now().Add(-time.Second)}
+	named := Invite{Secret: valid.Secret, Name: "ci", Expires: valid.Expires}
+	other := Invite{Secret: hex.EncodeToString([]byte("another secret")), Expires: valid.Expires}
+
+	tests := []struct {
+		name       string
+		invites    []Invite
+		joinerName string
+		peers      map[string]Peer
+		revoked    []string
+		joiner     peer.ID
+		proof      []byte
+		want       string
+		wantErr    bool
+	}{
+		{name: "valid", invites: []Invite{valid}, joiner: joiner, proof: proof, want: "laptop"},
+		{name: "second invite", invites: []Invite{other, valid}, joiner: joiner, proof: proof, want: "laptop"},
+		{name: "named invite", invites: []Invite{named}, joiner: joiner, proof: proof, want: "ci"},
+		{name: "expired", invites: []Invite{expired}, joiner: joiner, proof: proof, wantErr: true},
+		{name: "no invites", joiner: joiner, proof: proof, wantErr: true},
+		{name: "wrong proof", invites: []Invite{other}, joiner: joiner, proof: proof, wantErr: true},
+		{name: "proof of other peer", invites: []Invite{valid}, joiner: node.ID(), proof: proof, wantErr: true},
+		{name: "revoked", invites: []Invite{valid}, revoked: []string{joiner.Pretty()}, joiner: joiner, proof: proof, wantErr: true},
+		{name: "name in use", invites: []Invite{valid}, peers: map[string]Peer{"laptop": {ID: node.ID().Pretty()}},
+			joiner: joiner, proof: proof, wantErr: true},
+		{name: "id under another name", invites: []Invite{valid}, peers: map[string]Peer{"desk": {ID: joiner.Pretty()}},
+			joiner: joiner, proof: proof, wantErr: true},
+		{name: "invalid name", invites: []Invite{valid}, joinerName: "lap top: {}", joiner: joiner, proof: proof, wantErr: true},
+		{name: "path as name", invites: []Invite{valid}, joinerName: "../laptop", joiner: joiner, proof: proof, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, file := newTestConf(t)
+			conf.Invites = tt.invites
+			conf.Revoked = tt.revoked
+			if tt.peers != nil {
+				conf.Peers = tt.peers
+			}
+			if err := writeConf(file, conf); err != nil {
+				t.Fatal(err)
+			}
+			a := newTestServer(t, node, conf)
+			joinerName := tt.joinerName
+			if joinerName == "" {
+				joinerName = "laptop"
+			}
+
+			name, err := a.acceptInvite(file, tt.joiner, joinerName, nonce, tt.proof)
+			if (err != nil) != tt.wantErr || name != tt.want {
+				t.Fatalf("acceptInvite() = %q, %v, want %q, error %v", name, err, tt.want, tt.wantErr)
+			}
+			saved, err := readConf(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr {
+				if len(saved.Invites) != len(tt.invites) {
+					t.Error("refused pairing consumed an invite")
+				}
+				if _, ok := saved.Peers[joinerName]; ok && tt.peers[joinerName].ID == "" {
+					t.Error("refused peer saved")
+				}
+				return
+			}
+			if saved.Peers[name].ID != tt.joiner.Pretty() {
+				t.Errorf("peer %s not added", name)
+			}
+			if len(saved.Invites) != len(tt.invites)-1 {
+				t.Error("invite not consumed")
+			}
+
+			// The invite is gone, so the same proof can't pair again.
+			if _, err := a.acceptInvite(file, tt.joiner, "laptop", nonce, tt.proof); err == nil {
+				t.Error("invite accepted twice")
+			}
+		})
+	}
+}
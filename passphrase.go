@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"os"
+)
+
+// passphraseEnv is the environment variable holding the private key passphrase,
+// and newPassphraseEnv the one holding the passphrase `encrypt-key` changes it
+// to.
+const (
+	passphraseEnv    = "P2PTUNNEL_PASSPHRASE"
+	newPassphraseEnv = "P2PTUNNEL_NEW_PASSPHRASE"
+)
+
+// readPassphrase returns the passphrase from --passphrase-file, from
+// P2PTUNNEL_PASSPHRASE or, failing both, asks for it on the terminal. With
+// confirm set, a passphrase typed on the terminal has to be entered twice.
+func readPassphrase(ctx *cli.Context, confirm bool) ([]byte, error) {
+	if file := ctx.GlobalString("passphrase-file"); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+	if pass, ok := os.LookupEnv(passphraseEnv); ok {
+		return []byte(pass), nil
+	}
+
+	pass, err := readPassword("Passphrase for the private key: ")
+	if err != nil {
+		return nil, err
+	}
+	if !confirm {
+		return pass, nil
+	}
+	if len(pass) == 0 {
+		return nil, errors.New("Empty passphrase")
+	}
+	again, err := readPassword("Repeat the passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pass, again) {
+		return nil, errors.New("Passphrases don't match")
+	}
+	return pass, nil
+}
+
+// loadPrivateKey returns the marshaled private key of conf, from the
+// environment or a key file, or decrypting it with the passphrase if it is
+// stored encrypted.
+func loadPrivateKey(ctx *cli.Context, conf *Config) (string, error) {
+	if err := resolvePrivateKey(conf, ctx.GlobalString("conf")); err != nil {
+		return "", err
+	}
+	if conf.resolvedKey != "" {
+		return conf.resolvedKey, nil
+	}
+	if conf.EncryptedKey == nil {
+		return conf.PrivateKey, nil
+	}
+	pass, err := readPassphrase(ctx, false)
+	if err != nil {
+		return "", err
+	}
+	key, err := conf.EncryptedKey.Decrypt(pass)
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+// readNewPassphrase returns the passphrase an encrypted key is changed to, from
+// --new-passphrase-file, from P2PTUNNEL_NEW_PASSPHRASE or typed twice on the
+// terminal. It never reads the sources of the current passphrase, which would
+// leave the passphrase unchanged.
+func readNewPassphrase(ctx *cli.Context) ([]byte, error) {
+	if file := ctx.String("new-passphrase-file"); file != "" {
+		if file == ctx.GlobalString("passphrase-file") {
+			return nil, errors.New("--new-passphrase-file is the same file as --passphrase-file")
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+	if pass, ok := os.LookupEnv(newPassphraseEnv); ok {
+		return []byte(pass), nil
+	}
+
+	pass, err := readPassword("New passphrase for the private key: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(pass) == 0 {
+		return nil, errors.New("Empty passphrase")
+	}
+	again, err := readPassword("Repeat the new passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pass, again) {
+		return nil, errors.New("Passphrases don't match")
+	}
+	return pass, nil
+}
+
+// encryptConfKey moves the private key of conf into an encrypted block.
+func encryptConfKey(ctx *cli.Context, conf *Config) error {
+	pass, err := readPassphrase(ctx, true)
+	if err != nil {
+		return err
+	}
+	return encryptConfKeyWith(conf, pass)
+}
+
+// encryptConfKeyWith moves the private key of conf into a block encrypted with
+// pass.
+func encryptConfKeyWith(conf *Config, pass []byte) error {
+	ek, err := encryptKey([]byte(conf.PrivateKey), pass)
+	if err != nil {
+		return err
+	}
+	conf.EncryptedKey = ek
+	conf.PrivateKey = ""
+	return nil
+}
+
+func encryptKeyCmd(ctx *cli.Context) error {
+	configFile := ctx.GlobalString("conf")
+	_, err := updateConf(configFile, func(conf *Config) error {
+		if err := resolvePrivateKey(conf, configFile); err != nil {
+			return err
+		}
+		if err := conf.keyElsewhere(); err != nil {
+			return err
+		}
+		if conf.EncryptedKey == nil {
+			return encryptConfKey(ctx, conf)
+		}
+
+		// Changing the passphrase: decrypt with the current one, then
+		// encrypt with a new one from its own source.
+		old, err := readPassphrase(ctx, false)
+		if err != nil {
+			return err
+		}
+		key, err := conf.EncryptedKey.Decrypt(old)
+		if err != nil {
+			return err
+		}
+		pass, err := readNewPassphrase(ctx)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(pass, old) {
+			return errors.New("the new passphrase is the same as the current one")
+		}
+		conf.PrivateKey = string(key)
+		return encryptConfKeyWith(conf, pass)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Private key in %s is now encrypted\n", configFile)
+	return nil
+}
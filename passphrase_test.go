@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestChangePassphrase checks that encrypt-key takes the new passphrase from
+// its own source rather than re-reading the current one.
+func TestChangePassphrase(t *testing.T) {
+	conf, file := newTestConf(t)
+	key := conf.PrivateKey
+	if err := encryptConfKeyWith(conf, []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeConf(file, conf); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(file)
+	oldFile, newFile, sameFile := filepath.Join(dir, "old"), filepath.Join(dir, "new"), filepath.Join(dir, "same")
+	for name, pass := range map[string]string{oldFile: "old\n", newFile: "new\n", sameFile: "old"} {
+		if err := ioutil.WriteFile(name, []byte(pass), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := func(newPassphraseFile string) error {
+		return encryptKeyCmd(newTestContext(
+			map[string]string{"conf": file, "passphrase-file": oldFile},
+			map[string]string{"new-passphrase-file": newPassphraseFile},
+		))
+	}
+	for _, file := range []string{oldFile, sameFile} {
+		if err := run(file); err == nil {
+			t.Errorf("changed the passphrase to the current one from %s", filepath.Base(file))
+		}
+	}
+
+	os.Setenv(newPassphraseEnv, "old")
+	err := run("")
+	os.Unsetenv(newPassphraseEnv)
+	if err == nil {
+		t.Errorf("changed the passphrase to the current one from %s", newPassphraseEnv)
+	}
+
+	if err := run(newFile); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := readConf(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := saved.EncryptedKey.Decrypt([]byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != key {
+		t.Error("changing the passphrase changed the key")
+	}
+}
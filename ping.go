@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/routing"
+	libp2pping "github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/p2ptunnel/p2ptunnel/pkg/tunnel"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"time"
+)
+
+// tracer prints the steps of reaching a peer with --trace, with the time since
+// the command started.
+type tracer struct {
+	on    bool
+	start time.Time
+}
+
+func (t *tracer) step(format string, args ...interface{}) {
+	if !t.on {
+		return
+	}
+	fmt.Printf("trace  %+8.1fms  %s\n", ms(time.Since(t.start)), fmt.Sprintf(format, args...))
+}
+
+// ping reports the round-trip time to a peer and the path the connection
+// took, to tell slow discovery, relays and local services apart.
+func ping(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.New("Please provide the name of the peer to ping")
+	}
+	name := ctx.Args()[0]
+	tr := &tracer{on: ctx.Bool("trace"), start: time.Now()}
+
+	cctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node, dht, peers, err := newClientNode(cctx, ctx)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+	id, ok := peers[name]
+	if !ok {
+		return errors.Errorf("Peer %s is not in the config", name)
+	}
+	reach, err := node.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		return err
+	}
+	defer reach.Close()
+	tr.step("node %s started, connected to %d bootstrap peers", node.ID(), len(node.Network().Peers()))
+
+	dctx, dcancel := context.WithTimeout(cctx, ctx.Duration("timeout"))
+	defer dcancel()
+	if err := connectPeer(dctx, node, dht, id, tr); err != nil {
+		return err
+	}
+	path, addr := connPath(node, id)
+	fmt.Printf("PING %s (%s)\n", name, id)
+	fmt.Printf("connection    %s, %s, %s\n", path, transportName(addr), addr)
+
+	rtts, err := pingPeer(cctx, node, id, ctx.Int("count"), ctx.Duration("interval"), func(seq int, rtt time.Duration) {
+		fmt.Printf("reply from %s: seq=%d time=%.2fms\n", name, seq, ms(rtt))
+	})
+	if err != nil {
+		fmt.Printf("ping failed: %v\n", err)
+	}
+	fmt.Printf("--- %s ping statistics ---\n", name)
+	fmt.Printf("%d replies  %s\n", len(rtts), newBenchStats(rtts))
+
+	if service := ctx.String("service"); service != "" {
+		c, err := tunnel.NewConnector(tunnel.Options{Host: node, Peers: peers, Routing: dht})
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		conn, err := c.Dial(dctx, name, service)
+		if err != nil {
+			fmt.Printf("tunnel        %s failed after %.2fms: %v\n", service, ms(time.Since(start)), err)
+		} else {
+			fmt.Printf("tunnel        %s opened in %.2fms\n", service, ms(time.Since(start)))
+			conn.Close()
+		}
+	}
+
+	fmt.Printf("reachability  %s (AutoNAT)\n", reachability(reach, ctx.Duration("nat-wait")))
+	if len(rtts) == 0 {
+		return errors.Errorf("No reply from %s", name)
+	}
+	return nil
+}
+
+// connectPeer connects node to the peer id, looking up its addresses with r
+// unless they are known.
+func connectPeer(ctx context.Context, node host.Host, r routing.PeerRouting, id peer.ID, tr *tracer) error {
+	if node.Network().Connectedness(id) == network.Connected {
+		tr.step("already connected to %s", id)
+		return nil
+	}
+	if addrs := node.Peerstore().Addrs(id); len(addrs) > 0 {
+		tr.step("%d known addresses of %s", len(addrs), id)
+	} else if r == nil {
+		return errors.Errorf("No addresses known for %s", id)
+	} else {
+		tr.step("looking up %s in the DHT", id)
+		info, err := r.FindPeer(ctx, id)
+		if err != nil {
+			return errors.Wrap(err, "find peer")
+		}
+		tr.step("found %d addresses", len(info.Addrs))
+		for _, a := range info.Addrs {
+			tr.step("  %s", a)
+		}
+		node.Peerstore().AddAddrs(id, info.Addrs, peerstore.TempAddrTTL)
+	}
+
+	tr.step("dialing %s", id)
+	// The error of a failed dial lists the error of every address.
+	if err := node.Connect(ctx, peer.AddrInfo{ID: id}); err != nil {
+		return errors.Wrap(err, "connect")
+	}
+	path, addr := connPath(node, id)
+	tr.step("connected %s over %s to %s", path, transportName(addr), addr)
+	return nil
+}
+
+// pingPeer pings the peer id count times, one every interval, with the ping
+// protocol of libp2p, passing every reply to reply. It returns the round-trip
+// times until the first failure.
+func pingPeer(ctx context.Context, node host.Host, id peer.ID, count int, interval time.Duration, reply func(seq int, rtt time.Duration)) ([]time.Duration, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := libp2pping.Ping(ctx, node, id)
+	var rtts []time.Duration
+	for seq := 1; seq <= count; seq++ {
+		if seq > 1 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return rtts, ctx.Err()
+			}
+		}
+		res, ok := <-results
+		if !ok {
+			return rtts, errors.New("ping stream closed")
+		}
+		if res.Error != nil {
+			return rtts, res.Error
+		}
+		rtts = append(rtts, res.RTT)
+		reply(seq, res.RTT)
+	}
+	return rtts, nil
+}
+
+// transportName names the transport of a connection to addr, or of the
+// connection to the relay of a relayed one.
+func transportName(addr string) string {
+	m, err := ma.NewMultiaddr(addr)
+	if err != nil {
+		return "unknown"
+	}
+	name := "unknown"
+	ma.ForEach(m, func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_TCP:
+			name = "TCP"
+		case ma.P_QUIC:
+			name = "QUIC"
+		case ma.P_WS:
+			name = "WebSocket"
+		case ma.P_WSS:
+			name = "secure WebSocket"
+		case ma.P_CIRCUIT:
+			return false
+		}
+		return true
+	})
+	return name
+}
+
+// reachability returns the reachability of the node found by AutoNAT, waiting
+// up to wait for it to decide.
+func reachability(sub event.Subscription, wait time.Duration) network.Reachability {
+	r := network.ReachabilityUnknown
+	timeout := time.After(wait)
+	for {
+		select {
+		case e, ok := <-sub.Out():
+			if !ok {
+				return r
+			}
+			r = e.(event.EvtLocalReachabilityChanged).Reachability
+			if r != network.ReachabilityUnknown {
+				return r
+			}
+		case <-timeout:
+			return r
+		}
+	}
+}
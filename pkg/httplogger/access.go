@@ -0,0 +1,114 @@
+package httplogger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Access log formats.
+const (
+	// FormatCommon is the Common Log Format, followed by the quoted Host
+	// header and the duration.
+	FormatCommon = "common"
+	// FormatJSON writes every record as one JSON object per line.
+	FormatJSON = "json"
+)
+
+// Record is the access log record of one request/response pair.
+type Record struct {
+	Time    time.Time
+	Peer    string
+	Service string
+	Method  string
+	Path    string
+	Proto   string
+	Host    string
+	// Status is 0 if the connection closed before the response.
+	Status int
+	// ContentLength is the size of the response body as sent.
+	ContentLength int64
+	// Duration is the time from the first byte of the request to the last
+	// byte of the response.
+	Duration time.Duration
+}
+
+// AccessLog writes access log records. It is safe for concurrent use, records
+// of different connections never interleave.
+type AccessLog struct {
+	w      io.Writer
+	format string
+	lock   sync.Mutex
+}
+
+// NewAccessLog creates an access log writing to w in format.
+func NewAccessLog(w io.Writer, format string) (*AccessLog, error) {
+	if format != FormatCommon && format != FormatJSON {
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+	return &AccessLog{w: w, format: format}, nil
+}
+
+// BodyLimit returns 0, the access log needs no bodies.
+func (a *AccessLog) BodyLimit() int {
+	return 0
+}
+
+// Exchange logs the record of e.
+func (a *AccessLog) Exchange(e *Exchange) {
+	a.Log(e.Record)
+}
+
+// Log writes r to the access log.
+func (a *AccessLog) Log(r Record) {
+	var line []byte
+	if a.format == FormatJSON {
+		line = r.json()
+	} else {
+		line = r.common()
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.w.Write(line)
+}
+
+// common formats r like
+//
+//	office - - [19/Oct/2026:17:56:51 +0000] "GET / HTTP/1.1" 200 297 "web.lan" 1.5ms
+func (r Record) common() []byte {
+	status, length := "-", "-"
+	if r.Status != 0 {
+		status = strconv.Itoa(r.Status)
+		length = strconv.FormatInt(r.ContentLength, 10)
+	}
+	return []byte(fmt.Sprintf("%s - - [%s] %q %s %s %q %s\n",
+		orDash(r.Peer), r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.Path+" "+r.Proto, status, length, r.Host, r.Duration))
+}
+
+func (r Record) json() []byte {
+	b, _ := json.Marshal(struct {
+		Time          time.Time `json:"time"`
+		Peer          string    `json:"peer"`
+		Service       string    `json:"service,omitempty"`
+		Method        string    `json:"method"`
+		Path          string    `json:"path"`
+		Proto         string    `json:"proto"`
+		Host          string    `json:"host,omitempty"`
+		Status        int       `json:"status"`
+		ContentLength int64     `json:"content_length"`
+		DurationMS    float64   `json:"duration_ms"`
+	}{r.Time, r.Peer, r.Service, r.Method, r.Path, r.Proto, r.Host, r.Status, r.ContentLength,
+		float64(r.Duration) / float64(time.Millisecond)})
+	return append(b, '\n')
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,157 @@
+package httplogger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Body lengths besides a Content-Length.
+const (
+	// untilClose marks a body ending with the connection.
+	untilClose = -1
+	// chunked marks a body in chunked transfer coding.
+	chunked = -2
+)
+
+// maxChunkLine limits the chunk size and trailer lines of chunked bodies.
+const maxChunkLine = 4 << 10
+
+type chunkState byte
+
+const (
+	chunkSize    chunkState = iota // reading the chunk size line
+	chunkData                      // reading chunk data
+	chunkDataEnd                   // reading the line break after chunk data
+	chunkTrailer                   // reading the trailer
+)
+
+// bodyReader finds the end of a message body.
+type bodyReader struct {
+	// length is the bytes left of a body with a Content-Length, untilClose
+	// or chunked.
+	length int64
+
+	state chunkState
+	// left is the bytes left of the current chunk.
+	left int64
+	line []byte
+}
+
+func newBodyReader(length int64) *bodyReader {
+	return &bodyReader{length: length}
+}
+
+// consume reads b, passing the body data in it to data, which may be nil. It
+// returns the number of bytes of b belonging to the body and whether the body
+// is complete.
+func (r *bodyReader) consume(b []byte, data func([]byte)) (int, bool, error) {
+	switch r.length {
+	case untilClose:
+		if data != nil {
+			data(b)
+		}
+		return len(b), false, nil
+	case chunked:
+		return r.consumeChunked(b, data)
+	}
+	n := int64(len(b))
+	if n > r.length {
+		n = r.length
+	}
+	if data != nil && n > 0 {
+		data(b[:n])
+	}
+	r.length -= n
+	return int(n), r.length == 0, nil
+}
+
+func (r *bodyReader) consumeChunked(b []byte, data func([]byte)) (int, bool, error) {
+	n := 0
+	for n < len(b) {
+		if r.state == chunkData {
+			k := int64(len(b) - n)
+			if k > r.left {
+				k = r.left
+			}
+			if data != nil {
+				data(b[n : n+int(k)])
+			}
+			n += int(k)
+			r.left -= k
+			if r.left == 0 {
+				r.state = chunkDataEnd
+			}
+			continue
+		}
+
+		// The other states read lines.
+		i := n
+		for i < len(b) && b[i] != '\n' {
+			i++
+		}
+		if len(r.line)+i-n > maxChunkLine {
+			return n, false, fmt.Errorf("chunk line too long")
+		}
+		r.line = append(r.line, b[n:i]...)
+		if i == len(b) {
+			return len(b), false, nil
+		}
+		n = i + 1
+		line := strings.TrimRight(string(r.line), "\r")
+		r.line = r.line[:0]
+
+		switch r.state {
+		case chunkSize:
+			if j := strings.IndexByte(line, ';'); j >= 0 {
+				line = line[:j]
+			}
+			size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+			if err != nil || size < 0 {
+				return n, false, fmt.Errorf("invalid chunk size %q", line)
+			}
+			if size == 0 {
+				r.state = chunkTrailer
+			} else {
+				r.state, r.left = chunkData, size
+			}
+		case chunkDataEnd:
+			if line != "" {
+				return n, false, fmt.Errorf("missing line break after chunk")
+			}
+			r.state = chunkSize
+		case chunkTrailer:
+			if line == "" {
+				return n, true, nil
+			}
+		}
+	}
+	return n, false, nil
+}
+
+// bodyLength returns the length of the body following a message head with hdr,
+// from its Content-Length or Transfer-Encoding. Requests without either have
+// no body, responses end with the connection.
+func bodyLength(hdr Header, request bool) (int64, error) {
+	if te := hdr.Get("Transfer-Encoding"); te != "" {
+		codings := strings.Split(te, ",")
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			return chunked, nil
+		}
+		if request {
+			return 0, fmt.Errorf("request without chunked transfer coding")
+		}
+		return untilClose, nil
+	}
+	length, err := contentLength(hdr)
+	if err != nil {
+		return 0, err
+	}
+	if length < 0 {
+		if request {
+			return 0, nil
+		}
+		return untilClose, nil
+	}
+	return length, nil
+}
@@ -0,0 +1,353 @@
+package httplogger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxHeadSize limits the head of a message. Connections sending longer heads
+// are not logged any further.
+const maxHeadSize = 64 << 10
+
+// Exchange is a request/response pair parsed from a connection.
+type Exchange struct {
+	Record
+	Request, Response Message
+}
+
+// Message is a parsed HTTP message.
+type Message struct {
+	Header Header
+	// StatusText is the reason phrase of responses.
+	StatusText string
+	// Body holds the first bytes of the body, up to the largest body limit
+	// of the sinks.
+	Body []byte
+	// BodySize is the size of the whole body.
+	BodySize int64
+}
+
+// Header is the header fields of a message in their order.
+type Header []Field
+
+// Field is a header field.
+type Field struct {
+	Name, Value string
+}
+
+// Get returns the value of the first field named name, ignoring case.
+func (h Header) Get(name string) string {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Sink receives the exchanges parsed from connections.
+type Sink interface {
+	// BodyLimit is how many bytes of the bodies the sink needs.
+	BodyLimit() int
+	// Exchange is called with every complete exchange, or with a request
+	// left without a response when the connection closes.
+	Exchange(e *Exchange)
+}
+
+// ConnLog parses the HTTP/1.x messages of one proxied connection and passes a
+// request/response pair at a time to its sinks. It only reads the bytes it is
+// given, the caller passes them on unchanged. Connections which don't speak
+// HTTP/1.x are not logged. A nil ConnLog ignores all calls.
+type ConnLog struct {
+	peer, service string
+	sinks         []Sink
+	bodyLimit     int
+
+	lock     sync.Mutex
+	req, res message
+	// pending holds the requests waiting for their response, oldest first.
+	pending []*Exchange
+	// cur is the exchange whose response is being read.
+	cur *Exchange
+}
+
+// NewConn returns the logger of a new connection to service of peer. It
+// returns nil without sinks, which logs nothing.
+func NewConn(peer, service string, sinks ...Sink) *ConnLog {
+	if len(sinks) == 0 {
+		return nil
+	}
+	c := &ConnLog{peer: peer, service: service, sinks: sinks}
+	for _, s := range sinks {
+		if s.BodyLimit() > c.bodyLimit {
+			c.bodyLimit = s.BodyLimit()
+		}
+	}
+	return c
+}
+
+// Request parses bytes sent by the client.
+func (c *ConnLog) Request(b []byte) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.req.feed(b, c.requestHead, c.requestBody, nil)
+}
+
+// Response parses bytes sent by the server.
+func (c *ConnLog) Response(b []byte) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.res.feed(b, c.responseHead, c.responseBody, c.responseEnd)
+}
+
+// Close logs the response ended by closing the connection, and the requests
+// left without a response.
+func (c *ConnLog) Close() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.responseEnd()
+	for _, e := range c.pending {
+		e.Duration = time.Since(e.Time)
+		c.emit(e)
+	}
+	c.pending = nil
+}
+
+func (c *ConnLog) emit(e *Exchange) {
+	for _, s := range c.sinks {
+		s.Exchange(e)
+	}
+}
+
+func (c *ConnLog) requestHead(head []byte, started time.Time) (int64, error) {
+	line, hdr := parseHead(head)
+	f := strings.Fields(line)
+	if len(f) != 3 || !strings.HasPrefix(f[2], "HTTP/1.") {
+		return 0, fmt.Errorf("invalid request line %q", line)
+	}
+	c.pending = append(c.pending, &Exchange{
+		Record: Record{
+			Time:    started,
+			Peer:    c.peer,
+			Service: c.service,
+			Method:  f[0],
+			Path:    f[1],
+			Proto:   f[2],
+			Host:    hdr.Get("Host"),
+		},
+		Request: Message{Header: hdr},
+	})
+	return bodyLength(hdr, true)
+}
+
+func (c *ConnLog) responseHead(head []byte, started time.Time) (int64, error) {
+	line, hdr := parseHead(head)
+	f := strings.Fields(line)
+	if len(f) < 2 || !strings.HasPrefix(f[0], "HTTP/1.") {
+		return 0, fmt.Errorf("invalid status line %q", line)
+	}
+	status, err := strconv.Atoi(f[1])
+	if err != nil || status < 100 || status > 999 {
+		return 0, fmt.Errorf("invalid status line %q", line)
+	}
+	if status < 200 && status != 101 {
+		// Interim responses precede the actual one.
+		return 0, nil
+	}
+
+	e := &Exchange{Record: Record{Time: started, Peer: c.peer, Service: c.service, Method: "-", Path: "-", Proto: f[0]}}
+	if len(c.pending) > 0 {
+		e = c.pending[0]
+		c.pending = c.pending[1:]
+	}
+	e.Status = status
+	e.Response.Header = hdr
+	e.Response.StatusText = strings.Join(f[2:], " ")
+	c.cur = e
+	if status == 101 {
+		// The connection no longer speaks HTTP after switching protocols.
+		c.responseEnd()
+		c.req.broken = true
+		return 0, fmt.Errorf("switched protocols")
+	}
+	if e.Method == "HEAD" || status == 204 || status == 304 {
+		return 0, nil
+	}
+	return bodyLength(hdr, false)
+}
+
+func (c *ConnLog) requestBody(b []byte) {
+	if len(c.pending) > 0 {
+		c.addBody(&c.pending[len(c.pending)-1].Request, b)
+	}
+}
+
+func (c *ConnLog) responseBody(b []byte) {
+	if c.cur != nil {
+		c.addBody(&c.cur.Response, b)
+		c.cur.ContentLength = c.cur.Response.BodySize
+	}
+}
+
+// addBody counts b in the body of m, keeping up to bodyLimit bytes.
+func (c *ConnLog) addBody(m *Message, b []byte) {
+	m.BodySize += int64(len(b))
+	if keep := c.bodyLimit - len(m.Body); keep > 0 {
+		if keep > len(b) {
+			keep = len(b)
+		}
+		m.Body = append(m.Body, b[:keep]...)
+	}
+}
+
+func (c *ConnLog) responseEnd() {
+	if c.cur == nil {
+		return
+	}
+	c.cur.Duration = time.Since(c.cur.Time)
+	c.emit(c.cur)
+	c.cur = nil
+}
+
+// message parses the stream of HTTP messages of one direction.
+type message struct {
+	head []byte
+	// started is when the first byte of the current message arrived.
+	started time.Time
+	// body reads the body of the current message, nil while reading its
+	// head.
+	body *bodyReader
+	// broken stops parsing once the stream is no HTTP.
+	broken bool
+}
+
+// feed parses b. Complete message heads are passed to head, which returns the
+// length of the body following them, untilClose or chunked. body is called
+// with the body data, decoded from chunks, and end once a message is
+// complete.
+func (m *message) feed(b []byte, head func([]byte, time.Time) (int64, error), body func([]byte), end func()) {
+	for len(b) > 0 && !m.broken {
+		if m.body != nil {
+			n, done, err := m.body.consume(b, body)
+			if err != nil {
+				m.broken = true
+				return
+			}
+			b = b[n:]
+			if done {
+				m.body = nil
+				if end != nil {
+					end()
+				}
+			}
+			continue
+		}
+
+		if len(m.head) == 0 {
+			// Skip the empty lines allowed between messages.
+			b = trimLeadingNewlines(b)
+			if len(b) == 0 {
+				return
+			}
+			m.started = time.Now()
+		}
+		prev := len(m.head)
+		m.head = append(m.head, b...)
+		n := headEnd(m.head, prev)
+		if n < 0 {
+			if len(m.head) > maxHeadSize {
+				m.broken = true
+				m.head = nil
+			}
+			return
+		}
+		b = b[n-prev:]
+		if n > maxHeadSize {
+			// Break on long heads arriving at once too, as on those
+			// arriving in parts.
+			m.broken = true
+			m.head = nil
+			return
+		}
+		length, err := head(m.head[:n], m.started)
+		m.head = m.head[:0]
+		if err != nil {
+			m.broken = true
+			return
+		}
+		if length != 0 {
+			m.body = newBodyReader(length)
+		} else if end != nil {
+			end()
+		}
+	}
+}
+
+func trimLeadingNewlines(b []byte) []byte {
+	for len(b) > 0 && (b[0] == '\r' || b[0] == '\n') {
+		b = b[1:]
+	}
+	return b
+}
+
+// headEnd returns the length of the head in h ending with an empty line, or -1
+// if h holds no complete head. The search starts near from, where the bytes
+// new since the last search begin.
+func headEnd(h []byte, from int) int {
+	i := from - 3
+	if i < 0 {
+		i = 0
+	}
+	for ; i < len(h); i++ {
+		if h[i] != '\n' {
+			continue
+		}
+		if i+1 < len(h) && h[i+1] == '\n' {
+			return i + 2
+		}
+		if i+2 < len(h) && h[i+1] == '\r' && h[i+2] == '\n' {
+			return i + 3
+		}
+	}
+	return -1
+}
+
+// parseHead splits a message head into its first line and header fields.
+func parseHead(head []byte) (string, Header) {
+	lines := strings.Split(string(head), "\n")
+	var hdr Header
+	for _, l := range lines[1:] {
+		l = strings.TrimRight(l, "\r")
+		i := strings.IndexByte(l, ':')
+		if i <= 0 {
+			continue
+		}
+		hdr = append(hdr, Field{Name: strings.TrimSpace(l[:i]), Value: strings.TrimSpace(l[i+1:])})
+	}
+	return strings.TrimRight(lines[0], "\r"), hdr
+}
+
+// contentLength returns the Content-Length of hdr, or -1 if it has none.
+func contentLength(hdr Header) (int64, error) {
+	v := hdr.Get("Content-Length")
+	if v == "" {
+		return -1, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid Content-Length %q", v)
+	}
+	return n, nil
+}
@@ -0,0 +1,184 @@
+package httplogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// newTestConn returns a connection logger of peer "office" writing to out.
+func newTestConn(t *testing.T, format string, out *bytes.Buffer) *ConnLog {
+	a, err := NewAccessLog(out, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewConn("office", "web", a)
+}
+
+func TestAccessLogCommon(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(t, FormatCommon, out)
+	c.Request([]byte("GET /index.html HTTP/1.1\r\nHost: web.lan\r\nAccept: */*\r\n\r\n"))
+	c.Response([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+
+	exp := regexp.MustCompile(`^office - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [-+]\d{4}\] "GET /index.html HTTP/1.1" 200 5 "web.lan" \S+\n$`)
+	if !exp.Match(out.Bytes()) {
+		t.Errorf("unexpected record %q", out.String())
+	}
+	c.Close()
+	if strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("expect one record, get %q", out.String())
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(t, FormatJSON, out)
+	req := []byte("POST /api HTTP/1.1\r\nHost: api.lan\r\nContent-Length: 7\r\n\r\n{\"a\":1}")
+	res := []byte("HTTP/1.1 201 Created\r\ncontent-length: 2\r\n\r\nok")
+	// Feed the messages byte by byte, as they may arrive.
+	for i := range req {
+		c.Request(req[i : i+1])
+	}
+	for i := range res {
+		c.Response(res[i : i+1])
+	}
+
+	var r struct {
+		Peer          string  `json:"peer"`
+		Method        string  `json:"method"`
+		Path          string  `json:"path"`
+		Host          string  `json:"host"`
+		Status        int     `json:"status"`
+		ContentLength int64   `json:"content_length"`
+		DurationMS    float64 `json:"duration_ms"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &r); err != nil {
+		t.Fatalf("%v: %q", err, out.String())
+	}
+	if r.Peer != "office" || r.Method != "POST" || r.Path != "/api" || r.Host != "api.lan" ||
+		r.Status != 201 || r.ContentLength != 2 {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
+
+func TestAccessLogSpecialResponses(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(t, FormatCommon, out)
+	// A HEAD response announces a length but has no body.
+	c.Request([]byte("HEAD / HTTP/1.1\r\nHost: web.lan\r\n\r\n"))
+	c.Response([]byte("HTTP/1.1 200 OK\r\nContent-Length: 297\r\n\r\n"))
+	// Interim responses are skipped.
+	c.Request([]byte("PUT /f HTTP/1.1\r\nHost: web.lan\r\nExpect: 100-continue\r\nContent-Length: 3\r\n\r\n"))
+	c.Response([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+	c.Request([]byte("abc"))
+	c.Response([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+	// Without a length the body ends with the connection.
+	c.Request([]byte("GET /stream HTTP/1.0\r\n\r\n"))
+	c.Response([]byte("HTTP/1.0 200 OK\r\n\r\nsome"))
+	c.Response([]byte(" data"))
+	c.Close()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	exp := []string{
+		`"HEAD / HTTP/1.1" 200 0 "web.lan"`,
+		`"PUT /f HTTP/1.1" 204 0 "web.lan"`,
+		`"GET /stream HTTP/1.0" 200 9 ""`,
+	}
+	if len(lines) != len(exp) {
+		t.Fatalf("expect %d records, get %q", len(exp), out.String())
+	}
+	for i, e := range exp {
+		if !strings.Contains(lines[i], e) {
+			t.Errorf(" Expect: %s\n Get: %s\n", e, lines[i])
+		}
+	}
+}
+
+func TestAccessLogUnanswered(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(t, FormatCommon, out)
+	c.Request([]byte("GET /slow HTTP/1.1\r\nHost: web.lan\r\n\r\n"))
+	c.Close()
+	if !strings.Contains(out.String(), `"GET /slow HTTP/1.1" - - "web.lan"`) {
+		t.Errorf("unexpected record %q", out.String())
+	}
+}
+
+func TestAccessLogNotHTTP(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(t, FormatCommon, out)
+	c.Request([]byte("SSH-2.0-OpenSSH_8.9\r\n\r\n"))
+	c.Response([]byte("SSH-2.0-OpenSSH_8.9\r\n\r\n"))
+	c.Close()
+	if out.Len() != 0 {
+		t.Errorf("expect no records, get %q", out.String())
+	}
+
+	var nilConn *ConnLog
+	nilConn.Request([]byte("GET / HTTP/1.1\r\n\r\n"))
+	nilConn.Close()
+}
+
+func TestAccessLogKeepsBytes(t *testing.T) {
+	req := []byte("GET / HTTP/1.1\r\nHost: web.lan\r\n\r\n")
+	orig := append([]byte(nil), req...)
+	c := newTestConn(t, FormatCommon, &bytes.Buffer{})
+	c.Request(req[:10])
+	c.Request(req[10:])
+	if !bytes.Equal(req, orig) {
+		t.Errorf("request bytes changed to %q", req)
+	}
+}
+
+func TestAccessLogPipelined(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(t, FormatCommon, out)
+	// Three pipelined requests, the second with a chunked body.
+	c.Request([]byte("GET /a HTTP/1.1\r\nHost: web.lan\r\n\r\n" +
+		"POST /b HTTP/1.1\r\nHost: web.lan\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nwiki\r\n0\r\n\r\n" +
+		"GET /c HTTP/1.1\r\nHost: web.lan\r\nConnection: close\r\n\r\n"))
+	c.Response([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n"))
+	c.Response([]byte("HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\nHTTP/1.1 404 Not Found\r\nConnection: close\r\n\r\ngone"))
+	c.Close()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	exp := []string{
+		`"GET /a HTTP/1.1" 200 11 "web.lan"`,
+		`"POST /b HTTP/1.1" 201 0 "web.lan"`,
+		`"GET /c HTTP/1.1" 404 4 "web.lan"`,
+	}
+	if len(lines) != len(exp) {
+		t.Fatalf("expect %d records, get %q", len(exp), out.String())
+	}
+	for i, e := range exp {
+		if !strings.Contains(lines[i], e) {
+			t.Errorf(" Expect: %s\n Get: %s\n", e, lines[i])
+		}
+	}
+}
+
+func TestAccessLogLongHead(t *testing.T) {
+	req := []byte("GET / HTTP/1.1\r\nHost: web.lan\r\nX-Pad: " + strings.Repeat("a", maxHeadSize) + "\r\n\r\n")
+	res := []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	// Requests with heads over the limit aren't logged, whether they arrive
+	// at once or in parts.
+	for _, chunk := range []int{len(req), 1000} {
+		out := &bytes.Buffer{}
+		c := newTestConn(t, FormatCommon, out)
+		for i := 0; i < len(req); i += chunk {
+			end := i + chunk
+			if end > len(req) {
+				end = len(req)
+			}
+			c.Request(req[i:end])
+		}
+		c.Response(res)
+		c.Close()
+		if strings.Contains(out.String(), "GET /") {
+			t.Errorf("chunks of %d: expect the request not to be logged, get %q", chunk, out.String())
+		}
+	}
+}
@@ -0,0 +1,31 @@
+//go:build go1.18
+// +build go1.18
+
+package httplogger
+
+import (
+	"reflect"
+	"testing"
+)
+
+func FuzzHTTPLoggerPrint(f *testing.F) {
+	f.Add(sampleRequests, []byte{3, 17, 0, 40})
+	f.Add(sampleResponses, []byte{0, 0, 0, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, data, sizes []byte) {
+		whole := printChunks([][]byte{data})
+		if got := printChunks(chunks(data, sizes)); got != whole {
+			t.Errorf("chunking changes the output\n Expect: %q\n Get: %q\n", whole, got)
+		}
+	})
+}
+
+func FuzzConnLog(f *testing.F) {
+	f.Add(sampleRequests, sampleResponses, []byte{5, 0, 63}, []byte{1, 2, 3})
+	f.Fuzz(func(t *testing.T, req, res, reqSizes, resSizes []byte) {
+		whole := connExchanges([][]byte{req}, [][]byte{res})
+		got := connExchanges(chunks(req, reqSizes), chunks(res, resSizes))
+		if !reflect.DeepEqual(got, whole) {
+			t.Errorf("chunking changes the exchanges\n Expect: %+v\n Get: %+v\n", whole, got)
+		}
+	})
+}
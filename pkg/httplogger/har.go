@@ -0,0 +1,446 @@
+package httplogger
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Redacted replaces the values of redacted headers in captures.
+const Redacted = "[REDACTED]"
+
+// DefaultRedact lists the headers redacted by default, as they usually carry
+// credentials.
+var DefaultRedact = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+}
+
+// HAR is an HTTP Archive 1.2, as far as p2ptunnel writes it. Entries carry the
+// peer and service of their tunnel as the custom fields _peer and _service.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+// HARLog is the log of a HAR.
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+// HARCreator names the application which created a HAR.
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HAREntry is an exchange in a HAR.
+type HAREntry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	// Time is the duration of the exchange in milliseconds.
+	Time     float64     `json:"time"`
+	Request  HARRequest  `json:"request"`
+	Response HARResponse `json:"response"`
+	Cache    struct{}    `json:"cache"`
+	Timings  HARTimings  `json:"timings"`
+	Peer     string      `json:"_peer,omitempty"`
+	Service  string      `json:"_service,omitempty"`
+}
+
+// HARRequest is the request of a HAR entry.
+type HARRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []HARPair    `json:"cookies"`
+	Headers     []HARPair    `json:"headers"`
+	QueryString []HARPair    `json:"queryString"`
+	PostData    *HARPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int64        `json:"bodySize"`
+}
+
+// HARResponse is the response of a HAR entry.
+type HARResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []HARPair  `json:"cookies"`
+	Headers     []HARPair  `json:"headers"`
+	Content     HARContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int64      `json:"bodySize"`
+}
+
+// HARPair is a header, query parameter or cookie.
+type HARPair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARPostData is the body of a request. Bodies which aren't UTF-8 are base64
+// encoded, as response content.
+type HARPostData struct {
+	MimeType  string `json:"mimeType"`
+	Text      string `json:"text"`
+	Encoding  string `json:"_encoding,omitempty"`
+	Truncated bool   `json:"_truncated,omitempty"`
+}
+
+// HARContent is the body of a response. Size is the size of the whole body,
+// Text holds the captured part.
+type HARContent struct {
+	Size      int64  `json:"size"`
+	MimeType  string `json:"mimeType"`
+	Text      string `json:"text,omitempty"`
+	Encoding  string `json:"encoding,omitempty"`
+	Truncated bool   `json:"_truncated,omitempty"`
+}
+
+// HARTimings splits the time of an entry. Only the total is known to a
+// proxy, it counts as waiting.
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// CaptureOptions configures a HARCapture.
+type CaptureOptions struct {
+	// BodyLimit is the number of bytes of each body captured, bodies are
+	// truncated beyond it.
+	BodyLimit int
+	// Redact lists the headers whose values are replaced by Redacted,
+	// ignoring case.
+	Redact []string
+	// Creator is written as the creator of the HAR.
+	Creator HARCreator
+}
+
+// HARCapture is a Sink writing the exchanges to a HAR file. Each entry is
+// appended in place of the closing brackets, which are written after it again,
+// so the file is complete whenever the process stops.
+type HARCapture struct {
+	opts CaptureOptions
+
+	lock sync.Mutex
+	f    *os.File
+	// end is the offset of the closing brackets.
+	end     int64
+	entries int
+	err     error
+}
+
+// harTail closes the entries and the HAR, after a newline and indentation
+// unless there are no entries.
+const harTail = "]\n  }\n}\n"
+
+// NewHARCapture creates the HAR file at path and returns a capture writing to
+// it.
+func NewHARCapture(path string, opts CaptureOptions) (*HARCapture, error) {
+	creator, err := json.MarshalIndent(opts.Creator, "    ", "  ")
+	if err != nil {
+		return nil, err
+	}
+	head := "{\n  \"log\": {\n    \"version\": \"1.2\",\n    \"creator\": " + string(creator) + ",\n    \"entries\": ["
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteString(head + harTail); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &HARCapture{opts: opts, f: f, end: int64(len(head))}, nil
+}
+
+// BodyLimit returns the body limit of the options.
+func (c *HARCapture) BodyLimit() int {
+	return c.opts.BodyLimit
+}
+
+// Exchange adds e to the HAR file.
+func (c *HARCapture) Exchange(e *Exchange) {
+	b, err := json.MarshalIndent(c.entry(e), "      ", "  ")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil || c.f == nil {
+		return
+	}
+	if err != nil {
+		c.err = err
+		return
+	}
+	sep := ",\n      "
+	if c.entries == 0 {
+		sep = "\n      "
+	}
+	entry := sep + string(b)
+	if _, err := c.f.WriteAt([]byte(entry+"\n    "+harTail), c.end); err != nil {
+		c.err = err
+		return
+	}
+	c.end += int64(len(entry))
+	c.entries++
+}
+
+// Close closes the HAR file and returns the first error writing it.
+func (c *HARCapture) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.f == nil {
+		return c.err
+	}
+	if err := c.f.Close(); err != nil && c.err == nil {
+		c.err = err
+	}
+	c.f = nil
+	return c.err
+}
+
+func (c *HARCapture) entry(e *Exchange) HAREntry {
+	ms := float64(e.Duration) / float64(time.Millisecond)
+	entry := HAREntry{
+		StartedDateTime: e.Time,
+		Time:            ms,
+		Request: HARRequest{
+			Method:      e.Method,
+			URL:         requestURL(e),
+			HTTPVersion: e.Proto,
+			Cookies:     []HARPair{},
+			Headers:     c.headers(e.Request.Header),
+			QueryString: []HARPair{},
+			HeadersSize: -1,
+			BodySize:    e.Request.BodySize,
+		},
+		Response: HARResponse{
+			Status:      e.Status,
+			StatusText:  e.Response.StatusText,
+			HTTPVersion: e.Proto,
+			Cookies:     []HARPair{},
+			Headers:     c.headers(e.Response.Header),
+			Content: HARContent{
+				Size:     e.Response.BodySize,
+				MimeType: e.Response.Header.Get("Content-Type"),
+			},
+			RedirectURL: e.Response.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    e.Response.BodySize,
+		},
+		Timings: HARTimings{Wait: ms},
+		Peer:    e.Peer,
+		Service: e.Service,
+	}
+	if u, err := url.Parse(entry.Request.URL); err == nil {
+		for name, values := range u.Query() {
+			for _, v := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, HARPair{Name: name, Value: v})
+			}
+		}
+		sort.SliceStable(entry.Request.QueryString, func(i, j int) bool {
+			return entry.Request.QueryString[i].Name < entry.Request.QueryString[j].Name
+		})
+	}
+	if e.Request.BodySize > 0 {
+		text, enc := encodeBody(e.Request.Body)
+		entry.Request.PostData = &HARPostData{
+			MimeType:  e.Request.Header.Get("Content-Type"),
+			Text:      text,
+			Encoding:  enc,
+			Truncated: int64(len(e.Request.Body)) < e.Request.BodySize,
+		}
+	}
+	if e.Response.BodySize > 0 {
+		content := &entry.Response.Content
+		content.Text, content.Encoding = encodeBody(e.Response.Body)
+		content.Truncated = int64(len(e.Response.Body)) < e.Response.BodySize
+	}
+	return entry
+}
+
+// headers converts h, redacting the values of the configured headers.
+func (c *HARCapture) headers(h Header) []HARPair {
+	pairs := make([]HARPair, 0, len(h))
+	for _, f := range h {
+		v := f.Value
+		for _, r := range c.opts.Redact {
+			if strings.EqualFold(f.Name, r) {
+				v = Redacted
+				break
+			}
+		}
+		pairs = append(pairs, HARPair{Name: f.Name, Value: v})
+	}
+	return pairs
+}
+
+// requestURL returns the absolute URL of the request of e.
+func requestURL(e *Exchange) string {
+	if strings.HasPrefix(e.Path, "http://") || strings.HasPrefix(e.Path, "https://") {
+		return e.Path
+	}
+	return "http://" + e.Host + e.Path
+}
+
+// encodeBody returns b as text, base64 encoded unless it is UTF-8.
+func encodeBody(b []byte) (string, string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+func decodeBody(text, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return []byte(text), nil
+}
+
+// ReadHAR reads a HAR.
+func ReadHAR(r io.Reader) (*HAR, error) {
+	har := &HAR{}
+	if err := json.NewDecoder(r).Decode(har); err != nil {
+		return nil, fmt.Errorf("read HAR: %v", err)
+	}
+	return har, nil
+}
+
+// skipHeaders are the headers not replayed, as the HTTP client sets them.
+var skipHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Host":              true,
+	"Keep-Alive":        true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// ErrTruncatedBody is returned by NewRequest for requests whose body was
+// truncated in the capture, as they can't be replayed.
+var ErrTruncatedBody = errors.New("request body truncated in the capture, not replayable")
+
+// NewRequest builds the request of e for replaying it. Redacted headers are
+// left out. Requests with a truncated body fail with ErrTruncatedBody.
+func (e *HAREntry) NewRequest() (*http.Request, error) {
+	var body io.Reader
+	if pd := e.Request.PostData; pd != nil {
+		if pd.Truncated {
+			return nil, ErrTruncatedBody
+		}
+		b, err := decodeBody(pd.Text, pd.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(e.Request.Method, e.Request.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range e.Request.Headers {
+		if h.Value == Redacted || skipHeaders[http.CanonicalHeaderKey(h.Name)] {
+			continue
+		}
+		req.Header.Add(h.Name, h.Value)
+	}
+	return req, nil
+}
+
+// volatileHeaders change between otherwise equal responses and aren't
+// compared.
+var volatileHeaders = map[string]bool{
+	"Age":               true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Date":              true,
+	"Etag":              true,
+	"Expires":           true,
+	"Keep-Alive":        true,
+	"Last-Modified":     true,
+	"Set-Cookie":        true,
+	"Transfer-Encoding": true,
+}
+
+// Diff compares the response of a replayed request with the captured one and
+// describes the differences. Volatile and redacted headers are not compared,
+// nor the body beyond a truncated capture.
+func (e *HAREntry) Diff(res *http.Response, body []byte) []string {
+	var diff []string
+	if res.StatusCode != e.Response.Status {
+		diff = append(diff, fmt.Sprintf("status %d, was %d", res.StatusCode, e.Response.Status))
+	}
+
+	old := make(http.Header)
+	for _, h := range e.Response.Headers {
+		old.Add(h.Name, h.Value)
+	}
+	names := make(map[string]bool)
+	for name := range old {
+		names[name] = true
+	}
+	for name := range res.Header {
+		names[name] = true
+	}
+	var sorted []string
+	for name := range names {
+		if !volatileHeaders[name] && old.Get(name) != Redacted {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		was, now := strings.Join(old.Values(name), ", "), strings.Join(res.Header.Values(name), ", ")
+		switch {
+		case was == now:
+		case was == "":
+			diff = append(diff, fmt.Sprintf("header %s: %q added", name, now))
+		case now == "":
+			diff = append(diff, fmt.Sprintf("header %s: %q removed", name, was))
+		default:
+			diff = append(diff, fmt.Sprintf("header %s: %q, was %q", name, now, was))
+		}
+	}
+
+	content := e.Response.Content
+	captured, err := decodeBody(content.Text, content.Encoding)
+	if err != nil {
+		return append(diff, fmt.Sprintf("captured body: %v", err))
+	}
+	same := bytes.Equal(body, captured)
+	if content.Truncated {
+		same = bytes.HasPrefix(body, captured) && int64(len(body)) == content.Size
+	}
+	if !same {
+		diff = append(diff, fmt.Sprintf("body of %d bytes differs from byte %d, was %d bytes",
+			len(body), commonPrefix(body, captured), content.Size))
+	}
+	return diff
+}
+
+func commonPrefix(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
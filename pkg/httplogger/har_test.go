@@ -0,0 +1,179 @@
+package httplogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func capture(t *testing.T, opts CaptureOptions, exchanges ...[2]string) *HAR {
+	path := filepath.Join(t.TempDir(), "capture.har")
+	c, err := NewHARCapture(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewConn("office", "web", c)
+	for _, e := range exchanges {
+		conn.Request([]byte(e[0]))
+		conn.Response([]byte(e[1]))
+	}
+	conn.Close()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	har, err := ReadHAR(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return har
+}
+
+func TestHARCapture(t *testing.T) {
+	har := capture(t, CaptureOptions{BodyLimit: 4, Redact: DefaultRedact}, [2]string{
+		"POST /login?next=%2F&a=1 HTTP/1.1\r\nHost: web.lan\r\nAuthorization: Bearer secret\r\nContent-Type: text/plain\r\nContent-Length: 6\r\n\r\nhunter",
+		"HTTP/1.1 302 Found\r\nLocation: /home\r\nset-cookie: id=1\r\nContent-Length: 3\r\n\r\n\xff\xfe\xfd",
+	})
+	if len(har.Log.Entries) != 1 {
+		t.Fatalf("expect one entry, get %d", len(har.Log.Entries))
+	}
+	e := har.Log.Entries[0]
+	if e.Request.URL != "http://web.lan/login?next=%2F&a=1" || e.Peer != "office" || e.Service != "web" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if len(e.Request.QueryString) != 2 || e.Request.QueryString[1] != (HARPair{Name: "next", Value: "/"}) {
+		t.Errorf("unexpected query string %+v", e.Request.QueryString)
+	}
+	for _, h := range append(e.Request.Headers, e.Response.Headers...) {
+		if strings.Contains(h.Value, "secret") || strings.Contains(h.Value, "id=1") {
+			t.Errorf("header %s is not redacted", h.Name)
+		}
+	}
+	if pd := e.Request.PostData; pd == nil || pd.Text != "hunt" || !pd.Truncated || e.Request.BodySize != 6 {
+		t.Errorf("unexpected post data %+v", pd)
+	}
+	if c := e.Response.Content; c.Encoding != "base64" || c.Size != 3 || c.Truncated ||
+		e.Response.Status != 302 || e.Response.RedirectURL != "/home" {
+		t.Errorf("unexpected response %+v", e.Response)
+	}
+}
+
+func TestHARReplay(t *testing.T) {
+	har := capture(t, CaptureOptions{BodyLimit: 1024, Redact: DefaultRedact}, [2]string{
+		"PUT /f HTTP/1.1\r\nHost: web.lan\r\nCookie: c=1\r\nX-Trace: 7\r\nContent-Length: 3\r\n\r\nabc",
+		"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nDate: Mon, 19 Oct 2026 10:00:00 GMT\r\nContent-Length: 2\r\n\r\nok",
+	})
+	e := &har.Log.Entries[0]
+
+	req, err := e.NewRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(req.Body)
+	if req.Method != "PUT" || req.URL.String() != "http://web.lan/f" || string(body) != "abc" {
+		t.Errorf("unexpected request %s %s %q", req.Method, req.URL, body)
+	}
+	if req.Header.Get("Cookie") != "" || req.Header.Get("X-Trace") != "7" {
+		t.Errorf("unexpected headers %v", req.Header)
+	}
+
+	res := &http.Response{StatusCode: 200, Header: http.Header{
+		"Content-Type": {"text/plain"},
+		"Date":         {"Tue, 20 Oct 2026 10:00:00 GMT"},
+	}}
+	if diff := e.Diff(res, []byte("ok")); len(diff) != 0 {
+		t.Errorf("expect no differences, get %q", diff)
+	}
+
+	res = &http.Response{StatusCode: 500, Header: http.Header{"Content-Type": {"text/html"}}}
+	diff := e.Diff(res, []byte("oops"))
+	exp := []string{
+		"status 500, was 200",
+		`header Content-Type: "text/html", was "text/plain"`,
+		"body of 4 bytes differs from byte 1, was 2 bytes",
+	}
+	if strings.Join(diff, "\n") != strings.Join(exp, "\n") {
+		t.Errorf(" Expect: %q\n Get: %q\n", exp, diff)
+	}
+}
+
+func TestHARTruncatedDiff(t *testing.T) {
+	e := &HAREntry{Response: HARResponse{
+		Status:  200,
+		Content: HARContent{Size: 6, Text: "abc", Truncated: true},
+	}}
+	res := &http.Response{StatusCode: 200, Header: http.Header{}}
+	if diff := e.Diff(res, []byte("abcdef")); len(diff) != 0 {
+		t.Errorf("expect no differences beyond the truncated body, get %q", diff)
+	}
+	if diff := e.Diff(res, []byte("abcdefg")); len(diff) != 1 {
+		t.Errorf("expect the size to differ, get %q", diff)
+	}
+	if diff := e.Diff(res, bytes.Repeat([]byte("x"), 6)); len(diff) != 1 {
+		t.Errorf("expect the body to differ, get %q", diff)
+	}
+}
+
+func TestHARCaptureAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.har")
+	c, err := NewHARCapture(path, CaptureOptions{BodyLimit: 16, Creator: HARCreator{Name: "p2ptunnel"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := NewConn("office", "web", c)
+	defer conn.Close()
+
+	// The file is a complete HAR after every exchange, laid out as if it
+	// was written at once.
+	for i := 0; i <= 3; i++ {
+		if i > 0 {
+			conn.Request([]byte("GET /" + strings.Repeat("a", i) + " HTTP/1.1\r\nHost: web.lan\r\n\r\n"))
+			conn.Response([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		har, err := ReadHAR(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("after %d exchanges: %v", i, err)
+		}
+		if len(har.Log.Entries) != i || har.Log.Creator.Name != "p2ptunnel" {
+			t.Fatalf("expect %d entries, get %+v", i, har.Log)
+		}
+		if i > 0 && har.Log.Entries[i-1].Request.URL != "http://web.lan/"+strings.Repeat("a", i) {
+			t.Errorf("unexpected entry %+v", har.Log.Entries[i-1])
+		}
+		exp, _ := json.MarshalIndent(har, "", "  ")
+		if string(b) != string(exp)+"\n" {
+			t.Errorf(" Expect: %s\n Get: %s\n", exp, b)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Exchanges after Close are dropped.
+	c.Exchange(&Exchange{})
+}
+
+func TestHARReplayTruncated(t *testing.T) {
+	e := &HAREntry{Request: HARRequest{
+		Method:   "POST",
+		URL:      "http://web.lan/upload",
+		PostData: &HARPostData{Text: "abc", Truncated: true},
+	}}
+	if _, err := e.NewRequest(); err != ErrTruncatedBody {
+		t.Errorf("expect ErrTruncatedBody, get %v", err)
+	}
+}
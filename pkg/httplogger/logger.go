@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 )
 
 type curState byte
@@ -17,9 +19,19 @@ const (
 )
 
 // HTTPLogger is to parse incoming byte stream and print http request and response header
+//
+// Bodies are skipped by their Content-Length or chunked transfer coding, so the
+// heads of every message on a persistent or pipelined connection are printed.
+// 1xx, 204 and 304 responses have no body, other responses without either end
+// with the connection. A logger follows one direction of a connection, it
+// can't tell that responses to HEAD requests have no body.
 type HTTPLogger struct {
 	logger io.Writer
 	state  curState
+	// head collects the printed head to find the length of its body.
+	head []byte
+	// body skips the body of the current message, nil while printing heads.
+	body *bodyReader
 }
 
 // New creates one logger instance
@@ -33,17 +45,27 @@ func New(l io.Writer) *HTTPLogger {
 // Reset resets the internal state and start new parse
 func (l *HTTPLogger) Reset() {
 	l.state = start
+	l.head = l.head[:0]
+	l.body = nil
 }
 
 // Print parse incoming bytes and print
 func (l *HTTPLogger) Print(buf []byte) {
-	for _, b := range buf {
+	for len(buf) > 0 {
 		if l.state == foundCrLfCrLf {
-			return
+			if !l.skipBody(&buf) {
+				return
+			}
+			continue
+		}
+		b := buf[0]
+		buf = buf[1:]
+		if len(l.head) < maxHeadSize {
+			l.head = append(l.head, b)
 		}
 		if b != '\r' && b != '\n' {
 			fmt.Fprint(l.logger, string(b))
-			l.Reset()
+			l.state = start
 			continue
 		}
 		switch b {
@@ -54,7 +76,7 @@ func (l *HTTPLogger) Print(buf []byte) {
 			case foundCrLf:
 				l.state = foundCrLfCr
 			default:
-				l.Reset()
+				l.state = start
 			}
 		case '\n':
 			switch l.state {
@@ -63,9 +85,56 @@ func (l *HTTPLogger) Print(buf []byte) {
 			case foundCrLfCr:
 				l.state = foundCrLfCrLf
 			default:
-				l.Reset()
+				l.state = start
 			}
 		}
 		fmt.Fprint(l.logger, string(b))
 	}
 }
+
+// skipBody skips the body following a complete head in buf, and returns
+// whether the next message starts. It returns false once the rest of the
+// connection can't be parsed.
+func (l *HTTPLogger) skipBody(buf *[]byte) bool {
+	if l.body == nil {
+		line, hdr := parseHead(l.head)
+		response := strings.HasPrefix(line, "HTTP/")
+		if response {
+			switch status := statusCode(line); {
+			case status == 101:
+				// The connection no longer speaks HTTP after switching protocols.
+				return false
+			case status >= 100 && status < 200, status == 204, status == 304:
+				l.Reset()
+				return true
+			}
+		}
+		length, err := bodyLength(hdr, !response)
+		if err != nil || length == untilClose {
+			return false
+		}
+		l.body = newBodyReader(length)
+	}
+	n, done, err := l.body.consume(*buf, nil)
+	if err != nil {
+		return false
+	}
+	*buf = (*buf)[n:]
+	if done {
+		l.Reset()
+	}
+	return done
+}
+
+// statusCode returns the status code of a status line, 0 if it has none.
+func statusCode(line string) int {
+	f := strings.Fields(line)
+	if len(f) < 2 {
+		return 0
+	}
+	status, err := strconv.Atoi(f[1])
+	if err != nil {
+		return 0
+	}
+	return status
+}
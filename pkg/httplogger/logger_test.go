@@ -110,3 +110,91 @@ func TestLogMultiple(t *testing.T) {
 		t.Errorf(" Expect: %s\n Get: %s\n", string(reply1)+string(reply2), output.String())
 	}
 }
+
+func TestLogPersistent(t *testing.T) {
+	get := "GET / HTTP/1.1\r\nHost: 127.0.0.1:8000\r\n\r\n"
+	post := "POST /form HTTP/1.1\r\nHost: 127.0.0.1:8000\r\nContent-Length: 7\r\n\r\n"
+	ok := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n"
+	chunkedOK := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"
+	chunkedPost := "POST /upload HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n"
+	for _, c := range []struct {
+		name   string
+		stream []string
+		expect string
+	}{
+		{
+			name:   "keep-alive requests",
+			stream: []string{get + get},
+			expect: get + get,
+		},
+		{
+			name:   "request bodies",
+			stream: []string{post + "a=1&b=2" + get},
+			expect: post + get,
+		},
+		{
+			name:   "response bodies",
+			stream: []string{ok + "hello" + ok + "\r\n\r\n!"},
+			expect: ok + ok,
+		},
+		{
+			name:   "chunked response",
+			stream: []string{chunkedOK + "5\r\nhello\r\n7;ext=1\r\n, world\r\n0\r\n\r\n" + ok + "hello"},
+			expect: chunkedOK + ok,
+		},
+		{
+			name:   "chunked request with trailer",
+			stream: []string{chunkedPost + "3\r\nabc\r\n0\r\nChecksum: 12\r\n\r\n" + get},
+			expect: chunkedPost + get,
+		},
+		{
+			name:   "pipelined requests split anywhere",
+			stream: []string{post[:20], post[20:] + "a=1", "&b=2GET / HT", get[8:] + get},
+			expect: post + get + get,
+		},
+		{
+			name:   "chunks split anywhere",
+			stream: []string{chunkedOK + "5\r", "\nhel", "lo\r\n0", "\r\n", "\r\n" + ok},
+			expect: chunkedOK + ok,
+		},
+		{
+			name:   "no content",
+			stream: []string{"HTTP/1.1 204 No Content\r\n\r\n" + ok + "hello"},
+			expect: "HTTP/1.1 204 No Content\r\n\r\n" + ok,
+		},
+		{
+			name:   "not modified with a length",
+			stream: []string{"HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n" + ok + "hello" + ok},
+			expect: "HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n" + ok + ok,
+		},
+		{
+			name:   "continue before the response",
+			stream: []string{"HTTP/1.1 100 Continue\r\n\r\n", ok + "hello" + ok},
+			expect: "HTTP/1.1 100 Continue\r\n\r\n" + ok + ok,
+		},
+		{
+			name:   "switching protocols",
+			stream: []string{"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n\x81\x05hello" + ok},
+			expect: "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n",
+		},
+		{
+			name:   "response until close",
+			stream: []string{"HTTP/1.0 200 OK\r\nConnection: close\r\n\r\nbody" + ok},
+			expect: "HTTP/1.0 200 OK\r\nConnection: close\r\n\r\n",
+		},
+		{
+			name:   "invalid chunk size",
+			stream: []string{chunkedOK + "zz\r\nhello\r\n0\r\n\r\n" + ok},
+			expect: chunkedOK,
+		},
+	} {
+		output := &bytes.Buffer{}
+		l := New(output)
+		for _, s := range c.stream {
+			l.Print([]byte(s))
+		}
+		if output.String() != c.expect {
+			t.Errorf("%s:\n Expect: %q\n Get: %q\n", c.name, c.expect, output.String())
+		}
+	}
+}
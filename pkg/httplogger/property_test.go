@@ -0,0 +1,108 @@
+package httplogger
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// chunks splits data into chunks of the sizes given, each taken modulo 64 and
+// plus one. The rest of data is the last chunk.
+func chunks(data, sizes []byte) [][]byte {
+	var out [][]byte
+	for _, s := range sizes {
+		if len(data) == 0 {
+			break
+		}
+		n := int(s)%64 + 1
+		if n > len(data) {
+			n = len(data)
+		}
+		out = append(out, data[:n])
+		data = data[n:]
+	}
+	if len(data) > 0 {
+		out = append(out, data)
+	}
+	return out
+}
+
+// printChunks returns the output of a logger printing the chunks in turn.
+func printChunks(parts [][]byte) string {
+	out := &bytes.Buffer{}
+	l := New(out)
+	for _, p := range parts {
+		l.Print(p)
+	}
+	return out.String()
+}
+
+// collectSink keeps the exchanges it receives, without their times.
+type collectSink struct {
+	exchanges []Exchange
+}
+
+func (s *collectSink) BodyLimit() int {
+	return 1 << 10
+}
+
+func (s *collectSink) Exchange(e *Exchange) {
+	x := *e
+	x.Time, x.Duration = time.Time{}, 0
+	x.Request.Body = append([]byte(nil), x.Request.Body...)
+	x.Response.Body = append([]byte(nil), x.Response.Body...)
+	s.exchanges = append(s.exchanges, x)
+}
+
+// connExchanges returns the exchanges parsed from the request chunks followed
+// by the response chunks of a connection.
+func connExchanges(req, res [][]byte) []Exchange {
+	s := &collectSink{}
+	c := NewConn("office", "web", s)
+	for _, p := range req {
+		c.Request(p)
+	}
+	for _, p := range res {
+		c.Response(p)
+	}
+	c.Close()
+	return s.exchanges
+}
+
+// sampleRequests and sampleResponses are the messages of a persistent
+// connection, used when checking random splits.
+var (
+	sampleRequests = []byte("GET / HTTP/1.1\r\nHost: web.lan\r\n\r\n" +
+		"POST /upload HTTP/1.1\r\nHost: web.lan\r\nTransfer-Encoding: chunked\r\n\r\n5;ext\r\nhello\r\n0\r\nX-Sum: 1\r\n\r\n" +
+		"\r\nHEAD /big HTTP/1.1\r\nHost: web.lan\r\n\r\n")
+	sampleResponses = []byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello" +
+		"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n")
+)
+
+func TestPrintChunkingProperty(t *testing.T) {
+	data := append(append([]byte(nil), sampleRequests...), sampleResponses...)
+	whole := printChunks([][]byte{data})
+	f := func(sizes []byte) bool {
+		return printChunks(chunks(data, sizes)) == whole
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnLogChunkingProperty(t *testing.T) {
+	whole := connExchanges([][]byte{sampleRequests}, [][]byte{sampleResponses})
+	if len(whole) != 3 {
+		t.Fatalf("expect 3 exchanges, get %d", len(whole))
+	}
+	f := func(reqSizes, resSizes []byte) bool {
+		got := connExchanges(chunks(sampleRequests, reqSizes), chunks(sampleResponses, resSizes))
+		return reflect.DeepEqual(got, whole)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
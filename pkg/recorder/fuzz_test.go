@@ -0,0 +1,44 @@
+//go:build go1.18
+// +build go1.18
+
+package recorder
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// readRecords returns the records of the recording r and the error ending it.
+func readRecords(r io.Reader) ([]*Record, error) {
+	rd, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var records []*Record
+	for {
+		rec, err := rd.Next()
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+func FuzzReader(f *testing.F) {
+	f.Add([]byte(Magic + "O\x02\x01\x02{}I\x04\x01\x05hello"))
+	f.Add([]byte(Magic + "C\x00\x07\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		want, wantErr := readRecords(bytes.NewReader(data))
+		got, err := readRecords(iotest.OneByteReader(bytes.NewReader(data)))
+		if len(got) != len(want) || (err == nil) != (wantErr == nil) {
+			t.Fatalf("reading byte by byte returns %d records and %v, expect %d and %v", len(got), err, len(want), wantErr)
+		}
+		for i := range want {
+			if !bytes.Equal(got[i].Data, want[i].Data) || got[i].Info != want[i].Info {
+				t.Errorf("record %d:\n Expect: %+v\n Get: %+v\n", i, want[i], got[i])
+			}
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// maxRecordSize limits the data of a record read, to fail on corrupt files
+// rather than allocating whatever their lengths claim.
+const maxRecordSize = 64 << 20
+
+// Record is a record read from a recording.
+type Record struct {
+	Kind   Kind
+	Time   time.Time
+	Stream uint64
+	// Info describes the stream, from its open record.
+	Info StreamInfo
+	// Data holds the bytes of KindIn and KindOut records.
+	Data []byte
+}
+
+// Reader reads the records of a recording.
+type Reader struct {
+	r    *bufio.Reader
+	info map[uint64]StreamInfo
+}
+
+// NewReader returns a Reader of the recording r, which has to start with
+// Magic.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != Magic {
+		return nil, fmt.Errorf("not a p2ptunnel recording")
+	}
+	return &Reader{r: br, info: make(map[uint64]StreamInfo)}, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the recording. A
+// recording cut off in the middle of a record, as by a crash, ends with
+// io.ErrUnexpectedEOF.
+func (r *Reader) Next() (*Record, error) {
+	kind, err := r.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	ns, err := binary.ReadVarint(r.r)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	stream, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	if n > maxRecordSize {
+		return nil, fmt.Errorf("record of %d bytes is too large", n)
+	}
+	// Read rather than allocate the claimed length, which may be corrupt.
+	data, err := io.ReadAll(io.LimitReader(r.r, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	rec := &Record{Kind: Kind(kind), Time: time.Unix(0, ns), Stream: stream}
+	switch rec.Kind {
+	case KindOpen:
+		var info StreamInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			return nil, fmt.Errorf("stream %d: %v", stream, err)
+		}
+		r.info[stream] = info
+		rec.Info = info
+	case KindIn, KindOut:
+		rec.Info = r.info[stream]
+		rec.Data = data
+	case KindClose:
+		rec.Info = r.info[stream]
+		delete(r.info, stream)
+	default:
+		return nil, fmt.Errorf("unknown record kind %q", kind)
+	}
+	return rec, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,305 @@
+// Package recorder records the bytes passing through tunnels to rotating files,
+// whatever protocol they carry, and reads the recordings back.
+//
+// A recording starts with Magic, followed by records of
+//
+//	kind (1 byte) | time (varint, Unix nanoseconds) | stream (uvarint) | length (uvarint) | data
+//
+// The data of KindOpen records is the JSON encoded StreamInfo of the stream.
+// Every file starts with the open records of the streams still open when it
+// was created, so that rotated files can be read on their own.
+package recorder
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Magic starts every recording.
+const Magic = "P2PTREC\x01"
+
+// Kind is the kind of a record.
+type Kind byte
+
+// Record kinds.
+const (
+	// KindOpen starts a stream.
+	KindOpen Kind = 'O'
+	// KindIn holds bytes received from the peer.
+	KindIn Kind = 'I'
+	// KindOut holds bytes sent to the peer.
+	KindOut Kind = 'U'
+	// KindClose ends a stream.
+	KindClose Kind = 'C'
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindOpen:
+		return "open"
+	case KindIn:
+		return "in"
+	case KindOut:
+		return "out"
+	case KindClose:
+		return "close"
+	}
+	return fmt.Sprintf("Kind(%d)", byte(k))
+}
+
+// StreamInfo describes a recorded stream.
+type StreamInfo struct {
+	Peer    string `json:"peer"`
+	Service string `json:"service"`
+	// Direction is "in" for tunnels opened by the peer, "out" for our own.
+	Direction string `json:"direction"`
+}
+
+// Options configures the rotation of a Recorder.
+type Options struct {
+	// MaxSize is the size in bytes after which the file is rotated, 0 never
+	// rotates.
+	MaxSize int64
+	// MaxFiles is the number of rotated files kept next to the current one,
+	// named after it with the suffixes .1 (the newest) to .MaxFiles.
+	MaxFiles int
+	// OnError is called with the error which stopped the recording, if any.
+	OnError func(err error)
+}
+
+// Recorder writes the recordings of streams to a file. It is safe for
+// concurrent use.
+type Recorder struct {
+	path string
+	opts Options
+
+	lock sync.Mutex
+	// f is nil once the recorder is closed or failed.
+	f    *os.File
+	size int64
+	next uint64
+	open map[uint64]StreamInfo
+	buf  []byte
+	err  error
+}
+
+// New creates a Recorder appending to the file at path, which is created if
+// it doesn't exist. Streams are numbered on from the highest stream of the
+// recording appended to, so that the streams of different runs stay apart.
+func New(path string, opts Options) (*Recorder, error) {
+	r := &Recorder{path: path, opts: opts, open: make(map[uint64]StreamInfo)}
+	// A new file only has the streams open when it was rotated, the others
+	// of the last run are in the previous one.
+	for _, p := range []string{path, path + ".1"} {
+		last, err := lastStream(p)
+		if err != nil {
+			return nil, err
+		}
+		if last > r.next {
+			r.next = last
+		}
+	}
+	if err := r.openFile(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// lastStream returns the highest stream recorded in the file at path, 0 if
+// there is no such file. A recording cut off by a crash counts up to there.
+func lastStream(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || fi.Size() == 0 {
+		return 0, err
+	}
+	rd, err := NewReader(f)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", path, err)
+	}
+	var last uint64
+	for {
+		rec, err := rd.Next()
+		if err != nil {
+			return last, nil
+		}
+		if rec.Stream > last {
+			last = rec.Stream
+		}
+	}
+}
+
+// openFile opens the file at path for appending, writing Magic to new files.
+func (r *Recorder) openFile() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	size := fi.Size()
+	if size == 0 {
+		if _, err := f.WriteString(Magic); err != nil {
+			f.Close()
+			return err
+		}
+		size = int64(len(Magic))
+	}
+	r.f, r.size = f, size
+	return nil
+}
+
+// Stream starts the recording of a stream. A nil Recorder returns a nil
+// Stream, which records nothing.
+func (r *Recorder) Stream(info StreamInfo) *Stream {
+	if r == nil {
+		return nil
+	}
+	data, _ := json.Marshal(info)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.next++
+	r.open[r.next] = info
+	r.write(KindOpen, r.next, data)
+	return &Stream{r: r, id: r.next}
+}
+
+// Close closes the file, and returns the error which stopped the recording
+// before if any.
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.f == nil {
+		return r.err
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// write appends a record, rotating the file first if it grew too large.
+// Recording is best effort: the first error stops it rather than failing
+// tunnels, and is passed to OnError.
+func (r *Recorder) write(kind Kind, stream uint64, data []byte) {
+	if r.f == nil {
+		return
+	}
+	if r.opts.MaxSize > 0 && r.size >= r.opts.MaxSize {
+		if err := r.rotate(); err != nil {
+			r.fail(fmt.Errorf("rotate %s: %v", r.path, err))
+			return
+		}
+	}
+	if err := r.put(kind, stream, data); err != nil {
+		r.fail(err)
+	}
+}
+
+// fail stops the recording after err.
+func (r *Recorder) fail(err error) {
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+	r.err = err
+	if r.opts.OnError != nil {
+		r.opts.OnError(err)
+	}
+}
+
+// put appends a record to the file.
+func (r *Recorder) put(kind Kind, stream uint64, data []byte) error {
+	var v [binary.MaxVarintLen64]byte
+	b := append(r.buf[:0], byte(kind))
+	b = append(b, v[:binary.PutVarint(v[:], time.Now().UnixNano())]...)
+	b = append(b, v[:binary.PutUvarint(v[:], stream)]...)
+	b = append(b, v[:binary.PutUvarint(v[:], uint64(len(data)))]...)
+	b = append(b, data...)
+	r.buf = b
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return err
+}
+
+// rotate shifts the rotated files, moves the current file to .1 and starts a
+// new one with the open records of the open streams. The current file is
+// closed either way.
+func (r *Recorder) rotate() error {
+	err := r.f.Close()
+	r.f = nil
+	if err != nil {
+		return err
+	}
+	if r.opts.MaxFiles > 0 {
+		for i := r.opts.MaxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	if err := r.openFile(); err != nil {
+		return err
+	}
+	for id, info := range r.open {
+		data, _ := json.Marshal(info)
+		if err := r.put(KindOpen, id, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stream records one stream. A nil Stream ignores all calls.
+type Stream struct {
+	r  *Recorder
+	id uint64
+}
+
+// In records bytes received from the peer.
+func (s *Stream) In(b []byte) {
+	s.record(KindIn, b)
+}
+
+// Out records bytes sent to the peer.
+func (s *Stream) Out(b []byte) {
+	s.record(KindOut, b)
+}
+
+// Close records the end of the stream.
+func (s *Stream) Close() {
+	if s == nil {
+		return
+	}
+	s.r.lock.Lock()
+	defer s.r.lock.Unlock()
+	if _, ok := s.r.open[s.id]; !ok {
+		return
+	}
+	delete(s.r.open, s.id)
+	s.r.write(KindClose, s.id, nil)
+}
+
+func (s *Stream) record(kind Kind, b []byte) {
+	if s == nil || len(b) == 0 {
+		return
+	}
+	s.r.lock.Lock()
+	defer s.r.lock.Unlock()
+	s.r.write(kind, s.id, b)
+}
@@ -0,0 +1,251 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// readAll returns the records of the recording at path.
+func readAll(t *testing.T, path string) []*Record {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []*Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnels.rec")
+	r, err := New(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssh := r.Stream(StreamInfo{Peer: "laptop", Service: "ssh", Direction: "in"})
+	db := r.Stream(StreamInfo{Peer: "office", Service: "db", Direction: "out"})
+	ssh.In([]byte("SSH-2.0-OpenSSH_8.9\r\n"))
+	db.Out([]byte{0, 0, 0, 8, 4, 210, 22, 47})
+	ssh.Out([]byte("SSH-2.0-OpenSSH_9.0\r\n"))
+	ssh.Out(nil)
+	ssh.Close()
+	ssh.Close()
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	type rec struct {
+		kind    Kind
+		stream  uint64
+		service string
+		data    string
+	}
+	exp := []rec{
+		{KindOpen, 1, "ssh", ""},
+		{KindOpen, 2, "db", ""},
+		{KindIn, 1, "ssh", "SSH-2.0-OpenSSH_8.9\r\n"},
+		{KindOut, 2, "db", "\x00\x00\x00\x08\x04\xd2\x16\x2f"},
+		{KindOut, 1, "ssh", "SSH-2.0-OpenSSH_9.0\r\n"},
+		{KindClose, 1, "ssh", ""},
+	}
+	got := readAll(t, path)
+	if len(got) != len(exp) {
+		t.Fatalf("expect %d records, get %d", len(exp), len(got))
+	}
+	for i, e := range exp {
+		g := rec{got[i].Kind, got[i].Stream, got[i].Info.Service, string(got[i].Data)}
+		if g != e {
+			t.Errorf("record %d:\n Expect: %+v\n Get: %+v\n", i, e, g)
+		}
+		if i > 0 && got[i].Time.Before(got[i-1].Time) {
+			t.Errorf("record %d is older than the one before", i)
+		}
+	}
+
+	var nilRecorder *Recorder
+	s := nilRecorder.Stream(StreamInfo{})
+	s.In([]byte("ignored"))
+	s.Close()
+}
+
+func TestRecordRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnels.rec")
+	r, err := New(path, Options{MaxSize: 100, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	s := r.Stream(StreamInfo{Peer: "laptop", Service: "ssh"})
+	chunk := bytes.Repeat([]byte("x"), 60)
+	for i := 0; i < 5; i++ {
+		s.In(chunk)
+	}
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		records := readAll(t, p)
+		// Each file starts with the open record of the stream.
+		if len(records) == 0 || records[0].Kind != KindOpen || records[0].Info.Peer != "laptop" {
+			t.Errorf("%s doesn't start with the open stream", filepath.Base(p))
+		}
+		for _, rec := range records[1:] {
+			if rec.Kind != KindIn || rec.Info.Service != "ssh" {
+				t.Errorf("%s: unexpected record %+v", filepath.Base(p), rec)
+			}
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expect at most 2 rotated files, get %v", err)
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnels.rec")
+	r, err := New(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Stream(StreamInfo{Peer: "laptop"}).In([]byte("hello"))
+	r.Close()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd, err := NewReader(bytes.NewReader(b[:len(b)-2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rd.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rd.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expect io.ErrUnexpectedEOF, get %v", err)
+	}
+
+	if _, err := NewReader(bytes.NewReader([]byte("GET / HTTP/1.1"))); err == nil {
+		t.Error("expect error reading a file which isn't a recording")
+	}
+}
+
+func TestReadCorruptLength(t *testing.T) {
+	// A record claiming the largest allowed length, with little data after.
+	b := append([]byte(Magic), byte(KindIn))
+	v := make([]byte, binary.MaxVarintLen64)
+	b = append(b, v[:binary.PutVarint(v, 1)]...)
+	b = append(b, v[:binary.PutUvarint(v, 1)]...)
+	b = append(b, v[:binary.PutUvarint(v, maxRecordSize)]...)
+	b = append(b, "hello"...)
+	rd, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = rd.Next()
+	runtime.ReadMemStats(&after)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expect io.ErrUnexpectedEOF, get %v", err)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > maxRecordSize/2 {
+		t.Errorf("expect the claimed length not to be allocated, allocated %d bytes", alloc)
+	}
+}
+
+func TestRecordAppendKeepsStreamsApart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnels.rec")
+	run := func(opts Options, streams int) {
+		r, err := New(path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < streams; i++ {
+			s := r.Stream(StreamInfo{Peer: "laptop", Service: "ssh"})
+			s.In([]byte("hello"))
+			s.Close()
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(Options{}, 2)
+	run(Options{}, 2)
+	var ids []uint64
+	for _, rec := range readAll(t, path) {
+		if rec.Kind == KindOpen {
+			ids = append(ids, rec.Stream)
+		}
+	}
+	if len(ids) != 4 || ids[0] != 1 || ids[1] != 2 || ids[2] != 3 || ids[3] != 4 {
+		t.Errorf("expect streams 1 to 4, get %v", ids)
+	}
+
+	// The streams of the last run may all be in the rotated file.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	run(Options{MaxFiles: 1}, 1)
+	if records := readAll(t, path); len(records) == 0 || records[0].Stream != 5 {
+		t.Errorf("expect stream 5 after the rotated file, get %+v", records)
+	}
+
+	if err := os.WriteFile(path, []byte("not a recording"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(path, Options{}); err == nil {
+		t.Error("expect error appending to a file which isn't a recording")
+	}
+}
+
+func TestRecordRotationFails(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tunnels.rec")
+	var errs []error
+	r, err := New(path, Options{MaxSize: 100, MaxFiles: 1, OnError: func(err error) { errs = append(errs, err) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The rotated file can't replace a directory.
+	if err := os.Mkdir(path+".1", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path+".1", "keep"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := r.Stream(StreamInfo{Peer: "laptop", Service: "ssh"})
+	chunk := bytes.Repeat([]byte("x"), 60)
+	for i := 0; i < 4; i++ {
+		s.In(chunk)
+	}
+	s.Close()
+	if len(errs) != 1 {
+		t.Fatalf("expect the rotation error reported once, get %v", errs)
+	}
+	if err := r.Close(); err == nil || err != errs[0] {
+		t.Errorf("expect Close to return the rotation error, get %v", err)
+	}
+	// Streams started after the failure record nothing.
+	r.Stream(StreamInfo{Peer: "laptop"}).In(chunk)
+	// The open record and the first chunk fit before the rotation.
+	if records := readAll(t, path); len(records) != 2 {
+		t.Errorf("expect the 2 records before the failed rotation, get %d", len(records))
+	}
+}
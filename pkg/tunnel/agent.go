@@ -0,0 +1,229 @@
+package tunnel
+
+import (
+	"fmt"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// listenBacklog is the number of tunnels a Listener queues until they are
+// accepted. Further tunnels are refused.
+const listenBacklog = 16
+
+// handshakeTimeout bounds the time a peer has to send its Request.
+var handshakeTimeout = 10 * time.Second
+
+// Options configure an Agent or a Connector.
+type Options struct {
+	// Host is the libp2p host tunnels are opened and accepted on.
+	Host host.Host
+	// Peers names the remote peers. Agents reset streams of any other peer,
+	// connectors dial peers by these names.
+	Peers map[string]peer.ID
+	// Authorize is asked by the agent whether the named peer may open a
+	// tunnel for req. Its error is sent to the peer as the reason of the
+	// refusal. Every request of a known peer is allowed when nil.
+	Authorize func(name string, req Request) error
+	// Routing looks up the addresses of peers the host knows none of, e.g.
+	// the DHT. Only the addresses in the peerstore are dialed when nil.
+	Routing routing.PeerRouting
+}
+
+// Agent accepts tunnels of its peers and hands them to the Listener of the
+// requested service.
+type Agent struct {
+	opts  Options
+	names map[peer.ID]string
+
+	lock      sync.Mutex
+	listeners map[string]*listener
+}
+
+// NewAgent handles the tunnel protocol on opts.Host until the Agent is closed.
+func NewAgent(opts Options) (*Agent, error) {
+	if opts.Host == nil {
+		return nil, errors.New("tunnel: no host")
+	}
+	a := &Agent{
+		opts:      opts,
+		names:     make(map[peer.ID]string, len(opts.Peers)),
+		listeners: make(map[string]*listener),
+	}
+	for name, id := range opts.Peers {
+		a.names[id] = name
+	}
+	opts.Host.SetStreamHandler(Protocol, a.handleStream)
+	return a, nil
+}
+
+// Listen returns a listener accepting the tunnels to service. Each service can
+// have one listener at a time.
+func (a *Agent) Listen(service string) (net.Listener, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.listeners == nil {
+		return nil, net.ErrClosed
+	}
+	if _, ok := a.listeners[service]; ok {
+		return nil, errors.Errorf("tunnel: service %q is already listened on", service)
+	}
+	l := &listener{
+		agent:   a,
+		service: service,
+		conns:   make(chan *conn, listenBacklog),
+		done:    make(chan struct{}),
+	}
+	a.listeners[service] = l
+	return l, nil
+}
+
+// Close stops handling the tunnel protocol and closes all listeners.
+func (a *Agent) Close() error {
+	a.opts.Host.RemoveStreamHandler(Protocol)
+	a.lock.Lock()
+	listeners := a.listeners
+	a.listeners = nil
+	a.lock.Unlock()
+	for _, l := range listeners {
+		l.close()
+	}
+	return nil
+}
+
+func (a *Agent) handleStream(s network.Stream) {
+	name, ok := a.names[s.Conn().RemotePeer()]
+	if !ok {
+		_ = s.Reset()
+		return
+	}
+
+	req, err := ReceiveRequest(s)
+	if err != nil {
+		_ = s.Reset()
+		return
+	}
+
+	if a.opts.Authorize != nil {
+		if err := a.opts.Authorize(name, req); err != nil {
+			refuse(s, err.Error())
+			return
+		}
+	}
+
+	a.lock.Lock()
+	l := a.listeners[req.Service]
+	a.lock.Unlock()
+	if l == nil {
+		refuse(s, fmt.Sprintf("unknown service %q", req.Service))
+		return
+	}
+	if reason := l.queue(newConn(s, req.Service)); reason != "" {
+		refuse(s, reason)
+	}
+}
+
+// ReceiveRequest reads the Request starting the tunnel stream s, as the agent
+// does before answering it with WriteResponse. A peer which doesn't send its
+// request within a few seconds gets an error, so it can't hold on to the
+// stream.
+func ReceiveRequest(s network.Stream) (Request, error) {
+	if err := s.SetReadDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return Request{}, err
+	}
+	req, err := ReadRequest(s)
+	if err != nil {
+		return Request{}, err
+	}
+	return req, s.SetReadDeadline(time.Time{})
+}
+
+// refuse denies the request of s for reason and closes it.
+func refuse(s network.Stream, reason string) {
+	if err := WriteResponse(s, reason); err != nil {
+		_ = s.Reset()
+		return
+	}
+	_ = s.Close()
+}
+
+// listener queues the tunnels of one service until they are accepted. The
+// tunnel is only accepted towards the connector by Accept, so nothing is sent
+// before the response.
+type listener struct {
+	agent   *Agent
+	service string
+	conns   chan *conn
+	done    chan struct{}
+
+	lock   sync.Mutex
+	closed bool
+}
+
+// queue adds c to the tunnels waiting to be accepted, or returns the reason
+// it can't.
+func (l *listener) queue(c *conn) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return "service unavailable"
+	}
+	select {
+	case l.conns <- c:
+		return ""
+	default:
+		return "service busy"
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		select {
+		case <-l.done:
+			return nil, net.ErrClosed
+		case c := <-l.conns:
+			if err := WriteResponse(c.stream, ""); err != nil {
+				_ = c.stream.Reset()
+				continue
+			}
+			return c, nil
+		}
+	}
+}
+
+func (l *listener) Close() error {
+	l.agent.lock.Lock()
+	if l.agent.listeners[l.service] == l {
+		delete(l.agent.listeners, l.service)
+	}
+	l.agent.lock.Unlock()
+	l.close()
+	return nil
+}
+
+func (l *listener) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	close(l.done)
+	for {
+		select {
+		case c := <-l.conns:
+			refuse(c.stream, "service unavailable")
+		default:
+			return
+		}
+	}
+}
+
+func (l *listener) Addr() net.Addr {
+	return &Addr{Peer: l.agent.opts.Host.ID(), Service: l.service}
+}
@@ -0,0 +1,139 @@
+package tunnel
+
+import (
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Network is the network name of tunnel addresses.
+const Network = "p2ptunnel"
+
+// Addr is the address of one end of a tunnel.
+type Addr struct {
+	Peer peer.ID
+	// Service is the service the tunnel was opened for.
+	Service string
+	// Multiaddr is the transport address of the peer's connection, nil for
+	// listeners.
+	Multiaddr ma.Multiaddr
+}
+
+// Network returns Network.
+func (a *Addr) Network() string {
+	return Network
+}
+
+// String returns the peer ID and the service, e.g. 12D3KooW.../web.
+func (a *Addr) String() string {
+	return a.Peer.Pretty() + "/" + a.Service
+}
+
+// conn is a tunnel stream used as a net.Conn. Besides the net.Conn methods it
+// has CloseWrite and CloseRead for half closing the tunnel, as net.TCPConn.
+//
+// Deadlines are passed on to the stream, which only checks them while
+// blocked. conn also fails reads and writes once their deadline passed, and
+// reports timeouts as os.ErrDeadlineExceeded like the net package does.
+type conn struct {
+	stream        network.Stream
+	local, remote *Addr
+	// writeLock keeps concurrent writes from interleaving, which the stream
+	// muxers don't guarantee once a write times out halfway.
+	writeLock sync.Mutex
+
+	lock                        sync.Mutex
+	readDeadline, writeDeadline time.Time
+}
+
+func newConn(s network.Stream, service string) *conn {
+	c := s.Conn()
+	return &conn{
+		stream: s,
+		local:  &Addr{Peer: c.LocalPeer(), Service: service, Multiaddr: c.LocalMultiaddr()},
+		remote: &Addr{Peer: c.RemotePeer(), Service: service, Multiaddr: c.RemoteMultiaddr()},
+	}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if c.expired(&c.readDeadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, err := c.stream.Read(b)
+	return n, mapTimeout(err)
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if c.expired(&c.writeDeadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	n, err := c.stream.Write(b)
+	return n, mapTimeout(err)
+}
+
+// Close closes both directions of the tunnel.
+func (c *conn) Close() error {
+	return c.stream.Close()
+}
+
+// CloseWrite closes the tunnel for writing, the peer reads io.EOF once it
+// received everything written before.
+func (c *conn) CloseWrite() error {
+	return c.stream.CloseWrite()
+}
+
+// CloseRead closes the tunnel for reading, interrupting pending reads.
+func (c *conn) CloseRead() error {
+	return c.stream.CloseRead()
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.lock.Unlock()
+	return c.stream.SetDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline = t
+	c.lock.Unlock()
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.writeDeadline = t
+	c.lock.Unlock()
+	return c.stream.SetWriteDeadline(t)
+}
+
+// expired reports whether the deadline is set and has passed.
+func (c *conn) expired(deadline *time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return !deadline.IsZero() && !time.Now().Before(*deadline)
+}
+
+// mapTimeout replaces the timeout errors of the stream muxers with
+// os.ErrDeadlineExceeded.
+func mapTimeout(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
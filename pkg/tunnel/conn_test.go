@@ -0,0 +1,152 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/net/nettest"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// dialPipe opens a tunnel and returns both of its ends.
+func dialPipe(t *testing.T) (dialed, accepted net.Conn, stop func(), err error) {
+	a, c := pair(t, nil)
+	l, err := a.Listen("pipe")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		accepted, err = l.Accept()
+		done <- err
+	}()
+	dialed, err = c.Dial(ctx, "agent", "pipe")
+	if err != nil {
+		l.Close()
+		return nil, nil, nil, err
+	}
+	if err := <-done; err != nil {
+		dialed.Close()
+		return nil, nil, nil, err
+	}
+	stop = func() {
+		dialed.Close()
+		accepted.Close()
+		l.Close()
+	}
+	return dialed, accepted, stop, nil
+}
+
+func TestConn(t *testing.T) {
+	nettest.TestConn(t, func() (net.Conn, net.Conn, func(), error) {
+		return dialPipe(t)
+	})
+}
+
+func TestConnAddrs(t *testing.T) {
+	dialed, accepted, stop, err := dialPipe(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	if dialed.LocalAddr().String() != accepted.RemoteAddr().String() {
+		t.Errorf("dialed local %s != accepted remote %s", dialed.LocalAddr(), accepted.RemoteAddr())
+	}
+	if dialed.RemoteAddr().String() != accepted.LocalAddr().String() {
+		t.Errorf("dialed remote %s != accepted local %s", dialed.RemoteAddr(), accepted.LocalAddr())
+	}
+	addr := dialed.RemoteAddr().(*Addr)
+	if addr.Network() != Network || addr.Service != "pipe" {
+		t.Errorf("unexpected address %s of network %s", addr, addr.Network())
+	}
+	if addr.Multiaddr == nil {
+		t.Error("expect the transport address of the peer")
+	}
+}
+
+func TestConnCloseWrite(t *testing.T) {
+	dialed, accepted, stop, err := dialPipe(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	if _, err := dialed.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialed.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(accepted)
+	if err != nil || string(data) != "ping" {
+		t.Fatalf("read until EOF: %q, %v", data, err)
+	}
+	// The other direction is still open after a half close.
+	if _, err := accepted.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if err := accepted.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	data, err = io.ReadAll(dialed)
+	if err != nil || string(data) != "pong" {
+		t.Fatalf("read until EOF: %q, %v", data, err)
+	}
+}
+
+func TestConnCloseRead(t *testing.T) {
+	dialed, _, stop, err := dialPipe(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	if err := dialed.(interface{ CloseRead() error }).CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialed.Read(make([]byte, 1)); err == nil {
+		t.Error("expect error reading after CloseRead")
+	}
+}
+
+func TestHTTPOverTunnel(t *testing.T) {
+	a, c := pair(t, nil)
+	l, err := a.Listen("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.RemoteAddr)
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return c.Dial(ctx, "agent", "web")
+		},
+	}}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get("http://office/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "hello " + (&Addr{Peer: c.opts.Host.ID(), Service: "web"}).String()
+		if string(body) != want {
+			t.Errorf(" Expect: %s\n Get: %s\n", want, body)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/pkg/errors"
+	"net"
+	"time"
+)
+
+// Connector opens tunnels to the services of its peers.
+type Connector struct {
+	opts Options
+}
+
+// NewConnector returns a Connector opening tunnels from opts.Host.
+func NewConnector(opts Options) (*Connector, error) {
+	if opts.Host == nil {
+		return nil, errors.New("tunnel: no host")
+	}
+	return &Connector{opts: opts}, nil
+}
+
+// Dial opens a tunnel to service of the named peer.
+func (c *Connector) Dial(ctx context.Context, peerName, service string) (net.Conn, error) {
+	return c.DialRequest(ctx, peerName, Request{Service: service})
+}
+
+// DialRequest opens a tunnel to the named peer with req, which also carries the
+// destination of proxy services.
+func (c *Connector) DialRequest(ctx context.Context, peerName string, req Request) (net.Conn, error) {
+	id, ok := c.opts.Peers[peerName]
+	if !ok {
+		return nil, errors.Errorf("tunnel: unknown peer %s", peerName)
+	}
+	if req.Service == "" {
+		req.Service = DefaultService
+	}
+	if err := c.findPeer(ctx, id); err != nil {
+		return nil, errors.Wrapf(err, "find peer %s", peerName)
+	}
+
+	s, err := c.opts.Host.NewStream(ctx, id, Protocol)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open stream to %s", peerName)
+	}
+	if err := SendRequest(ctx, s, req); err != nil {
+		return nil, err
+	}
+	return newConn(s, req.Service), nil
+}
+
+// SendRequest asks the agent at the other end of the new tunnel stream s for
+// req and waits for the answer, until the deadline of ctx if it has one. The
+// stream is reset if the agent refuses, and the refusal returned as a
+// *RefusedError.
+func SendRequest(ctx context.Context, s network.Stream, req Request) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+	if err := WriteRequest(s, req); err != nil {
+		_ = s.Reset()
+		return err
+	}
+	if err := ReadResponse(s); err != nil {
+		_ = s.Reset()
+		return err
+	}
+	return s.SetDeadline(time.Time{})
+}
+
+// findPeer looks up the addresses of id with the router, unless the host is
+// connected to it or knows its addresses already.
+func (c *Connector) findPeer(ctx context.Context, id peer.ID) error {
+	h := c.opts.Host
+	if c.opts.Routing == nil || h.Network().Connectedness(id) == network.Connected || len(h.Peerstore().Addrs(id)) > 0 {
+		return nil
+	}
+	info, err := c.opts.Routing.FindPeer(ctx, id)
+	if err != nil {
+		return err
+	}
+	h.Peerstore().AddAddrs(id, info.Addrs, peerstore.TempAddrTTL)
+	return nil
+}
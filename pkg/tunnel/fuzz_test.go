@@ -0,0 +1,79 @@
+//go:build go1.18
+// +build go1.18
+
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add([]byte{3, 0, 's', 's', 'h'})
+	f.Add([]byte{0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkReads(t, data, func(r io.Reader) (interface{}, error) {
+			return ReadFrame(r)
+		})
+		payload, err := ReadFrame(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		buf := &bytes.Buffer{}
+		if err := WriteFrame(buf, payload); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, buf.Bytes()) {
+			t.Errorf("frame %x doesn't start %x", buf.Bytes(), data)
+		}
+	})
+}
+
+func FuzzReadRequest(f *testing.F) {
+	f.Add([]byte("\x03\x00lan\x0b\x00web.lan:443"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkReads(t, data, readRequest)
+		req, err := ReadRequest(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		buf := &bytes.Buffer{}
+		if err := WriteRequest(buf, req); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, buf.Bytes()) {
+			t.Errorf("request %x doesn't start %x", buf.Bytes(), data)
+		}
+	})
+}
+
+func FuzzRequestRoundTrip(f *testing.F) {
+	f.Add("lan", "web.lan:443")
+	f.Add("", "")
+	f.Fuzz(func(t *testing.T, service, dest string) {
+		req := Request{Service: service, Dest: dest}
+		buf := &bytes.Buffer{}
+		if err := WriteRequest(buf, req); err != nil {
+			if len(service) <= MaxFrameSize && len(dest) <= MaxFrameSize {
+				t.Fatal(err)
+			}
+			return
+		}
+		got, err := ReadRequest(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != req || buf.Len() != 0 {
+			t.Errorf(" Expect: %+v\n Get: %+v, %d bytes left\n", req, got, buf.Len())
+		}
+	})
+}
+
+func FuzzReadResponse(f *testing.F) {
+	f.Add([]byte{0, 0})
+	f.Add([]byte("\x0f\x00unknown service"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkReads(t, data, readResponse)
+	})
+}
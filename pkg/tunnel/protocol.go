@@ -0,0 +1,101 @@
+// Package tunnel opens and accepts p2ptunnel tunnels over libp2p streams, so
+// Go programs can embed the agent and connector sides of p2ptunnel.
+package tunnel
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// Protocol is the libp2p protocol of tunnel streams. Streams start with a
+// Request naming the service, answered by the agent before any data.
+const Protocol = "/p2ptunnel/0.1.0"
+
+// DefaultService is the service asked for when none is named.
+const DefaultService = "default"
+
+// MaxFrameSize is the largest payload a handshake frame can carry.
+const MaxFrameSize = 1<<16 - 1
+
+// Request is sent by the connector right after opening a stream to tell the
+// agent which service it wants to reach.
+type Request struct {
+	Service string
+	// Dest is the destination address asked for on proxy services.
+	Dest string
+}
+
+// RefusedError is returned when the agent denies a Request.
+type RefusedError struct {
+	Reason string
+}
+
+func (e *RefusedError) Error() string {
+	return "refused by agent: " + e.Reason
+}
+
+// WriteFrame writes payload prefixed by its size as a little endian uint16.
+func WriteFrame(w io.Writer, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return errors.Errorf("frame of %d bytes is too large", len(payload))
+	}
+	frame := make([]byte, 2+len(payload))
+	binary.LittleEndian.PutUint16(frame, uint16(len(payload)))
+	copy(frame[2:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads one frame written by WriteFrame.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// WriteRequest writes req as two frames, the service and the destination.
+func WriteRequest(w io.Writer, req Request) error {
+	if err := WriteFrame(w, []byte(req.Service)); err != nil {
+		return err
+	}
+	return WriteFrame(w, []byte(req.Dest))
+}
+
+// ReadRequest reads a Request written by WriteRequest.
+func ReadRequest(r io.Reader) (Request, error) {
+	service, err := ReadFrame(r)
+	if err != nil {
+		return Request{}, err
+	}
+	dest, err := ReadFrame(r)
+	if err != nil {
+		return Request{}, err
+	}
+	return Request{Service: string(service), Dest: string(dest)}, nil
+}
+
+// WriteResponse answers a Request. An empty reason accepts the request,
+// anything else is the reason it was denied.
+func WriteResponse(w io.Writer, reason string) error {
+	return WriteFrame(w, []byte(reason))
+}
+
+// ReadResponse returns a *RefusedError carrying the agent's reason if the
+// request was denied.
+func ReadResponse(r io.Reader) error {
+	reason, err := ReadFrame(r)
+	if err != nil {
+		return errors.Wrap(err, "read agent response")
+	}
+	if len(reason) > 0 {
+		return &RefusedError{Reason: string(reason)}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+	"testing/quick"
+)
+
+// readers returns readers of data which return it at once, one byte at a time
+// and half of each read.
+func readers(data []byte) map[string]io.Reader {
+	return map[string]io.Reader{
+		"whole":   bytes.NewReader(data),
+		"one":     iotest.OneByteReader(bytes.NewReader(data)),
+		"half":    iotest.HalfReader(bytes.NewReader(data)),
+		"dataerr": iotest.DataErrReader(bytes.NewReader(data)),
+	}
+}
+
+// checkReads calls read with every reader of data, and fails if the results
+// differ.
+func checkReads(t *testing.T, data []byte, read func(io.Reader) (interface{}, error)) {
+	want, wantErr := read(bytes.NewReader(data))
+	for name, r := range readers(data) {
+		got, err := read(r)
+		if (err == nil) != (wantErr == nil) || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s reader:\n Expect: %v, %v\n Get: %v, %v\n", name, want, wantErr, got, err)
+		}
+	}
+}
+
+func readRequest(r io.Reader) (interface{}, error) {
+	return ReadRequest(r)
+}
+
+func readResponse(r io.Reader) (interface{}, error) {
+	err := ReadResponse(r)
+	if refused, ok := err.(*RefusedError); ok {
+		return refused.Reason, nil
+	}
+	return nil, err
+}
+
+func TestRequestSplitProperty(t *testing.T) {
+	f := func(service, dest string) bool {
+		buf := &bytes.Buffer{}
+		req := Request{Service: service, Dest: dest}
+		if err := WriteRequest(buf, req); err != nil {
+			return false
+		}
+		for _, r := range readers(buf.Bytes()) {
+			if got, err := ReadRequest(r); err != nil || got != req {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseSplitProperty(t *testing.T) {
+	f := func(reason string) bool {
+		buf := &bytes.Buffer{}
+		if err := WriteResponse(buf, reason); err != nil {
+			return false
+		}
+		for _, r := range readers(buf.Bytes()) {
+			got, err := readResponse(r)
+			if err != nil || (reason != "" && got != reason) || (reason == "" && got != nil) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadTruncatedRequest(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := WriteRequest(buf, Request{Service: "lan", Dest: "web.lan:443"}); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	for i := 0; i < len(b); i++ {
+		if _, err := ReadRequest(bytes.NewReader(b[:i])); err == nil {
+			t.Errorf("expect error reading %d of %d bytes", i, len(b))
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-tcp-transport"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	req := Request{Service: "lan", Dest: "web.lan:443"}
+	if err := WriteRequest(buf, req); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadRequest(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != req {
+		t.Errorf(" Expect: %+v\n Get: %+v\n", req, got)
+	}
+
+	if err := WriteResponse(buf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadResponse(buf); err != nil {
+		t.Errorf("accepted response returned %v", err)
+	}
+	if err := WriteResponse(buf, "no way"); err != nil {
+		t.Fatal(err)
+	}
+	var refused *RefusedError
+	if err := ReadResponse(buf); !errors.As(err, &refused) || refused.Reason != "no way" {
+		t.Errorf("expect refusal with reason, get %v", err)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	if err := WriteFrame(io.Discard, make([]byte, MaxFrameSize+1)); err == nil {
+		t.Error("expect error writing oversized frame")
+	}
+}
+
+// newHost creates a host listening on the loopback interface only.
+func newHost(t *testing.T) host.Host {
+	h, err := libp2p.New(
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+		libp2p.Transport(tcp.NewTCPTransport),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// pair returns an agent and a connector knowing each other as "agent" and
+// "connector".
+func pair(t *testing.T, authorize func(string, Request) error) (*Agent, *Connector) {
+	ha, hc := newHost(t), newHost(t)
+	hc.Peerstore().AddAddrs(ha.ID(), ha.Addrs(), peerstore.PermanentAddrTTL)
+
+	a, err := NewAgent(Options{
+		Host:      ha,
+		Peers:     map[string]peer.ID{"connector": hc.ID()},
+		Authorize: authorize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	c, err := NewConnector(Options{Host: hc, Peers: map[string]peer.ID{"agent": ha.ID()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, c
+}
+
+func TestDialListen(t *testing.T) {
+	a, c := pair(t, nil)
+	l, err := a.Listen("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := c.Dial(ctx, "agent", "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := []byte("hello through the tunnel")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, reply) {
+		t.Errorf(" Expect: %s\n Get: %s\n", msg, reply)
+	}
+	if got := conn.RemoteAddr().(*Addr); got.Peer != l.Addr().(*Addr).Peer || got.Service != "echo" {
+		t.Errorf("unexpected remote address %s", got)
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	a, c := pair(t, func(name string, req Request) error {
+		if req.Service == "secret" {
+			return errors.New("not for " + name)
+		}
+		return nil
+	})
+	if _, err := a.Listen("secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for service, reason := range map[string]string{
+		"secret":  "not for connector",
+		"missing": `unknown service "missing"`,
+	} {
+		var refused *RefusedError
+		_, err := c.Dial(ctx, "agent", service)
+		if !errors.As(err, &refused) || refused.Reason != reason {
+			t.Errorf("%s: expect refusal %q, get %v", service, reason, err)
+		}
+	}
+
+	if _, err := c.Dial(ctx, "nobody", "secret"); err == nil {
+		t.Error("expect error dialing an unknown peer")
+	}
+}
+
+func TestUnknownPeerReset(t *testing.T) {
+	a, _ := pair(t, nil)
+	if _, err := a.Listen(DefaultService); err != nil {
+		t.Fatal(err)
+	}
+
+	stranger := newHost(t)
+	stranger.Peerstore().AddAddrs(a.opts.Host.ID(), a.opts.Host.Addrs(), peerstore.PermanentAddrTTL)
+	c, err := NewConnector(Options{Host: stranger, Peers: map[string]peer.ID{"agent": a.opts.Host.ID()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := c.Dial(ctx, "agent", ""); err == nil {
+		t.Error("expect the agent to reset streams of unknown peers")
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	a, _ := pair(t, nil)
+	l, err := a.Listen("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Listen("web"); err == nil {
+		t.Error("expect error listening twice on a service")
+	}
+	l.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Error("expect error accepting on a closed listener")
+	}
+	if _, err := a.Listen("web"); err != nil {
+		t.Errorf("listen again after close: %v", err)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { handshakeTimeout = timeout }(handshakeTimeout)
+	handshakeTimeout = 100 * time.Millisecond
+
+	a, c := pair(t, nil)
+	if _, err := a.Listen(DefaultService); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := c.opts.Host.NewStream(ctx, a.opts.Host.ID(), Protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Send half a request and wait for the agent to give up on the rest.
+	if err := WriteFrame(s, []byte(DefaultService)); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read = %v, want the agent to reset the stream", err)
+	}
+}
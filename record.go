@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/p2ptunnel/p2ptunnel/pkg/recorder"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// streamRecorder records the bytes of all tunnels with --record. It is set
+// before the stream handlers reading it are installed.
+var streamRecorder *recorder.Recorder
+
+var (
+	recordFlag = cli.StringFlag{
+		Name:  "record",
+		Usage: "record the bytes passing through tunnels to this file, see the dump command",
+	}
+	recordSizeFlag = cli.Int64Flag{
+		Name:  "record-max-size",
+		Usage: "rotate the recording after this many MiB",
+		Value: 100,
+	}
+	recordFilesFlag = cli.IntFlag{
+		Name:  "record-files",
+		Usage: "keep this many rotated recordings",
+		Value: 5,
+	}
+)
+
+// startRecording starts recording tunnels if --record is given.
+func startRecording(ctx *cli.Context) error {
+	path := ctx.String("record")
+	if path == "" {
+		return nil
+	}
+	r, err := recorder.New(path, recorder.Options{
+		MaxSize:  ctx.Int64("record-max-size") << 20,
+		MaxFiles: ctx.Int("record-files"),
+		OnError: func(err error) {
+			logger.Errorw("recording stopped", "file", path, "error", err)
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "start recording")
+	}
+	streamRecorder = r
+	logger.Infow("recording tunnels", "file", path)
+	return nil
+}
+
+// stopRecording closes the recording of tunnels.
+func stopRecording() {
+	if streamRecorder == nil {
+		return
+	}
+	if err := streamRecorder.Close(); err != nil {
+		logger.Errorw("close recording", "error", err)
+	}
+}
+
+// dump prints recordings of tunnels, in the order of the files given.
+func dump(ctx *cli.Context) error {
+	if len(ctx.Args()) == 0 {
+		return errors.New("Please provide the recordings to dump, the oldest first")
+	}
+	for _, path := range ctx.Args() {
+		if err := dumpFile(ctx, path); err != nil {
+			return errors.Wrap(err, path)
+		}
+	}
+	return nil
+}
+
+func dumpFile(ctx *cli.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := recorder.NewReader(f)
+	if err != nil {
+		return err
+	}
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			fmt.Printf("%s: recording cut off\n", path)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !dumpMatches(ctx, rec) {
+			continue
+		}
+
+		head := fmt.Sprintf("%s  #%d %s/%s", rec.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), rec.Stream, rec.Info.Peer, rec.Info.Service)
+		switch rec.Kind {
+		case recorder.KindOpen:
+			fmt.Printf("%s  open, %s tunnel\n", head, rec.Info.Direction)
+		case recorder.KindClose:
+			fmt.Printf("%s  close\n", head)
+		default:
+			arrow := "<-"
+			if rec.Kind == recorder.KindOut {
+				arrow = "->"
+			}
+			fmt.Printf("%s  %s %d bytes\n", head, arrow, len(rec.Data))
+			if ctx.Bool("text") {
+				fmt.Println(strings.TrimSuffix(printable(rec.Data), "\n"))
+			} else {
+				fmt.Print(hex.Dump(rec.Data))
+			}
+		}
+	}
+}
+
+// dumpMatches reports whether rec passes the filters of the dump command.
+func dumpMatches(ctx *cli.Context, rec *recorder.Record) bool {
+	if ctx.IsSet("stream") && rec.Stream != ctx.Uint64("stream") {
+		return false
+	}
+	if ctx.String("peer") != "" && rec.Info.Peer != ctx.String("peer") {
+		return false
+	}
+	if ctx.String("service") != "" && rec.Info.Service != ctx.String("service") {
+		return false
+	}
+	return true
+}
+
+// printable returns b as text, replacing invalid UTF-8 and control characters
+// other than line breaks and tabs by dots.
+func printable(b []byte) string {
+	out := make([]rune, 0, len(b))
+	for len(b) > 0 {
+		c, size := utf8.DecodeRune(b)
+		b = b[size:]
+		switch {
+		case c == '\r' && len(b) > 0 && b[0] == '\n':
+			continue
+		case c == '\n' || c == '\t':
+		case c == utf8.RuneError || c < 0x20 || c == 0x7f:
+			c = '.'
+		}
+		out = append(out, c)
+	}
+	return string(out)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// reloadDebounce collapses the burst of events editors emit when saving a file.
+const reloadDebounce = 500 * time.Millisecond
+
+// watchConf re-reads configFile on SIGHUP, and on every change of the file when
+// watch is set, and hands the new config to apply. A config that fails to load
+// or apply is reported and the running config is kept.
+func watchConf(ctx context.Context, configFile string, watch bool, apply func(*Config) error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events chan fsnotify.Event
+	var errs chan error
+	if watch {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			logger.Warnw("unable to watch config file", "error", err)
+		} else {
+			defer watcher.Close()
+			// Watch the directory rather than the file, so that editors and
+			// tools replacing the file by rename are still noticed.
+			if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+				logger.Warnw("unable to watch config file", "error", err)
+			} else {
+				events = watcher.Events
+				errs = watcher.Errors
+				logger.Infow("watching config for changes", "config", configFile)
+			}
+		}
+	}
+
+	reload := func(reason string) {
+		logger.Infow("reloading config", "config", configFile, "reason", reason)
+		if err := reloadConf(configFile, apply); err != nil {
+			logger.Errorw("reload failed, keeping current config", "error", err)
+		}
+	}
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			reload("SIGHUP")
+		case ev := <-events:
+			if filepath.Clean(ev.Name) != filepath.Clean(configFile) {
+				continue
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			debounce = time.After(reloadDebounce)
+		case err := <-errs:
+			// The watcher blocks once its error channel is full, so errors
+			// have to be drained for events to keep coming.
+			logger.Warnw("watch config file", "error", err)
+		case <-debounce:
+			debounce = nil
+			reload("file changed")
+		}
+	}
+}
+
+// reloadConf reads configFile and hands it to apply.
+func reloadConf(configFile string, apply func(*Config) error) error {
+	conf, err := readConf(configFile)
+	if err != nil {
+		return err
+	}
+	return apply(conf)
+}
+
+// diffPeers describes the peer changes between two configs, one line per peer.
+func diffPeers(oldPeers, newPeers map[string]Peer) []string {
+	var diff []string
+	for name, p := range newPeers {
+		old, ok := oldPeers[name]
+		switch {
+		case !ok:
+			diff = append(diff, fmt.Sprintf("+ peer %s (%s)", name, p.ID))
+		case old.ID != p.ID:
+			diff = append(diff, fmt.Sprintf("~ peer %s (%s -> %s)", name, old.ID, p.ID))
+		case !reflect.DeepEqual(old, p):
+			diff = append(diff, fmt.Sprintf("~ peer %s (access changed)", name))
+		}
+	}
+	for name, p := range oldPeers {
+		if _, ok := newPeers[name]; !ok {
+			diff = append(diff, fmt.Sprintf("- peer %s (%s)", name, p.ID))
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool { return diff[i][2:] < diff[j][2:] })
+	return diff
+}
+
+// diffServices describes the service changes between two configs.
+func diffServices(oldServices, newServices map[string]Service) []string {
+	var diff []string
+	for name, svc := range newServices {
+		old, ok := oldServices[name]
+		switch {
+		case !ok:
+			diff = append(diff, fmt.Sprintf("+ service %s (%s)", name, svc))
+		case old != svc:
+			diff = append(diff, fmt.Sprintf("~ service %s (%s -> %s)", name, old, svc))
+		}
+	}
+	for name, svc := range oldServices {
+		if _, ok := newServices[name]; !ok {
+			diff = append(diff, fmt.Sprintf("- service %s (%s)", name, svc))
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool { return diff[i][2:] < diff[j][2:] })
+	return diff
+}
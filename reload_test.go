@@ -0,0 +1,146 @@
+package main
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffPeers(t *testing.T) {
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	old := map[string]Peer{
+		"laptop": {ID: "QmLaptop"},
+		"phone":  {ID: "QmPhone"},
+		"server": {ID: "QmServer", Services: []string{"ssh"}},
+		"tablet": {ID: "QmTablet"},
+	}
+	tests := []struct {
+		name  string
+		peers map[string]Peer
+		want  []string
+	}{
+		{"unchanged", old, nil},
+		{"added", map[string]Peer{
+			"laptop": {ID: "QmLaptop"},
+			"phone":  {ID: "QmPhone"},
+			"server": {ID: "QmServer", Services: []string{"ssh"}},
+			"tablet": {ID: "QmTablet"},
+			"desk":   {ID: "QmDesk"},
+		}, []string{"+ peer desk (QmDesk)"}},
+		{"changed", map[string]Peer{
+			"laptop": {ID: "QmLaptop2"},
+			"phone":  {ID: "QmPhone", Expires: &expires},
+			"server": {ID: "QmServer", Services: []string{"ssh", "web"}},
+			"tablet": {ID: "QmTablet"},
+		}, []string{
+			"~ peer laptop (QmLaptop -> QmLaptop2)",
+			"~ peer phone (access changed)",
+			"~ peer server (access changed)",
+		}},
+		{"removed and added", map[string]Peer{
+			"laptop": {ID: "QmLaptop"},
+			"phone":  {ID: "QmPhone"},
+			"server": {ID: "QmServer", Services: []string{"ssh"}},
+			"watch":  {ID: "QmWatch"},
+		}, []string{"- peer tablet (QmTablet)", "+ peer watch (QmWatch)"}},
+		{"all removed", nil, []string{
+			"- peer laptop (QmLaptop)",
+			"- peer phone (QmPhone)",
+			"- peer server (QmServer)",
+			"- peer tablet (QmTablet)",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffPeers(old, tt.peers); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffPeers() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffServices(t *testing.T) {
+	old := map[string]Service{
+		"ssh":   {Addr: "localhost:22"},
+		"web":   {Addr: "localhost:8080"},
+		"proxy": {Proxy: true},
+	}
+	tests := []struct {
+		name     string
+		services map[string]Service
+		want     []string
+	}{
+		{"unchanged", old, nil},
+		{"changed", map[string]Service{
+			"ssh":   {Addr: "localhost:2222"},
+			"web":   {Proxy: true},
+			"proxy": {Proxy: true},
+		}, []string{
+			"~ service ssh (localhost:22 -> localhost:2222)",
+			"~ service web (localhost:8080 -> proxy)",
+		}},
+		{"added and removed", map[string]Service{
+			"ssh": {Addr: "localhost:22"},
+			"db":  {Addr: "localhost:5432"},
+		}, []string{
+			"+ service db (localhost:5432)",
+			"- service proxy (proxy)",
+			"- service web (localhost:8080)",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffServices(old, tt.services); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffServices() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestReloadKeepsConfig checks that the agent keeps running with its config
+// when the new one can't be read or is invalid.
+func TestReloadKeepsConfig(t *testing.T) {
+	conf, file := newTestConf(t)
+	laptopID, err := peer.IDFromPrivateKey(newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop := laptopID.Pretty()
+	conf.Services = map[string]Service{"ssh": {Addr: "localhost:22"}}
+	conf.Peers["laptop"] = Peer{ID: laptop}
+	if err := writeConf(file, conf); err != nil {
+		t.Fatal(err)
+	}
+	running, err := readConf(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTestServer(t, newTestHost(t, newTestKey(t)), running)
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not yaml", "peers: [\n"},
+		{"invalid peer", "name: home\nid: " + conf.ID + "\npeers:\n  laptop:\n    id: nope\n"},
+		{"no name", "id: " + conf.ID + "\npeers: {}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(file, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := reloadConf(file, a.reload); err == nil {
+				t.Fatal("reloaded a bad config")
+			}
+			if a.config() != running {
+				t.Error("bad config replaced the running one")
+			}
+			if _, ok := a.lookupPeer(laptop); !ok {
+				t.Error("peer of the running config was dropped")
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/p2ptunnel/p2ptunnel/pkg/httplogger"
+	"github.com/p2ptunnel/p2ptunnel/pkg/tunnel"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// replay re-issues the requests of a HAR capture through tunnels to a peer and
+// reports the responses differing from the captured ones.
+func replay(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.New("Please provide the HAR file to replay")
+	}
+	peerName := ctx.String("peer")
+	if peerName == "" {
+		return errors.New("Please provide the peer to send the requests to with --peer")
+	}
+	f, err := os.Open(ctx.Args()[0])
+	if err != nil {
+		return err
+	}
+	har, err := httplogger.ReadHAR(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	entries := har.Log.Entries
+	if len(entries) == 0 {
+		fmt.Printf("%s holds no requests\n", ctx.Args()[0])
+		return nil
+	}
+
+	cctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node, connector, err := newClient(cctx, ctx)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	clients := make(map[string]*http.Client)
+	clientFor := func(service string) *http.Client {
+		if c, ok := clients[service]; ok {
+			return c
+		}
+		c := replayClient(connector, peerName, service)
+		clients[service] = c
+		return c
+	}
+
+	differ, skipped := 0, 0
+	for i := range entries {
+		e := &entries[i]
+		service := ctx.String("service")
+		if service == "" {
+			service = e.Service
+		}
+		diff, err := replayEntry(cctx, clientFor(service), e, ctx.Duration("timeout"))
+		if err != nil {
+			skipped++
+			fmt.Printf("SKIP  %s %s\n      %v\n", e.Request.Method, e.Request.URL, err)
+			continue
+		}
+		if len(diff) == 0 {
+			fmt.Printf("ok    %s %s\n", e.Request.Method, e.Request.URL)
+			continue
+		}
+		differ++
+		fmt.Printf("DIFF  %s %s\n", e.Request.Method, e.Request.URL)
+		for _, d := range diff {
+			fmt.Printf("      %s\n", d)
+		}
+	}
+	if differ > 0 {
+		return errors.Errorf("%d of %d responses differ", differ, len(entries)-skipped)
+	}
+	if skipped > 0 {
+		fmt.Printf("All %d responses match, %d requests not replayable\n", len(entries)-skipped, skipped)
+		return nil
+	}
+	fmt.Printf("All %d responses match\n", len(entries))
+	return nil
+}
+
+// replayClient returns an HTTP client sending its requests through tunnels to
+// service of the named peer. It doesn't follow redirects, so that they can be
+// compared.
+func replayClient(c *tunnel.Connector, peerName, service string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return c.Dial(ctx, peerName, service)
+			},
+			DisableCompression: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// replayEntry sends the request of e and returns how the response differs. It
+// fails if the request can't be replayed, e.g. as its body was truncated.
+func replayEntry(ctx context.Context, client *http.Client, e *httplogger.HAREntry, timeout time.Duration) ([]string, error) {
+	req, err := e.NewRequest()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return []string{"read body: " + err.Error()}, nil
+	}
+	return e.Diff(res, body), nil
+}
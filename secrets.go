@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Environment variables overriding the private key of the config file. The
+// key is the base64 encoded marshaled private key.
+const (
+	privateKeyEnv     = "P2PTUNNEL_PRIVATE_KEY"
+	privateKeyFileEnv = "P2PTUNNEL_PRIVATE_KEY_FILE"
+)
+
+// resolvePrivateKey loads the private key from the environment or from the
+// key file of conf. The key is kept out of the marshaled config, so it never
+// ends up in the config file when that is rewritten. Only commands using the
+// key resolve it, the others work without access to it.
+func resolvePrivateKey(conf *Config, configFile string) error {
+	if key, ok := os.LookupEnv(privateKeyEnv); ok {
+		data, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return errors.Wrapf(err, "decode %s", privateKeyEnv)
+		}
+		return conf.setResolvedKey(data, privateKeyEnv)
+	}
+
+	file, ok := os.LookupEnv(privateKeyFileEnv)
+	if !ok {
+		if conf.PrivateKeyFile == "" {
+			return nil
+		}
+		file = conf.keyFilePath(configFile)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "read private key file")
+	}
+	key, err := decodeKeyFile(data)
+	if err != nil {
+		return errors.Wrapf(err, "private key file %s", file)
+	}
+	return conf.setResolvedKey(key, file)
+}
+
+// setResolvedKey makes key, read from source, the private key of conf. It
+// fails if the key doesn't belong to the ID of the config, as a node started
+// with it would not be the peer its peers know.
+func (c *Config) setResolvedKey(key []byte, source string) error {
+	priv, err := crypto.UnmarshalPrivateKey(key)
+	if err != nil {
+		return errors.Wrapf(err, "private key from %s", source)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	if id.Pretty() != c.ID {
+		return errors.Errorf("private key from %s belongs to %s, not to id %s of the config", source, id.Pretty(), c.ID)
+	}
+	c.resolvedKey = string(key)
+	c.keySource = source
+	return nil
+}
+
+// keyFilePath resolves PrivateKeyFile relative to the directory of the config.
+func (c *Config) keyFilePath(configFile string) string {
+	if filepath.IsAbs(c.PrivateKeyFile) {
+		return c.PrivateKeyFile
+	}
+	return filepath.Join(filepath.Dir(configFile), c.PrivateKeyFile)
+}
+
+// decodeKeyFile accepts both the raw marshaled private key, as written by
+// `init --key-file`, and its base64 encoding.
+func decodeKeyFile(data []byte) ([]byte, error) {
+	if _, err := crypto.UnmarshalPrivateKey(data); err == nil {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, errors.New("neither a raw nor a base64 encoded private key")
+	}
+	if _, err := crypto.UnmarshalPrivateKey(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeKeyFile writes the marshaled private key, readable by the owner only.
+func writeKeyFile(file string, key []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, key, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(file, 0600)
+}
+
+// stageKeyFile writes key to a temporary file next to file, readable by the
+// owner only, and returns its name. Renaming it over file replaces the key
+// at once, after the config referring to the new key has been saved.
+func stageKeyFile(file string, key []byte) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(key)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// redact removes every secret from conf, leaving a config safe to share.
+func (c *Config) redact() {
+	c.PrivateKey = ""
+	c.EncryptedKey = nil
+	c.Invites = nil
+}
+
+func exportConfig(ctx *cli.Context) error {
+	conf, err := readConf(ctx.GlobalString("conf"))
+	if err != nil {
+		return err
+	}
+	if ctx.Bool("redact") {
+		conf.redact()
+	}
+	return yaml.NewEncoder(os.Stdout).Encode(conf)
+}
+
+// keyElsewhere returns an error if the private key of conf doesn't live in the
+// config file itself, so commands rewriting the key don't write it to the
+// wrong place.
+func (c *Config) keyElsewhere() error {
+	if c.keySource == "" {
+		return nil
+	}
+	return errors.Errorf("the private key is read from %s, update it there", c.keySource)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolvePrivateKey(t *testing.T) {
+	conf, file := newTestConf(t)
+	dir := filepath.Dir(file)
+	key := []byte(conf.PrivateKey)
+	other, err := crypto.MarshalPrivateKey(newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"conf.key":   key,
+		"env.key":    []byte(base64.StdEncoding.EncodeToString(key) + "\n"),
+		"other.key":  other,
+		"broken.key": []byte("not a key"),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		env        string
+		envFile    string
+		keyFile    string
+		wantSource string
+		wantErr    bool
+	}{
+		{name: "inline key", wantSource: ""},
+		{name: "config key file", keyFile: "conf.key", wantSource: filepath.Join(dir, "conf.key")},
+		{name: "absolute key file", keyFile: filepath.Join(dir, "conf.key"), wantSource: filepath.Join(dir, "conf.key")},
+		{name: "env file over config", envFile: filepath.Join(dir, "env.key"), keyFile: "other.key",
+			wantSource: filepath.Join(dir, "env.key")},
+		{name: "env over all", env: base64.StdEncoding.EncodeToString(key), envFile: filepath.Join(dir, "other.key"),
+			keyFile: "other.key", wantSource: privateKeyEnv},
+		{name: "missing key file", keyFile: "missing.key", wantErr: true},
+		{name: "broken key file", keyFile: "broken.key", wantErr: true},
+		{name: "key of other peer", keyFile: "other.key", wantErr: true},
+		{name: "env key of other peer", env: base64.StdEncoding.EncodeToString(other), wantErr: true},
+		{name: "env not base64", env: "!", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv(privateKeyEnv, tt.env)
+			}
+			if tt.envFile != "" {
+				t.Setenv(privateKeyFileEnv, tt.envFile)
+			}
+			c := *conf
+			c.PrivateKeyFile = tt.keyFile
+			err := resolvePrivateKey(&c, file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolvePrivateKey() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if c.keySource != tt.wantSource {
+				t.Errorf("key read from %q, want %q", c.keySource, tt.wantSource)
+			}
+			if c.plainKey() != string(key) {
+				t.Error("resolved the wrong key")
+			}
+		})
+	}
+}
+
+// TestReadConfWithoutKey checks that commands which don't need the private
+// key work while the key file isn't available.
+func TestReadConfWithoutKey(t *testing.T) {
+	conf, file := newTestConf(t)
+	conf.PrivateKey = ""
+	conf.PrivateKeyFile = "missing.key"
+	if err := writeConf(file, conf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readConf(file); err != nil {
+		t.Fatal(err)
+	}
+	ctx := newTestContext(map[string]string{"conf": file}, nil)
+	if _, err := loadPrivateKey(ctx, conf); err == nil {
+		t.Error("loaded a missing private key")
+	}
+	if err := validateConf(ctx); err == nil {
+		t.Error("validated a config with a missing key file")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	conf, _ := newTestConf(t)
+	conf.EncryptedKey = &EncryptedKey{KDF: kdfArgon2id, Ciphertext: "secret"}
+	conf.Invites = []Invite{{Secret: "00", Expires: time.Now()}}
+	conf.Peers["laptop"] = Peer{ID: peer.ID("laptop").Pretty()}
+	conf.Services = map[string]Service{"ssh": {Addr: "localhost:22"}}
+	conf.redact()
+	if conf.PrivateKey != "" || conf.EncryptedKey != nil || conf.Invites != nil {
+		t.Errorf("secrets left after redact: %+v", conf)
+	}
+	if conf.ID == "" || len(conf.Peers) != 1 || len(conf.Services) != 1 {
+		t.Errorf("redact removed more than the secrets: %+v", conf)
+	}
+}
@@ -0,0 +1,49 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"os"
+	"strings"
+)
+
+// readPassword prompts on the controlling terminal and reads a line with echo
+// turned off.
+func readPassword(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "no terminal to read the passphrase from")
+	}
+	defer tty.Close()
+
+	fd := int(tty.Fd())
+	state, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, errors.Wrap(err, "no terminal to read the passphrase from")
+	}
+	noEcho := *state
+	noEcho.Lflag &^= unix.ECHO
+	noEcho.Lflag |= unix.ICANON | unix.ISIG
+	noEcho.Iflag |= unix.ICRNL
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &noEcho); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := unix.IoctlSetTermios(fd, ioctlSetTermios, state); err != nil {
+			fmt.Fprintf(os.Stderr, "restore terminal: %v\n", err)
+		}
+	}()
+
+	fmt.Fprint(tty, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	fmt.Fprintln(tty)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
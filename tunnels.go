@@ -0,0 +1,171 @@
+package main
+
+import (
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/p2ptunnel/p2ptunnel/pkg/recorder"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelStats describes an open tunnel for the admin API. BytesIn counts the
+// bytes received from the peer, BytesOut those sent to it.
+type tunnelStats struct {
+	// The counters come first to keep them 64-bit aligned for atomic access.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+
+	ID uint64 `json:"id"`
+	// Direction is "in" for tunnels opened by peers, "out" for our own.
+	Direction string    `json:"direction"`
+	Peer      string    `json:"peer"`
+	Service   string    `json:"service"`
+	Dest      string    `json:"dest,omitempty"`
+	Local     string    `json:"local"`
+	Started   time.Time `json:"started"`
+
+	// rec records the tunnel with --record.
+	rec *recorder.Stream
+}
+
+// tunnelTable tracks the open tunnels of the process.
+type tunnelTable struct {
+	lock sync.Mutex
+	next uint64
+	open map[uint64]*tunnelStats
+}
+
+var tunnels = &tunnelTable{open: make(map[uint64]*tunnelStats)}
+
+// add registers a new tunnel and returns it with its ID and start time set,
+// starting its recording.
+func (t *tunnelTable) add(s *tunnelStats) *tunnelStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.next++
+	s.ID = t.next
+	s.Started = time.Now()
+	s.rec = streamRecorder.Stream(recorder.StreamInfo{
+		Peer:      s.Peer,
+		Service:   s.Service,
+		Direction: s.Direction,
+	})
+	t.open[s.ID] = s
+	return s
+}
+
+// remove unregisters the tunnel and ends its recording.
+func (t *tunnelTable) remove(s *tunnelStats) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.open, s.ID)
+	s.rec.Close()
+}
+
+// list returns a snapshot of the open tunnels, oldest first.
+func (t *tunnelTable) list() []tunnelStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	list := make([]tunnelStats, 0, len(t.open))
+	for _, s := range t.open {
+		c := *s
+		c.BytesIn = atomic.LoadInt64(&s.BytesIn)
+		c.BytesOut = atomic.LoadInt64(&s.BytesOut)
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (t *tunnelTable) count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.open)
+}
+
+// countingStream counts the bytes passing through a stream in the stats of
+// its tunnel and in the tunnel metrics, and records them with --record.
+// The stats have to be added to the tunnel table first.
+type countingStream struct {
+	network.Stream
+	stats   *tunnelStats
+	in, out prometheus.Counter
+}
+
+func newCountingStream(s network.Stream, stats *tunnelStats) *countingStream {
+	return &countingStream{
+		Stream: s,
+		stats:  stats,
+		in:     tunnelBytes.WithLabelValues(stats.Peer, stats.Service, "in"),
+		out:    tunnelBytes.WithLabelValues(stats.Peer, stats.Service, "out"),
+	}
+}
+
+func (s *countingStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	atomic.AddInt64(&s.stats.BytesIn, int64(n))
+	s.in.Add(float64(n))
+	s.stats.rec.In(b[:n])
+	return n, err
+}
+
+func (s *countingStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	atomic.AddInt64(&s.stats.BytesOut, int64(n))
+	s.out.Add(float64(n))
+	s.stats.rec.Out(b[:n])
+	return n, err
+}
+
+// pipe copies between a tunnel stream and a local connection in both
+// directions, passing the bytes read from each side to fromStream and
+// fromLocal, which may be nil. Once one side finished sending, the other is
+// closed for writing. On errors both sides are closed right away. It returns
+// when both directions are done, with the first error.
+func pipe(stream network.Stream, local io.ReadWriteCloser, fromStream, fromLocal func([]byte)) error {
+	errs := make(chan error, 2)
+	copyTo := func(dst io.Writer, src io.Reader, tap func([]byte), closeWrite func() error) {
+		_, err := io.Copy(tapWriter{dst, tap}, src)
+		if err != nil {
+			stream.Reset()
+			local.Close()
+		} else {
+			closeWrite()
+		}
+		errs <- err
+	}
+	go copyTo(local, stream, fromStream, func() error { return closeWrite(local) })
+	go copyTo(stream, local, fromLocal, stream.CloseWrite)
+
+	err := <-errs
+	if err2 := <-errs; err == nil {
+		err = err2
+	}
+	stream.Close()
+	local.Close()
+	return err
+}
+
+// closeWrite closes c for writing, or entirely if it can't be half closed.
+func closeWrite(c io.Closer) error {
+	if hc, ok := c.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return c.Close()
+}
+
+// tapWriter passes the bytes written to tap before writing them.
+type tapWriter struct {
+	io.Writer
+	tap func([]byte)
+}
+
+func (w tapWriter) Write(b []byte) (int, error) {
+	if w.tap != nil {
+		w.tap(b)
+	}
+	return w.Writer.Write(b)
+}
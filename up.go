@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/p2ptunnel/p2ptunnel/pkg/tunnel"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"net"
+	"sync"
+	"time"
+)
+
+// Delays before a failed forward is restarted, doubling while it keeps
+// failing. A forward that ran for forwardRestartMax starts over at the minimum.
+const (
+	forwardRestartMin = time.Second
+	forwardRestartMax = time.Minute
+)
+
+// up runs every service and forward of the config in a single node: the
+// services as the agent does, and each forward as a connector of its own.
+func up(ctx *cli.Context) error {
+	configFile := ctx.GlobalString("conf")
+	conf, err := readConf(configFile)
+	if err != nil {
+		return err
+	}
+	if len(conf.Services) == 0 && len(conf.Forwards) == 0 {
+		return errors.New("Please configure services or forwards to bring up")
+	}
+	a, err := newAgentServer(conf, 0)
+	if err != nil {
+		return err
+	}
+
+	// Setup System Context
+	cctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Recording starts before the stream handlers which record tunnels.
+	if err := startRecording(ctx); err != nil {
+		return err
+	}
+	defer stopRecording()
+
+	// Create P2P Node
+	logger.Infow("creating libp2p node", "id", conf.ID)
+	key, err := loadPrivateKey(ctx, conf)
+	if err != nil {
+		return err
+	}
+	host, dht, err := CreateNode(
+		cctx,
+		key,
+		ctx.Uint("port"),
+		a.handleStream,
+	)
+	if err != nil {
+		return err
+	}
+	a.node = host
+
+	host.SetStreamHandler(PairProtocol, a.pairHandler(configFile))
+	host.SetStreamHandler(FileProtocol, a.fileHandler(configFile))
+	go signalExit(cancel, host)
+	go a.enforceGrants(cctx)
+
+	fwd := newForwarder(cctx, host, dht)
+	fwd.apply(conf)
+
+	apply := func(conf *Config) error {
+		if err := a.reload(conf); err != nil {
+			return err
+		}
+		fwd.apply(conf)
+		return nil
+	}
+	go watchConf(cctx, configFile, ctx.Bool("watch"), apply)
+
+	if err := serveMetrics(cctx, ctx.String("metrics-listen"), host); err != nil {
+		return err
+	}
+
+	admin := &adminServer{
+		mode:       "up",
+		name:       conf.Name,
+		configFile: configFile,
+		node:       host,
+		started:    time.Now(),
+		peers:      a.peers,
+		reload:     func() error { return reloadConf(configFile, apply) },
+		forwards:   fwd,
+	}
+	if err := serveAdmin(cctx, adminSocket(ctx), admin); err != nil {
+		logger.Warnw("admin API disabled", "error", err)
+	}
+
+	<-cctx.Done()
+	fwd.wait()
+	return nil
+}
+
+// forwarder runs the forwards of `p2ptunnel up`. Each forward is supervised on
+// its own, so one that fails is restarted without affecting the others.
+type forwarder struct {
+	ctx  context.Context
+	node host.Host
+	dht  *dht.IpfsDHT
+
+	lock    sync.Mutex
+	running map[string]*runningForward
+}
+
+type runningForward struct {
+	Forward
+	id     peer.ID
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newForwarder(ctx context.Context, node host.Host, dht *dht.IpfsDHT) *forwarder {
+	return &forwarder{
+		ctx:     ctx,
+		node:    node,
+		dht:     dht,
+		running: make(map[string]*runningForward),
+	}
+}
+
+// apply starts the forwards of conf which aren't running yet, and stops the
+// running ones which were removed or changed, including their peer's ID.
+func (f *forwarder) apply(conf *Config) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for name, r := range f.running {
+		fwd, ok := conf.Forwards[name]
+		if ok && fwd == r.Forward && conf.Peers[fwd.Peer].ID == r.id.Pretty() {
+			continue
+		}
+		r.cancel()
+		// Wait for the listener to be closed, a changed forward may reuse
+		// its address.
+		<-r.done
+		delete(f.running, name)
+		logger.Infow("stopped forward", "forward", name)
+	}
+
+	for _, name := range sortedKeys(conf.Forwards) {
+		if _, ok := f.running[name]; ok {
+			continue
+		}
+		fwd := conf.Forwards[name]
+		id, err := peer.Decode(conf.Peers[fwd.Peer].ID)
+		if err != nil {
+			logger.Errorw("invalid forward peer", "forward", name, "peer", fwd.Peer, "error", err)
+			continue
+		}
+		ctx, cancel := context.WithCancel(f.ctx)
+		r := &runningForward{Forward: fwd, id: id, cancel: cancel, done: make(chan struct{})}
+		f.running[name] = r
+		go f.supervise(ctx, name, r)
+	}
+}
+
+// list returns the running forwards by name.
+func (f *forwarder) list() map[string]Forward {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	list := make(map[string]Forward, len(f.running))
+	for name, r := range f.running {
+		list[name] = r.Forward
+	}
+	return list
+}
+
+// wait blocks until every forward has stopped.
+func (f *forwarder) wait() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, r := range f.running {
+		<-r.done
+	}
+}
+
+// supervise runs the forward until ctx is done, restarting it whenever it
+// fails.
+func (f *forwarder) supervise(ctx context.Context, name string, r *runningForward) {
+	defer close(r.done)
+
+	delay := forwardRestartMin
+	for {
+		start := time.Now()
+		err := f.run(ctx, name, r)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) >= forwardRestartMax {
+			delay = forwardRestartMin
+		}
+		logger.Warnw("forward failed, restarting", "forward", name, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > forwardRestartMax {
+			delay = forwardRestartMax
+		}
+	}
+}
+
+// run listens on the forward's address and tunnels the connections to its
+// peer until ctx is done or the forward fails.
+func (f *forwarder) run(ctx context.Context, name string, r *runningForward) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = errors.Errorf("panic: %v", p)
+		}
+	}()
+
+	addr, err := net.ResolveTCPAddr("tcp", r.Listen)
+	if err != nil {
+		return err
+	}
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	req := tunnel.Request{Service: r.Service, Dest: r.Dest}
+	if req.Service == "" {
+		req.Service = defaultService
+	}
+	peerTable := map[string]peer.ID{r.Peer: r.id}
+	// Discovery ends with this run, the next one after a restart starts
+	// its own.
+	discoverCtx, stopDiscovery := context.WithCancel(ctx)
+	defer stopDiscovery()
+	go Discover(discoverCtx, f.node, f.dht, peerTable)
+
+	logger.Infow("forwarding", "forward", name, "listen", l.Addr().String(), "peer", r.Peer, "service", req.Service)
+	return serveForward(ctx, f.node, l, peerTable, req)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"net"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a loopback address nothing listens on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitListening fails the test unless addr starts or stops accepting
+// connections, as listening says, within a few seconds.
+func waitListening(t *testing.T, addr string, listening bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+		}
+		if (err == nil) == listening {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s listening is %v, want %v", addr, err == nil, listening)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestForwarderApply(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	node := newTestHost(t, newTestKey(t))
+	home, office := newTestHost(t, newTestKey(t)), newTestHost(t, newTestKey(t))
+	// Connected peers are never looked up in the DHT, which the test
+	// doesn't have.
+	for _, h := range []host.Host{home, office} {
+		if err := node.Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fwd := newForwarder(ctx, node, nil)
+	defer func() {
+		cancel()
+		fwd.wait()
+	}()
+
+	ssh, web, db, web2 := freeAddr(t), freeAddr(t), freeAddr(t), freeAddr(t)
+	conf := &Config{
+		Peers: map[string]Peer{"home": {ID: home.ID().Pretty()}, "office": {ID: office.ID().Pretty()}},
+		Forwards: map[string]Forward{
+			"ssh": {Listen: ssh, Peer: "home", Service: "ssh"},
+			"web": {Listen: web, Peer: "home", Service: "web"},
+			"db":  {Listen: db, Peer: "office", Service: "db"},
+		},
+	}
+	fwd.apply(conf)
+	for _, addr := range []string{ssh, web, db} {
+		waitListening(t, addr, true)
+	}
+	if got := fwd.list(); len(got) != 3 {
+		t.Fatalf("%d forwards running, want 3", len(got))
+	}
+	running := func(name string) *runningForward {
+		fwd.lock.Lock()
+		defer fwd.lock.Unlock()
+		return fwd.running[name]
+	}
+	sshRun, dbRun := running("ssh"), running("db")
+
+	// Move web, drop db, add it back as db2 and move office to a new ID.
+	moved := newTestHost(t, newTestKey(t))
+	if err := node.Connect(ctx, peer.AddrInfo{ID: moved.ID(), Addrs: moved.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	conf = &Config{
+		Peers: map[string]Peer{"home": {ID: home.ID().Pretty()}, "office": {ID: moved.ID().Pretty()}},
+		Forwards: map[string]Forward{
+			"ssh": {Listen: ssh, Peer: "home", Service: "ssh"},
+			"web": {Listen: web2, Peer: "home", Service: "web"},
+			"db2": {Listen: db, Peer: "office", Service: "db"},
+		},
+	}
+	fwd.apply(conf)
+	waitListening(t, web, false)
+	waitListening(t, web2, true)
+	waitListening(t, db, true)
+	if running("ssh") != sshRun {
+		t.Error("unchanged forward was restarted")
+	}
+	if running("db") != nil {
+		t.Error("removed forward still running")
+	}
+	select {
+	case <-dbRun.done:
+	default:
+		t.Error("removed forward not stopped")
+	}
+	if r := running("db2"); r == nil || r.id != moved.ID() {
+		t.Error("added forward doesn't use the new peer ID")
+	}
+
+	// A forward of an unknown peer is skipped, the others keep running.
+	conf.Forwards["bad"] = Forward{Listen: freeAddr(t), Peer: "nobody"}
+	fwd.apply(conf)
+	if running("bad") != nil {
+		t.Error("forward of an unknown peer started")
+	}
+	if len(fwd.list()) != 3 {
+		t.Errorf("%d forwards running, want 3", len(fwd.list()))
+	}
+
+	fwd.apply(&Config{Peers: conf.Peers})
+	for _, addr := range []string{ssh, web2, db} {
+		waitListening(t, addr, false)
+	}
+	if len(fwd.list()) != 0 {
+		t.Errorf("%d forwards still running", len(fwd.list()))
+	}
+}
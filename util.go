@@ -13,10 +13,10 @@ import (
 	libp2pquic "github.com/libp2p/go-libp2p-quic-transport"
 	"github.com/libp2p/go-tcp-transport"
 	ma "github.com/multiformats/go-multiaddr"
+	"github.com/p2ptunnel/p2ptunnel/pkg/tunnel"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/signal"
 	"strings"
@@ -25,20 +25,93 @@ import (
 	"time"
 )
 
-// Protocol is a descriptor for the p2ptunnel P2P Protocol.
-const Protocol = "/p2ptunnel/0.0.1"
+// Protocol is a descriptor for the p2ptunnel P2P Protocol. Streams start with
+// a tunnel.Request naming the service, answered by the agent before any data.
+const Protocol = tunnel.Protocol
+
+// FileProtocol carries the files of `p2ptunnel send` to the receive directory
+// of an agent, see receiveFile.
+const FileProtocol = "/p2ptunnel/file/0.0.1"
 
 // Config is the main Configuration Struct for Hyprspace.
 type Config struct {
-	Name       string          `yaml:"name"`
-	ID         string          `yaml:"id"`
-	PrivateKey string          `yaml:"private_key"`
-	Peers      map[string]Peer `yaml:"peers"`
+	// Version is the schema version, see configVersion.
+	Version      int           `yaml:"version"`
+	Name         string        `yaml:"name"`
+	ID           string        `yaml:"id"`
+	PrivateKey   string        `yaml:"private_key,omitempty"`
+	EncryptedKey *EncryptedKey `yaml:"encrypted_private_key,omitempty"`
+	// PrivateKeyFile is a file holding the private key, relative to the
+	// config file. P2PTUNNEL_PRIVATE_KEY(_FILE) take precedence over it.
+	PrivateKeyFile string             `yaml:"private_key_file,omitempty"`
+	Services       map[string]Service `yaml:"services,omitempty"`
+	Peers          map[string]Peer    `yaml:"peers"`
+	// Forwards are the local ports tunneled to peers by `p2ptunnel up`.
+	Forwards map[string]Forward `yaml:"forwards,omitempty"`
+	// Revoked lists peer IDs which may no longer connect.
+	Revoked []string `yaml:"revoked,omitempty"`
+	// Invites are the pending invitations handed out by `p2ptunnel invite`.
+	Invites []Invite `yaml:"invites,omitempty"`
+	// Receive lets peers send files to the agent, it is off when nil.
+	Receive *Receive `yaml:"receive,omitempty"`
+
+	// resolvedKey is the private key loaded from keySource, the environment
+	// or a key file, by resolvePrivateKey.
+	resolvedKey string
+	keySource   string
+	// raw is the file content the config was read from, and migratedFrom
+	// the version it was migrated from, or -1.
+	raw          []byte
+	migratedFrom int
+}
+
+// Service is a local service exposed by the agent.
+type Service struct {
+	// Addr is the local address tunnels are forwarded to, e.g. localhost:8000.
+	Addr string `yaml:"addr,omitempty"`
+	// Proxy lets the connector pick the destination, restricted by the
+	// destinations allowed for the peer.
+	Proxy bool `yaml:"proxy,omitempty"`
+}
+
+// Receive is where the agent stores the files sent by peers.
+type Receive struct {
+	// Dir is the directory files are written to, relative to the config file.
+	Dir string `yaml:"dir"`
+	// MaxSize is the size limit of a file in MiB, defaultReceiveMaxSize if 0.
+	MaxSize int64 `yaml:"max_size,omitempty"`
+}
+
+func (s Service) String() string {
+	if s.Proxy {
+		return "proxy"
+	}
+	return s.Addr
 }
 
-// Peer defines a peer in the configuration. We might add more to this later.
+// Forward is a local address tunneled to a service of a peer.
+type Forward struct {
+	// Listen is the local address accepting connections, e.g. localhost:8012.
+	Listen string `yaml:"listen" json:"listen"`
+	// Peer is the name of the agent in peers.
+	Peer string `yaml:"peer" json:"peer"`
+	// Service and Dest are requested from the agent as by the connector's
+	// --service and --dest.
+	Service string `yaml:"service,omitempty" json:"service,omitempty"`
+	Dest    string `yaml:"dest,omitempty" json:"dest,omitempty"`
+}
+
+// Peer defines a peer in the configuration.
 type Peer struct {
 	ID string `yaml:"id"`
+	// Services lists the services the peer may use, all of them when empty.
+	Services []string `yaml:"services,omitempty"`
+	// Destinations lists the address patterns the peer may reach through
+	// proxy services.
+	Destinations []string `yaml:"destinations,omitempty"`
+	// NotBefore and Expires limit the time the peer may open tunnels.
+	NotBefore *time.Time `yaml:"not_before,omitempty"`
+	Expires   *time.Time `yaml:"expires,omitempty"`
 }
 
 func readConf(configFile string) (*Config, error) {
@@ -46,9 +119,23 @@ func readConf(configFile string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	conf := &Config{}
+	conf := &Config{raw: data, migratedFrom: -1}
 	err = yaml.Unmarshal(data, conf)
-	return conf, err
+	if err != nil {
+		return conf, err
+	}
+	from := conf.Version
+	migrated, err := migrateConf(conf)
+	if err != nil {
+		return conf, err
+	}
+	if migrated {
+		conf.migratedFrom = from
+	}
+	if conf.Peers == nil {
+		conf.Peers = make(map[string]Peer)
+	}
+	return conf, nil
 }
 
 // CreateNode creates an internal Libp2p nodes and returns it and it's DHT Discovery service.
@@ -74,6 +161,7 @@ func CreateNode(ctx context.Context, inputKey string, port uint, handler network
 		libp2p.DefaultMuxers,
 		libp2p.Transport(libp2pquic.NewTransport),
 		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.BandwidthReporter(bandwidth),
 		libp2p.FallbackDefaults,
 	)
 	if err != nil {
@@ -144,7 +232,7 @@ func CreateNode(ctx context.Context, inputKey string, port uint, handler network
 
 // Discover starts up a DHT based discovery system finding and adding nodes with the same rendezvous string.
 func Discover(ctx context.Context, h host.Host, dht *dht.IpfsDHT, peerTable map[string]peer.ID) {
-	fmt.Println("[+] Setting Up Node Discovery via DHT")
+	logger.Debug("setting up node discovery via DHT")
 
 	ticker := time.NewTicker(time.Second * 5)
 	defer ticker.Stop()
@@ -170,6 +258,8 @@ func Discover(ctx context.Context, h host.Host, dht *dht.IpfsDHT, peerTable map[
 	}
 }
 
+// prettyDiscovery connects to the peers of peerTable and logs each one reached.
+// It only connects, so agents don't see a tunnel stream without a request.
 func prettyDiscovery(ctx context.Context, node host.Host, peerTable map[string]peer.ID) {
 	// Build a temporary map of peers to limit querying to only those
 	// not connected.
@@ -179,16 +269,15 @@ func prettyDiscovery(ctx context.Context, node host.Host, peerTable map[string]p
 	}
 	for len(tempTable) > 0 {
 		for name, id := range tempTable {
-			stream, err := node.NewStream(ctx, id, Protocol)
-			if err != nil && (strings.HasPrefix(err.Error(), "failed to dial") ||
+			err := node.Connect(ctx, peer.AddrInfo{ID: id})
+			if err != nil && ctx.Err() == nil && (strings.HasPrefix(err.Error(), "failed to dial") ||
 				strings.HasPrefix(err.Error(), "no addresses")) {
 				// Attempt to connect to peers slowly when they aren't found.
 				time.Sleep(5 * time.Second)
 				continue
 			}
 			if err == nil {
-				fmt.Printf("[+] Connection to %s Successful. Network Ready.\n", name)
-				stream.Close()
+				logger.Infow("connected to peer", "peer", name)
 			}
 			delete(tempTable, name)
 		}
@@ -203,13 +292,13 @@ func signalExit(cancel context.CancelFunc, host host.Host) {
 
 	cancel()
 
-	fmt.Println("Received signal, closing host...")
+	logger.Info("received signal, closing host")
 
 	// Shut the node down
 	err := host.Close()
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
 
-	fmt.Println("Received signal, shutting down...")
+	logger.Info("shutting down")
 }